@@ -0,0 +1,687 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/application"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/logging"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+)
+
+//listPageSize is the number of entities that are requested at a time when listing entities
+const listPageSize int = 1000
+
+//entity is an NGSI-LD entity as it is returned by the API
+type entity map[string]interface{}
+
+//adminCommand runs an administrative subcommand with a client and the remaining arguments
+type adminCommand func(client *registryClient, args []string) error
+
+//adminCommands maps the subcommands of the administrative CLI to their implementations
+var adminCommands = map[string]map[string]adminCommand{
+	"devices": {
+		"list":   listDevices,
+		"get":    getDevice,
+		"create": createDevice,
+		"delete": deleteDevice,
+	},
+	"models": {
+		"list":   listDeviceModels,
+		"create": createDeviceModel,
+	},
+	"values": {
+		"tail": tailValues,
+	},
+	"properties": {
+		"list": listControlledProperties,
+	},
+}
+
+//runAdminCommand runs a subcommand such as "devices list" against a running registry if -url is
+//given, or directly against the database otherwise. Both go through the same NGSI-LD API.
+func runAdminCommand(args []string, log logging.Logger) {
+	if len(args) < 2 || adminCommands[args[0]][args[1]] == nil {
+		fmt.Fprintln(os.Stderr, "Usage: iot-device-registry <devices|models|values|properties> <command> [options] [arguments]")
+		fmt.Fprintln(os.Stderr, "\nCommands:")
+		fmt.Fprintln(os.Stderr, "  devices list|get <id>|create <id>|delete <id>")
+		fmt.Fprintln(os.Stderr, "  models list|create <id>")
+		fmt.Fprintln(os.Stderr, "  values tail <device id>")
+		fmt.Fprintln(os.Stderr, "  properties list")
+		os.Exit(2)
+	}
+
+	err := newRegistryClient(log).run(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s failed: %s\n", args[0], args[1], err.Error())
+		os.Exit(1)
+	}
+}
+
+//run runs the subcommand that is named by the first two arguments with the rest of them
+func (client *registryClient) run(args []string) error {
+	return adminCommands[args[0]][args[1]](client, args[2:])
+}
+
+//registryClient sends requests to the NGSI-LD API of a registry, either over HTTP or to a
+//request handler in this process that uses the database
+type registryClient struct {
+	log     logging.Logger
+	baseURL string
+	tenant  string
+	actor   string
+	output  string
+	client  *http.Client
+	stdout  io.Writer
+
+	// openDatabase connects to the database that the registry is configured with
+	openDatabase func() (database.Datastore, error)
+}
+
+func newRegistryClient(log logging.Logger) *registryClient {
+	return &registryClient{
+		log:    log,
+		stdout: os.Stdout,
+		openDatabase: func() (database.Datastore, error) {
+			return database.NewDatabaseConnection(database.NewPostgreSQLConnector(log), log)
+		},
+	}
+}
+
+//parseFlags parses the options that all subcommands share, together with the options that the
+//subcommand adds to the flag set, and connects the client
+func (client *registryClient) parseFlags(flags *flag.FlagSet, args []string) error {
+	flags.StringVar(&client.baseURL, "url", os.Getenv("REGISTRY_URL"), "the URL of a running registry (use the database if empty)")
+	flags.StringVar(&client.tenant, "tenant", "", "the tenant to work with (default tenant if empty)")
+	flags.StringVar(&client.actor, "actor", os.Getenv("USER"), "the actor to record in the audit log")
+	flags.StringVar(&client.output, "o", "table", "the output format, table or json")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if client.output != "table" && client.output != "json" {
+		return fmt.Errorf("output format must be table or json, not \"%s\"", client.output)
+	}
+
+	if client.baseURL != "" {
+		client.baseURL = strings.TrimSuffix(client.baseURL, "/")
+		client.client = &http.Client{Timeout: 30 * time.Second}
+		return nil
+	}
+
+	db, err := client.openDatabase()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the database: %s", err.Error())
+	}
+
+	client.baseURL = "http://localhost"
+	client.client = &http.Client{Transport: inProcessTransport{application.NewRequestHandler(client.log, nil, db)}}
+	return nil
+}
+
+//inProcessTransport serves requests with a handler instead of sending them over the network
+type inProcessTransport struct {
+	handler http.Handler
+}
+
+func (transport inProcessTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	transport.handler.ServeHTTP(w, r)
+	return w.Result(), nil
+}
+
+//do sends a request and decodes the response into result, unless result is nil. Responses
+//with an error status are returned as errors with the detail of the problem.
+func (client *registryClient) do(method, path string, query url.Values, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	requestURL := client.baseURL + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, requestURL, reader)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/ld+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/ld+json")
+	}
+	if client.tenant != "" {
+		req.Header.Set("NGSILD-Tenant", client.tenant)
+	}
+	if client.actor != "" {
+		req.Header.Set("X-Forwarded-User", client.actor)
+	}
+
+	resp, err := client.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		problem := struct {
+			Detail string `json:"detail"`
+		}{}
+		json.Unmarshal(responseBody, &problem)
+		if problem.Detail == "" {
+			problem.Detail = http.StatusText(resp.StatusCode)
+		}
+		return fmt.Errorf("%s (%d)", problem.Detail, resp.StatusCode)
+	}
+
+	if result != nil && len(responseBody) > 0 {
+		err = json.Unmarshal(responseBody, result)
+		if err != nil {
+			return fmt.Errorf("unexpected response from %s: %s", path, err.Error())
+		}
+	}
+
+	return nil
+}
+
+//queryEntities returns all entities of the type that match the query, one page at a time
+func (client *registryClient) queryEntities(typeName string, query url.Values) ([]entity, error) {
+	entities := []entity{}
+
+	for offset := 0; ; offset += listPageSize {
+		params := url.Values{"type": {typeName}, "limit": {strconv.Itoa(listPageSize)}, "offset": {strconv.Itoa(offset)}}
+		for key, values := range query {
+			params[key] = values
+		}
+
+		page := []entity{}
+		err := client.do(http.MethodGet, "/ngsi-ld/v1/entities", params, nil, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		entities = append(entities, page...)
+		if len(page) < listPageSize {
+			return entities, nil
+		}
+	}
+}
+
+func listDevices(client *registryClient, args []string) error {
+	flags := flag.NewFlagSet("devices list", flag.ExitOnError)
+	q := flags.String("q", "", "an NGSI-LD query to filter the devices with, e.g. batteryLevel<0.2")
+	err := client.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if *q != "" {
+		query.Set("q", *q)
+	}
+
+	devices, err := client.queryEntities("Device", query)
+	if err != nil {
+		return err
+	}
+
+	return client.printEntities(devices, []string{"ID", "MODEL", "LOCATION", "NAME", "VALUE", "LAST REPORTED"},
+		func(device entity) []string {
+			return []string{
+				device.id(), device.attribute("refDeviceModel"), device.attribute("location"),
+				device.attribute("name"), device.value(), device.attribute("dateLastValueReported"),
+			}
+		})
+}
+
+func getDevice(client *registryClient, args []string) error {
+	flags := flag.NewFlagSet("devices get", flag.ExitOnError)
+	err := client.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a device id")
+	}
+
+	device := entity{}
+	err = client.do(http.MethodGet, "/ngsi-ld/v1/entities/"+withPrefix(fiware.DeviceIDPrefix, flags.Arg(0)), nil, nil, &device)
+	if err != nil {
+		return err
+	}
+
+	if client.output == "json" {
+		return client.printJSON(device)
+	}
+
+	// A single entity is shown with one attribute per row
+	names := []string{}
+	for name := range device {
+		if name != "@context" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	rows := [][]string{}
+	for _, name := range names {
+		if name == "value" {
+			rows = append(rows, []string{name, device.value()})
+		} else {
+			rows = append(rows, []string{name, device.attribute(name)})
+		}
+	}
+
+	return client.printTable([]string{"ATTRIBUTE", "VALUE"}, rows)
+}
+
+func createDevice(client *registryClient, args []string) error {
+	flags := flag.NewFlagSet("devices create", flag.ExitOnError)
+	model := flags.String("model", "", "the id of the device model (required)")
+	lat := flags.Float64("lat", 0, "the latitude of the device")
+	lon := flags.Float64("lon", 0, "the longitude of the device")
+	name := flags.String("name", "", "the name of the device")
+	err := client.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 || *model == "" {
+		return fmt.Errorf("expected a device id and a -model")
+	}
+
+	device := entity{
+		"id":             withPrefix(fiware.DeviceIDPrefix, flags.Arg(0)),
+		"type":           "Device",
+		"refDeviceModel": entity{"type": "Relationship", "object": withPrefix(fiware.DeviceModelIDPrefix, *model)},
+	}
+
+	if *lat != 0 || *lon != 0 {
+		device["location"] = entity{
+			"type":  "GeoProperty",
+			"value": entity{"type": "Point", "coordinates": []float64{*lon, *lat}},
+		}
+	}
+
+	if *name != "" {
+		device["name"] = entity{"type": "Property", "value": *name}
+	}
+
+	err = client.do(http.MethodPost, "/ngsi-ld/v1/entities", nil, device, nil)
+	if err != nil {
+		return err
+	}
+
+	return client.printCreated(device)
+}
+
+func deleteDevice(client *registryClient, args []string) error {
+	flags := flag.NewFlagSet("devices delete", flag.ExitOnError)
+	err := client.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a device id")
+	}
+
+	deviceID := withPrefix(fiware.DeviceIDPrefix, flags.Arg(0))
+	err = client.do(http.MethodDelete, "/ngsi-ld/v1/entities/"+deviceID, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	if client.output == "json" {
+		return client.printJSON(entity{"id": deviceID, "deleted": true})
+	}
+
+	fmt.Fprintf(client.stdout, "Deleted %s\n", deviceID)
+	return nil
+}
+
+func listDeviceModels(client *registryClient, args []string) error {
+	flags := flag.NewFlagSet("models list", flag.ExitOnError)
+	q := flags.String("q", "", "an NGSI-LD query to filter the device models with, e.g. brandName==\"Acme\"")
+	err := client.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if *q != "" {
+		query.Set("q", *q)
+	}
+
+	deviceModels, err := client.queryEntities("DeviceModel", query)
+	if err != nil {
+		return err
+	}
+
+	return client.printEntities(deviceModels, []string{"ID", "CATEGORY", "BRAND", "MODEL NAME", "CONTROLLED PROPERTIES"},
+		func(deviceModel entity) []string {
+			return []string{
+				deviceModel.id(), deviceModel.attribute("category"), deviceModel.attribute("brandName"),
+				deviceModel.attribute("modelName"), deviceModel.attribute("controlledProperty"),
+			}
+		})
+}
+
+func createDeviceModel(client *registryClient, args []string) error {
+	flags := flag.NewFlagSet("models create", flag.ExitOnError)
+	properties := flags.String("properties", "", "the comma separated controlled properties of the model (required)")
+	category := flags.String("category", "sensor", "the comma separated categories of the model")
+	brand := flags.String("brand", "", "the brand name of the model")
+	modelName := flags.String("model-name", "", "the model name of the model")
+	manufacturer := flags.String("manufacturer", "", "the manufacturer name of the model")
+	name := flags.String("name", "", "the name of the model")
+	err := client.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 || *properties == "" {
+		return fmt.Errorf("expected a device model id and -properties")
+	}
+
+	deviceModel := entity{
+		"id":                 withPrefix(fiware.DeviceModelIDPrefix, flags.Arg(0)),
+		"type":               "DeviceModel",
+		"category":           entity{"type": "Property", "value": strings.Split(*category, ",")},
+		"controlledProperty": entity{"type": "Property", "value": strings.Split(*properties, ",")},
+	}
+
+	for attribute, value := range map[string]string{
+		"brandName": *brand, "modelName": *modelName, "manufacturerName": *manufacturer, "name": *name,
+	} {
+		if value != "" {
+			deviceModel[attribute] = entity{"type": "Property", "value": value}
+		}
+	}
+
+	err = client.do(http.MethodPost, "/ngsi-ld/v1/entities", nil, deviceModel, nil)
+	if err != nil {
+		return err
+	}
+
+	return client.printCreated(deviceModel)
+}
+
+//valueInstance is a single value from the history of a device
+type valueInstance struct {
+	ObservedAt time.Time   `json:"observedAt"`
+	Property   string      `json:"property"`
+	Value      interface{} `json:"value"`
+	UnitCode   string      `json:"unitCode,omitempty"`
+}
+
+func tailValues(client *registryClient, args []string) error {
+	flags := flag.NewFlagSet("values tail", flag.ExitOnError)
+	lastN := flags.Int("n", 10, "the number of values to show per controlled property")
+	attrs := flags.String("attrs", "", "the comma separated controlled properties to show (all if empty)")
+	follow := flags.Bool("f", false, "keep polling for new values")
+	interval := flags.Duration("interval", 10*time.Second, "how often to poll for new values with -f")
+	err := client.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a device id")
+	}
+
+	path := "/ngsi-ld/v1/temporal/entities/" + withPrefix(fiware.DeviceIDPrefix, flags.Arg(0))
+	query := url.Values{"lastN": {strconv.Itoa(*lastN)}}
+	if *attrs != "" {
+		query.Set("attrs", *attrs)
+	}
+
+	lastObservedAt := time.Time{}
+
+	for {
+		temporal := entity{}
+		err = client.do(http.MethodGet, path, query, nil, &temporal)
+		if err != nil {
+			return err
+		}
+
+		// The time relation "after" includes values observed at timeAt, that have already been shown
+		values, err := newValueInstancesAfter(temporal, lastObservedAt)
+		if err != nil {
+			return err
+		}
+
+		if len(values) > 0 || lastObservedAt.IsZero() {
+			err = client.printValues(values, lastObservedAt.IsZero())
+			if err != nil {
+				return err
+			}
+		}
+
+		if !*follow {
+			return nil
+		}
+
+		if len(values) > 0 {
+			lastObservedAt = values[len(values)-1].ObservedAt
+			query.Set("timerel", "after")
+			query.Set("timeAt", lastObservedAt.UTC().Format(time.RFC3339Nano))
+			query.Del("lastN")
+		}
+
+		time.Sleep(*interval)
+	}
+}
+
+//newValueInstancesAfter flattens a device in the temporal representation into the values that
+//were observed after the given time, oldest first
+func newValueInstancesAfter(temporal entity, after time.Time) ([]valueInstance, error) {
+	values := []valueInstance{}
+
+	for name, attribute := range temporal {
+		instances, ok := attribute.([]interface{})
+		if !ok || name == "@context" {
+			continue
+		}
+
+		for _, instance := range instances {
+			property, _ := instance.(map[string]interface{})
+			value := valueInstance{Property: name, Value: property["value"]}
+			value.UnitCode, _ = property["unitCode"].(string)
+
+			// The timestamps are compared as times, as their precision varies
+			observedAt, _ := property["observedAt"].(string)
+			var err error
+			value.ObservedAt, err = time.Parse(time.RFC3339Nano, observedAt)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected observedAt \"%s\" of %s", observedAt, name)
+			}
+
+			if value.ObservedAt.After(after) {
+				values = append(values, value)
+			}
+		}
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		if values[i].ObservedAt.Equal(values[j].ObservedAt) {
+			return values[i].Property < values[j].Property
+		}
+		return values[i].ObservedAt.Before(values[j].ObservedAt)
+	})
+
+	return values, nil
+}
+
+//printValues prints the values, with a header row in a table unless they follow earlier values
+func (client *registryClient) printValues(values []valueInstance, header bool) error {
+	if client.output == "json" {
+		return client.printJSON(values)
+	}
+
+	columns := []string{"OBSERVED AT", "PROPERTY", "VALUE", "UNIT"}
+	if !header {
+		columns = nil
+	}
+
+	rows := [][]string{}
+	for _, value := range values {
+		rows = append(rows, []string{
+			value.ObservedAt.UTC().Format(time.RFC3339Nano), value.Property, formatValue(value.Value), value.UnitCode,
+		})
+	}
+
+	return client.printTable(columns, rows)
+}
+
+func listControlledProperties(client *registryClient, args []string) error {
+	flags := flag.NewFlagSet("properties list", flag.ExitOnError)
+	err := client.parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	properties, err := client.queryEntities(application.ControlledPropertyTypeName, nil)
+	if err != nil {
+		return err
+	}
+
+	return client.printEntities(properties, []string{"NAME", "ABBREVIATION", "VALUE TYPE", "UNIT", "ALLOWED VALUES"},
+		func(property entity) []string {
+			return []string{
+				property.attribute("name"), property.attribute("abbreviation"), property.attribute("valueType"),
+				property.attribute("unitCode"), property.attribute("allowedValues"),
+			}
+		})
+}
+
+func (client *registryClient) printEntities(entities []entity, columns []string, row func(entity) []string) error {
+	if client.output == "json" {
+		return client.printJSON(entities)
+	}
+
+	rows := [][]string{}
+	for _, e := range entities {
+		rows = append(rows, row(e))
+	}
+
+	return client.printTable(columns, rows)
+}
+
+func (client *registryClient) printCreated(e entity) error {
+	if client.output == "json" {
+		return client.printJSON(e)
+	}
+
+	fmt.Fprintf(client.stdout, "Created %s\n", e.id())
+	return nil
+}
+
+func (client *registryClient) printJSON(v interface{}) error {
+	encoder := json.NewEncoder(client.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func (client *registryClient) printTable(columns []string, rows [][]string) error {
+	w := tabwriter.NewWriter(client.stdout, 0, 0, 2, ' ', 0)
+	if columns != nil {
+		fmt.Fprintln(w, strings.Join(columns, "\t"))
+	}
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+//value returns the latest values of a device, that are query escaped by the API
+func (e entity) value() string {
+	value := e.attribute("value")
+	if unescaped, err := url.QueryUnescape(value); err == nil {
+		return unescaped
+	}
+	return value
+}
+
+func (e entity) id() string {
+	id, _ := e["id"].(string)
+	return id
+}
+
+//attribute formats the value of a property, the object of a relationship or the coordinates of
+//a GeoProperty for a table cell
+func (e entity) attribute(name string) string {
+	attribute, ok := e[name].(map[string]interface{})
+	if !ok {
+		return formatValue(e[name])
+	}
+
+	if object, ok := attribute["object"]; ok {
+		return formatValue(object)
+	}
+
+	if value, ok := attribute["value"].(map[string]interface{}); ok {
+		if coordinates, ok := value["coordinates"]; ok {
+			return formatValue(coordinates)
+		}
+		if dateTime, ok := value["@value"]; ok {
+			return formatValue(dateTime)
+		}
+	}
+
+	return formatValue(attribute["value"])
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			values = append(values, formatValue(item))
+		}
+		return strings.Join(values, ",")
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+func withPrefix(prefix, id string) string {
+	if strings.HasPrefix(id, prefix) {
+		return id
+	}
+	return prefix + id
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/logging"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+)
+
+func TestMain(m *testing.M) {
+	// The commands must work in-process against the database of the test
+	os.Unsetenv("REGISTRY_URL")
+	os.Exit(m.Run())
+}
+
+func TestThatDevicesCanBeCreatedListedAndDeleted(t *testing.T) {
+	db := newDatabaseForTest(t)
+
+	output := runAdminCommandForTest(t, db, "models", "create", "-properties", "temperature", "livboj")
+	if output != "Created urn:ngsi-ld:DeviceModel:livboj\n" {
+		t.Fatalf("Unexpected output from models create: %q", output)
+	}
+
+	output = runAdminCommandForTest(t, db, "devices", "create", "-model", "livboj", "-lat", "62.3908", "-lon", "17.3069", "-name", "Beach", "sk-01")
+	if output != "Created urn:ngsi-ld:Device:sk-01\n" {
+		t.Fatalf("Unexpected output from devices create: %q", output)
+	}
+
+	lines := strings.Split(strings.TrimSpace(runAdminCommandForTest(t, db, "devices", "list")), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "ID") ||
+		strings.Join(strings.Fields(lines[1]), " ") != "urn:ngsi-ld:Device:sk-01 livboj 17.3069,62.3908 Beach" {
+		t.Errorf("Expected a table with a header and the device, but got %q", lines)
+	}
+
+	devices := []entity{}
+	json.Unmarshal([]byte(runAdminCommandForTest(t, db, "devices", "list", "-o", "json")), &devices)
+	if len(devices) != 1 || devices[0].id() != "urn:ngsi-ld:Device:sk-01" || devices[0].attribute("name") != "Beach" {
+		t.Errorf("Expected the device as JSON, but got %v", devices)
+	}
+
+	output = runAdminCommandForTest(t, db, "devices", "get", "sk-01")
+	if !strings.Contains(output, "ATTRIBUTE") || !strings.Contains(output, "refDeviceModel  livboj") {
+		t.Errorf("Expected a table with one attribute of the device per row, but got %q", output)
+	}
+
+	device := entity{}
+	json.Unmarshal([]byte(runAdminCommandForTest(t, db, "devices", "get", "-o", "json", "urn:ngsi-ld:Device:sk-01")), &device)
+	if device.id() != "urn:ngsi-ld:Device:sk-01" || device.attribute("location") != "17.3069,62.3908" {
+		t.Errorf("Expected the device as JSON, but got %v", device)
+	}
+
+	output = runAdminCommandForTest(t, db, "devices", "delete", "sk-01")
+	if output != "Deleted urn:ngsi-ld:Device:sk-01\n" {
+		t.Errorf("Unexpected output from devices delete: %q", output)
+	}
+
+	client, _ := newRegistryClientForTest(db)
+	err := client.run([]string{"devices", "get", "sk-01"})
+	if err == nil || !strings.Contains(err.Error(), "(404)") {
+		t.Errorf("Expected the deleted device to be gone, but got %v", err)
+	}
+}
+
+func TestThatModelsCreateStoresTheGivenAttributes(t *testing.T) {
+	db := newDatabaseForTest(t)
+
+	runAdminCommandForTest(t, db, "models", "create", "-properties", "temperature,snowDepth", "-brand", "Acme", "-o", "json", "livboj")
+
+	models := []entity{}
+	json.Unmarshal([]byte(runAdminCommandForTest(t, db, "models", "list", "-o", "json")), &models)
+	if len(models) != 1 || models[0].id() != "urn:ngsi-ld:DeviceModel:livboj" || models[0].attribute("brandName") != "Acme" ||
+		models[0].attribute("category") != "sensor" {
+		t.Fatalf("Expected the device model with its brand and default category, but got %v", models)
+	}
+
+	properties := strings.Split(models[0].attribute("controlledProperty"), ",")
+	if len(properties) != 2 {
+		t.Errorf("Expected the device model to have two controlled properties, but got %v", properties)
+	}
+}
+
+func TestThatValuesTailShowsValuesWithMixedPrecisionInChronologicalOrder(t *testing.T) {
+	db := newDatabaseForTest(t)
+
+	runAdminCommandForTest(t, db, "models", "create", "-properties", "temperature", "livboj")
+	runAdminCommandForTest(t, db, "devices", "create", "-model", "livboj", "sk-01")
+
+	start := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	for _, value := range []struct {
+		value      string
+		observedAt time.Time
+	}{
+		{"t=12", start.Add(500 * time.Millisecond)},
+		{"t=11", start},
+		{"t=13", start.Add(time.Second)},
+	} {
+		_, err := db.UpdateDeviceValue("sk-01", value.value, value.observedAt)
+		if err != nil {
+			t.Fatalf("Failed to store device value: %s", err.Error())
+		}
+	}
+
+	values := []valueInstance{}
+	json.Unmarshal([]byte(runAdminCommandForTest(t, db, "values", "tail", "-o", "json", "sk-01")), &values)
+
+	if len(values) != 3 || !values[0].ObservedAt.Equal(start) || formatValue(values[0].Value) != "11" ||
+		!values[1].ObservedAt.Equal(start.Add(500*time.Millisecond)) || !values[2].ObservedAt.Equal(start.Add(time.Second)) ||
+		values[0].UnitCode != "CEL" {
+		t.Errorf("Expected three values in chronological order, but got %+v", values)
+	}
+
+	lines := strings.Split(strings.TrimSpace(runAdminCommandForTest(t, db, "values", "tail", "-n", "1", "sk-01")), "\n")
+	if len(lines) != 2 || strings.Join(strings.Fields(lines[1]), " ") != "2021-05-01T10:00:01Z temperature 13 CEL" {
+		t.Errorf("Expected a table with the last value, but got %q", lines)
+	}
+}
+
+func TestThatTailedValuesAreOnlyShownOnceRegardlessOfTheirPrecision(t *testing.T) {
+	temporal := entity{
+		"id":   "urn:ngsi-ld:Device:sk-01",
+		"type": "Device",
+		"temperature": []interface{}{
+			map[string]interface{}{"type": "Property", "value": 12.0, "observedAt": "2021-05-01T10:00:00.5Z"},
+			map[string]interface{}{"type": "Property", "value": 11.0, "observedAt": "2021-05-01T10:00:00Z"},
+			map[string]interface{}{"type": "Property", "value": 13.0, "observedAt": "2021-05-01T10:00:01Z"},
+		},
+	}
+
+	values, err := newValueInstancesAfter(temporal, time.Date(2021, 5, 1, 10, 0, 0, 500000000, time.UTC))
+	if err != nil || len(values) != 1 || formatValue(values[0].Value) != "13" {
+		t.Errorf("Expected only the value after the last shown value, but got %+v (%v)", values, err)
+	}
+
+	temporal["temperature"] = []interface{}{map[string]interface{}{"type": "Property", "value": 12.0, "observedAt": "yesterday"}}
+	_, err = newValueInstancesAfter(temporal, time.Time{})
+	if err == nil {
+		t.Error("Expected a malformed observedAt to be rejected")
+	}
+}
+
+func newDatabaseForTest(t *testing.T) database.Datastore {
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), logging.NewLogger())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return db
+}
+
+//newRegistryClientForTest returns a client that works in-process against the database, and the
+//buffer that it writes its output to
+func newRegistryClientForTest(db database.Datastore) (*registryClient, *bytes.Buffer) {
+	output := &bytes.Buffer{}
+
+	client := newRegistryClient(logging.NewLogger())
+	client.stdout = output
+	client.openDatabase = func() (database.Datastore, error) {
+		return db, nil
+	}
+
+	return client, output
+}
+
+func runAdminCommandForTest(t *testing.T, db database.Datastore, args ...string) string {
+	client, output := newRegistryClientForTest(db)
+
+	err := client.run(args)
+	if err != nil {
+		t.Fatalf("%s failed: %s", strings.Join(args, " "), err.Error())
+	}
+
+	return output.String()
+}
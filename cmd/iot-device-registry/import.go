@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/application"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/logging"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+)
+
+//importEntities reads devices and device models from a file, or stdin if the file is "-", and
+//prints the outcome of every row. It exits with a non-zero status if any row failed.
+func importEntities(args []string, log logging.Logger) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "the format of the file, jsonld, csv or geojson (default from the file extension)")
+	tenant := flags.String("tenant", "", "the tenant to import into (default tenant if empty)")
+	actor := flags.String("actor", os.Getenv("USER"), "the actor to record in the audit log")
+	dryRun := flags.Bool("dry-run", false, "report what would be imported without changing anything")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: iot-device-registry import [options] <file>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	fileName := flags.Arg(0)
+	if *format == "" {
+		*format = importFormatFromFileName(fileName)
+	}
+
+	var input io.Reader = os.Stdin
+	if fileName != "-" {
+		file, err := os.Open(fileName)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %s", fileName, err.Error())
+		}
+		defer file.Close()
+		input = file
+	}
+
+	db, err := database.NewDatabaseConnection(database.NewPostgreSQLConnector(log), log)
+	if err != nil {
+		log.Fatalf("Failed to connect to the database: %s", err.Error())
+	}
+
+	report, err := application.ImportEntities(log, db, input, application.ImportOptions{
+		Format: *format,
+		Tenant: *tenant,
+		Actor:  *actor,
+		DryRun: *dryRun,
+	})
+	if err != nil {
+		log.Fatalf("Import of %s failed: %s", fileName, err.Error())
+	}
+
+	printImportReport("Import", fileName, report, log)
+}
+
+//printImportReport prints the outcome of every row and exits with a non-zero status if any of
+//them failed
+func printImportReport(operation, fileName string, report application.ImportReport, log logging.Logger) {
+	for _, row := range report.Rows {
+		if row.Error != "" {
+			fmt.Printf("%d\t%s\t%s\t%s\n", row.Row, row.EntityID, row.Status, row.Error)
+		} else {
+			fmt.Printf("%d\t%s\t%s\n", row.Row, row.EntityID, row.Status)
+		}
+	}
+
+	log.Infof(
+		"%s of %s completed (dry run: %t): %d created, %d updated, %d unchanged and %d failed.",
+		operation, fileName, report.DryRun,
+		report.Count(application.ImportStatusCreated), report.Count(application.ImportStatusUpdated),
+		report.Count(application.ImportStatusUnchanged), report.Count(application.ImportStatusFailed),
+	)
+
+	if report.Count(application.ImportStatusFailed) > 0 {
+		os.Exit(1)
+	}
+}
+
+func importFormatFromFileName(fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".csv":
+		return application.ImportFormatCSV
+	case ".geojson":
+		return application.ImportFormatGeoJSON
+	}
+	return application.ImportFormatJSONLD
+}
@@ -1,6 +1,13 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/application"
 	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/logging"
 	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
@@ -12,6 +19,49 @@ func main() {
 	serviceName := "iot-device-registry"
 
 	log := logging.NewLogger()
+
+	// Allow operators to upgrade the database schema without starting the service
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		log.Infof("Migrating database for %s ...", serviceName)
+
+		err := database.MigrateDatabase(database.NewPostgreSQLConnector(log), log)
+		if err != nil {
+			log.Fatalf("Database migration failed: %s", err.Error())
+		}
+
+		log.Infof("Database migration completed.")
+		return
+	}
+
+	// Repair devices that were stored with their latitude and longitude swapped
+	if len(os.Args) > 1 && os.Args[1] == "repair-coordinates" {
+		repairCoordinates(serviceName, os.Args[2:], log)
+		return
+	}
+
+	// Onboard devices and device models from a file
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		importEntities(os.Args[2:], log)
+		return
+	}
+
+	// Back up the registry, or copy it to another environment
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		exportSnapshot(os.Args[2:], log)
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		restoreSnapshot(os.Args[2:], log)
+		return
+	}
+
+	// Inspect and manage the registry, e.g. "devices list"
+	if len(os.Args) > 1 && adminCommands[os.Args[1]] != nil {
+		runAdminCommand(os.Args[1:], log)
+		return
+	}
+
 	log.Infof("Starting up %s ...", serviceName)
 
 	config := messaging.LoadConfiguration(serviceName)
@@ -19,6 +69,69 @@ func main() {
 
 	defer messenger.Close()
 
-	db, _ := database.NewDatabaseConnection(database.NewPostgreSQLConnector(log), log)
+	db, err := database.NewDatabaseConnection(database.NewPostgreSQLConnector(log), log)
+	if err != nil {
+		log.Fatalf("Failed to connect to the database: %s", err.Error())
+	}
+
+	retentionInterval, err := time.ParseDuration(getEnv("RETENTION_JOB_INTERVAL", "1h"))
+	if err != nil {
+		log.Fatalf("Invalid retention job interval: %s", err.Error())
+	}
+
+	auditRetentionDays, err := strconv.Atoi(getEnv("AUDIT_RETENTION_DAYS", "365"))
+	if err != nil || auditRetentionDays < 0 {
+		log.Fatalf("Invalid audit retention: AUDIT_RETENTION_DAYS must be a number of days")
+	}
+
+	application.StartRetentionJob(log, db, retentionInterval, time.Duration(auditRetentionDays)*24*time.Hour)
 	application.CreateRouterAndStartServing(log, messenger, db)
 }
+
+func repairCoordinates(serviceName string, args []string, log logging.Logger) {
+	flags := flag.NewFlagSet("repair-coordinates", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report the devices that would be repaired without changing them")
+	bbox := flags.String("region", "10.5,55.0,24.5,69.5", "the region of the deployment as minLon,minLat,maxLon,maxLat")
+	flags.Parse(args)
+
+	region, err := parseRegion(*bbox)
+	if err != nil {
+		log.Fatalf("Invalid region: %s", err.Error())
+	}
+
+	log.Infof("Repairing swapped device coordinates for %s (dry run: %t) ...", serviceName, *dryRun)
+
+	repairs, err := database.RepairSwappedCoordinates(database.NewPostgreSQLConnector(log), region, *dryRun, log)
+	if err != nil {
+		log.Fatalf("Coordinate repair failed: %s", err.Error())
+	}
+
+	log.Infof("Coordinate repair completed. %d devices had swapped coordinates.", len(repairs))
+}
+
+func parseRegion(bbox string) (database.Region, error) {
+	region := database.Region{}
+
+	parts := strings.Split(bbox, ",")
+	if len(parts) != 4 {
+		return region, fmt.Errorf("expected four comma separated numbers, but got %q", bbox)
+	}
+
+	corners := []*float64{&region.SouthWest[0], &region.SouthWest[1], &region.NorthEast[0], &region.NorthEast[1]}
+	for idx, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return region, fmt.Errorf("%q is not a number", part)
+		}
+		*corners[idx] = value
+	}
+
+	return region, nil
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
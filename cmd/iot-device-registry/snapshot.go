@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/application"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/logging"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+)
+
+//exportSnapshot writes a snapshot of the registry to a file, or to stdout if no file is given
+func exportSnapshot(args []string, log logging.Logger) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", application.SnapshotFormatJSONLD, "the format of the snapshot, jsonld or ndjson")
+	tenant := flags.String("tenant", "", "the tenant to export (default tenant if empty)")
+	values := flags.Bool("values", false, "include the value history of the devices")
+	outputFile := flags.String("o", "-", "the file to write the snapshot to")
+	flags.Parse(args)
+
+	var output io.Writer = os.Stdout
+	if *outputFile != "-" {
+		file, err := os.Create(*outputFile)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %s", *outputFile, err.Error())
+		}
+		defer file.Close()
+		output = file
+	}
+
+	db, err := database.NewDatabaseConnection(database.NewPostgreSQLConnector(log), log)
+	if err != nil {
+		log.Fatalf("Failed to connect to the database: %s", err.Error())
+	}
+
+	buffered := bufio.NewWriter(output)
+	err = application.WriteSnapshot(log, db, buffered, application.SnapshotOptions{
+		Format:        *format,
+		Tenant:        *tenant,
+		IncludeValues: *values,
+	})
+	if err == nil {
+		err = buffered.Flush()
+	}
+
+	if err != nil {
+		log.Fatalf("Export failed: %s", err.Error())
+	}
+}
+
+//restoreSnapshot loads a snapshot into a registry without any devices or device models
+func restoreSnapshot(args []string, log logging.Logger) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	format := flags.String("format", "", "the format of the snapshot, jsonld or ndjson (default from the file extension)")
+	tenant := flags.String("tenant", "", "the tenant to restore into (default tenant if empty)")
+	actor := flags.String("actor", os.Getenv("USER"), "the actor to record in the audit log")
+	dryRun := flags.Bool("dry-run", false, "report what would be restored without changing anything")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: iot-device-registry restore [options] <file>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	fileName := flags.Arg(0)
+	if *format == "" {
+		*format = application.SnapshotFormatJSONLD
+		if strings.ToLower(filepath.Ext(fileName)) == ".ndjson" {
+			*format = application.SnapshotFormatNDJSON
+		}
+	}
+
+	var input io.Reader = os.Stdin
+	if fileName != "-" {
+		file, err := os.Open(fileName)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %s", fileName, err.Error())
+		}
+		defer file.Close()
+		input = bufio.NewReader(file)
+	}
+
+	db, err := database.NewDatabaseConnection(database.NewPostgreSQLConnector(log), log)
+	if err != nil {
+		log.Fatalf("Failed to connect to the database: %s", err.Error())
+	}
+
+	report, err := application.RestoreSnapshot(log, db, input, application.ImportOptions{
+		Format: *format,
+		Tenant: *tenant,
+		Actor:  *actor,
+		DryRun: *dryRun,
+	})
+	if err != nil {
+		log.Fatalf("Restore of %s failed: %s", fileName, err.Error())
+	}
+
+	printImportReport("Restore", fileName, report, log)
+}
@@ -0,0 +1,285 @@
+package application
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/models"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+)
+
+//actorHeader names the user that a request is made on behalf of. The registry does not
+//authenticate users itself, so the header is expected to be set by a reverse proxy, and it is
+//only trusted in requests from one of the trusted proxies.
+const actorHeader string = "X-Forwarded-User"
+
+//trustedProxies are the reverse proxies whose X-Forwarded-User and X-Forwarded-For headers are
+//trusted. The headers are ignored in all other requests, as any client can set them.
+type trustedProxies struct {
+	networks []*net.IPNet
+	all      bool // Trust every request, as when the requests are made in-process
+}
+
+//parseTrustedProxies parses a comma separated list of IP addresses and CIDR networks
+func parseTrustedProxies(list string) (trustedProxies, error) {
+	proxies := trustedProxies{}
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if !strings.Contains(item, "/") {
+			if strings.Contains(item, ":") {
+				item += "/128"
+			} else {
+				item += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return proxies, fmt.Errorf("\"%s\" is not an IP address or a CIDR network", item)
+		}
+
+		proxies.networks = append(proxies.networks, network)
+	}
+
+	return proxies, nil
+}
+
+func (proxies trustedProxies) trusts(address string) bool {
+	if proxies.all {
+		return true
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range proxies.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//requestOrigin tells who made a request and from where, so that the changes can be audited
+type requestOrigin struct {
+	actor    string
+	sourceIP string
+}
+
+//newRequestOrigin attributes a request to the client that sent it, or, if it was sent by a
+//trusted proxy, to the user and client that the proxy forwarded it for
+func newRequestOrigin(r *http.Request, proxies trustedProxies) requestOrigin {
+	origin := requestOrigin{sourceIP: r.RemoteAddr}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		origin.sourceIP = host
+	}
+
+	if !proxies.trusts(origin.sourceIP) {
+		return origin
+	}
+
+	origin.actor = r.Header.Get(actorHeader)
+
+	// Every proxy appends the address that it got the request from, so the client is the last
+	// address that does not belong to a trusted proxy
+	forwardedFor := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for idx := len(forwardedFor) - 1; idx >= 0; idx-- {
+		address := strings.TrimSpace(forwardedFor[idx])
+		if address == "" {
+			continue
+		}
+
+		origin.sourceIP = address
+		if !proxies.trusts(address) {
+			break
+		}
+	}
+
+	return origin
+}
+
+//forAdminRequest is like forRequest, but only serves requests that a trusted proxy has made on
+//behalf of a user, as the admin API exposes the audit log and all the data of a tenant
+func forAdminRequest(cs *contextSource, newHandler contextSourceHandler) http.HandlerFunc {
+	return forRequest(cs, func(tenantSource *contextSource) http.HandlerFunc {
+		if tenantSource.origin.actor == "" {
+			return func(w http.ResponseWriter, r *http.Request) {
+				reportError(w, database.NewError(
+					database.ErrForbidden, "the admin API is only available through a trusted proxy that sets %s", actorHeader,
+				))
+			}
+		}
+
+		return newHandler(tenantSource)
+	})
+}
+
+//reportsValueOnly returns true if an update of the entity only reports a new value of a device.
+//Such updates are telemetry rather than changes of the registry, so they are not audited.
+func reportsValueOnly(entityID string, decodeBodyInto bodyDecoder) bool {
+	if !strings.HasPrefix(entityID, fiware.DeviceIDPrefix) {
+		return false
+	}
+
+	patch, err := newDevicePatch(entityID, decodeBodyInto)
+	return err == nil && patch.Value != nil && !patch.changesDevice()
+}
+
+//audited makes the change in a transaction, together with appending an entry with snapshots
+//of the entity from before and after the change to the audit log
+func (cs *contextSource) audited(operation, entityID string, change func(tx *contextSource) error) error {
+	return cs.withTransaction(func(tx *contextSource) error {
+		before, err := tx.snapshot(entityID)
+		if err != nil {
+			return err
+		}
+
+		err = change(tx)
+		if err != nil {
+			return err
+		}
+
+		after, err := tx.snapshot(entityID)
+		if err != nil {
+			return err
+		}
+
+		return tx.db.AppendAuditEntry(models.AuditEntry{
+			EntityID:   entityID,
+			EntityType: entityTypeFromID(entityID),
+			Operation:  operation,
+			Actor:      cs.origin.actor,
+			SourceIP:   cs.origin.sourceIP,
+			Before:     before,
+			After:      after,
+		})
+	})
+}
+
+//snapshot returns the entity as JSON, or an empty string if it does not exist
+func (cs *contextSource) snapshot(entityID string) (string, error) {
+	entity, err := cs.retrieveEntity(entityID)
+	if errors.Is(err, database.ErrNotFound) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	bytes, err := json.Marshal(entity)
+	if err != nil {
+		return "", fmt.Errorf("failed to create a snapshot of %s: %s", entityID, err.Error())
+	}
+
+	return string(bytes), nil
+}
+
+func entityTypeFromID(entityID string) string {
+	if strings.HasPrefix(entityID, fiware.DeviceIDPrefix) {
+		return "Device"
+	} else if strings.HasPrefix(entityID, fiware.DeviceModelIDPrefix) {
+		return "DeviceModel"
+	} else if strings.HasPrefix(entityID, ControlledPropertyIDPrefix) {
+		return ControlledPropertyTypeName
+	}
+	return ""
+}
+
+//auditEntry is how an audit entry is presented by the audit log API
+type auditEntry struct {
+	ID         uint            `json:"id"`
+	EntityID   string          `json:"entityId"`
+	EntityType string          `json:"entityType"`
+	Operation  string          `json:"operation"`
+	Actor      string          `json:"actor,omitempty"`
+	SourceIP   string          `json:"sourceIP,omitempty"`
+	Timestamp  string          `json:"timestamp"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+}
+
+func newAuditEntry(entry models.AuditEntry) auditEntry {
+	result := auditEntry{
+		ID:         entry.ID,
+		EntityID:   entry.EntityID,
+		EntityType: entry.EntityType,
+		Operation:  entry.Operation,
+		Actor:      entry.Actor,
+		SourceIP:   entry.SourceIP,
+		Timestamp:  entry.Timestamp.UTC().Format(time.RFC3339Nano),
+	}
+
+	if entry.Before != "" {
+		result.Before = json.RawMessage(entry.Before)
+	}
+
+	if entry.After != "" {
+		result.After = json.RawMessage(entry.After)
+	}
+
+	return result
+}
+
+//newAuditLogHandler serves the audit log of the tenant, optionally filtered by the entityId,
+//from (inclusive) and to (exclusive) query parameters
+func newAuditLogHandler(cs *contextSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, err := newPagination(r)
+		if err != nil {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData, err.Error())
+			return
+		}
+
+		if page.Limit == 0 || page.Limit > maxPageSize {
+			reportProblem(w, http.StatusForbidden, problemTooManyResults,
+				fmt.Sprintf("the limit must be between 1 and %d", maxPageSize))
+			return
+		}
+
+		query := database.AuditQuery{EntityID: r.URL.Query().Get("entityId")}
+
+		for _, param := range []struct {
+			name  string
+			value *time.Time
+		}{{"from", &query.From}, {"to", &query.To}} {
+			if value := r.URL.Query().Get(param.name); value != "" {
+				*param.value, err = time.Parse(time.RFC3339, value)
+				if err != nil {
+					reportProblem(w, http.StatusBadRequest, problemBadRequestData,
+						fmt.Sprintf("%s must be an RFC3339 timestamp, not \"%s\"", param.name, value))
+					return
+				}
+			}
+		}
+
+		entries, err := cs.db.GetAuditEntries(query, page)
+		if err != nil {
+			cs.log.Errorf("Failed to get audit entries: %s", err.Error())
+			reportError(w, err)
+			return
+		}
+
+		response := make([]auditEntry, 0, len(entries))
+		for _, entry := range entries {
+			response = append(response, newAuditEntry(entry))
+		}
+
+		bytes, _ := json.Marshal(response)
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(bytes)
+	}
+}
@@ -0,0 +1,268 @@
+package application
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+)
+
+//BatchOperationResult reports the outcome of a batch operation per entity
+type BatchOperationResult struct {
+	Success []string           `json:"success"`
+	Errors  []BatchEntityError `json:"errors"`
+}
+
+//BatchEntityError describes why the batch operation failed for a single entity
+type BatchEntityError struct {
+	EntityID string         `json:"entityId"`
+	Error    problemDetails `json:"error"`
+}
+
+//batchEntity is an entity in a batch request, together with its undecoded body
+type batchEntity struct {
+	ID   string
+	Type string
+	Body json.RawMessage
+}
+
+//batchOperation applies an operation to a single entity using the context source it is given,
+//and returns true if the entity was created
+type batchOperation func(cs *contextSource, entity batchEntity) (bool, error)
+
+func newBatchCreateHandler(cs *contextSource) http.HandlerFunc {
+	return newBatchHandler(cs, func(tx *contextSource, entity batchEntity) (bool, error) {
+		return true, tx.createEntity(entity.Type, entity.decodeBodyInto)
+	})
+}
+
+//newBatchUpsertHandler creates the entities that do not exist and replaces the ones that do, or
+//only updates the attributes that are part of the entities if the update option is given
+func newBatchUpsertHandler(cs *contextSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		updateOnly := false
+		for _, option := range strings.Split(r.URL.Query().Get("options"), ",") {
+			updateOnly = updateOnly || option == "update"
+		}
+
+		newBatchHandler(cs, func(tx *contextSource, entity batchEntity) (bool, error) {
+			err := tx.withTransaction(func(tx *contextSource) error {
+				return tx.createEntity(entity.Type, entity.decodeBodyInto)
+			})
+
+			if !errors.Is(err, database.ErrAlreadyExists) {
+				return err == nil, err
+			}
+
+			if updateOnly {
+				return false, tx.updateEntityAttributes(entity.ID, entity.decodeWritableBodyInto)
+			}
+
+			return false, tx.replaceEntity(entity.ID, entity.decodeWritableBodyInto)
+		})(w, r)
+	}
+}
+
+func newBatchUpdateHandler(cs *contextSource) http.HandlerFunc {
+	return newBatchHandler(cs, func(tx *contextSource, entity batchEntity) (bool, error) {
+		return false, tx.updateEntityAttributes(entity.ID, entity.decodeBodyInto)
+	})
+}
+
+func newBatchDeleteHandler(cs *contextSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entityIDs := []string{}
+
+		err := json.NewDecoder(r.Body).Decode(&entityIDs)
+		if err != nil {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData,
+				"the body of a batch delete must be an array of entity ids")
+			return
+		}
+
+		entities := []batchEntity{}
+		for _, entityID := range entityIDs {
+			entities = append(entities, batchEntity{ID: entityID})
+		}
+
+		result, _, err := cs.applyBatch(entities, func(tx *contextSource, entity batchEntity) (bool, error) {
+			return false, tx.DeleteEntity(entity.ID)
+		})
+
+		writeBatchResponse(w, result, err, nil)
+	}
+}
+
+func newBatchHandler(cs *contextSource, operation batchOperation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData, err.Error())
+			return
+		}
+
+		entities, err := newBatchEntities(body)
+		if err != nil {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData, err.Error())
+			return
+		}
+
+		result, created, err := cs.applyBatch(entities, operation)
+		writeBatchResponse(w, result, err, created)
+	}
+}
+
+func newBatchEntities(body []byte) ([]batchEntity, error) {
+	rawEntities := []json.RawMessage{}
+
+	err := json.Unmarshal(body, &rawEntities)
+	if err != nil {
+		return nil, errors.New("the body of a batch operation must be an array of entities")
+	}
+
+	entities := []batchEntity{}
+	for _, raw := range rawEntities {
+		entity := batchEntity{Body: raw}
+
+		header := struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		}{}
+
+		err = json.Unmarshal(raw, &header)
+		if err != nil || header.ID == "" {
+			return nil, errors.New("every entity in a batch operation must be an object with an id")
+		}
+
+		entity.ID, entity.Type = header.ID, header.Type
+		entities = append(entities, entity)
+	}
+
+	return entities, nil
+}
+
+func (entity batchEntity) decodeBodyInto(v interface{}) error {
+	return json.Unmarshal(entity.Body, v)
+}
+
+//upsertIgnoredAttributes are the attributes of a full entity that are ignored when it is upserted
+//over an existing entity, as they are maintained by the registry and not set on creation either
+var upsertIgnoredAttributes = []string{"dateLastValueReported", "value"}
+
+//decodeWritableBodyInto decodes the entity without the attributes that an upsert ignores, so that
+//an entity can be upserted as it was returned by the registry
+func (entity batchEntity) decodeWritableBodyInto(v interface{}) error {
+	attributes := map[string]json.RawMessage{}
+	err := json.Unmarshal(entity.Body, &attributes)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range upsertIgnoredAttributes {
+		delete(attributes, name)
+	}
+
+	body, _ := json.Marshal(attributes)
+	return json.Unmarshal(body, v)
+}
+
+//applyBatch applies the operation to all entities in a single transaction. Every entity is
+//handled in a nested transaction of its own, so that a failing entity leaves no partial writes
+//without affecting the other entities in the batch.
+func (cs *contextSource) applyBatch(entities []batchEntity, operation batchOperation) (BatchOperationResult, []string, error) {
+	result := BatchOperationResult{Success: []string{}, Errors: []BatchEntityError{}}
+	created := []string{}
+
+	err := cs.withTransaction(func(tx *contextSource) error {
+		for _, entity := range entities {
+			var wasCreated bool
+
+			err := tx.withTransaction(func(entityTx *contextSource) error {
+				var err error
+				wasCreated, err = operation(entityTx, entity)
+				return err
+			})
+
+			if err != nil {
+				cs.log.Errorf("Batch operation failed for entity %s: %s", entity.ID, err.Error())
+				result.Errors = append(result.Errors, BatchEntityError{
+					EntityID: entity.ID,
+					Error:    newProblemDetails(err),
+				})
+				continue
+			}
+
+			result.Success = append(result.Success, entity.ID)
+			if wasCreated {
+				created = append(created, entity.ID)
+			}
+		}
+
+		return nil
+	})
+
+	return result, created, err
+}
+
+//withTransaction calls fn with a copy of the context source that uses a database transaction.
+//Functions that are passed to afterCommit within the transaction are called once the outermost
+//transaction commits, and are dropped if the transaction they were passed in is rolled back.
+func (cs *contextSource) withTransaction(fn func(tx *contextSource) error) error {
+	onCommit := []func(){}
+
+	err := cs.db.Transaction(func(tx database.Datastore) error {
+		return fn(&contextSource{
+			db: tx, log: cs.log, messenger: cs.messenger, proxies: cs.proxies, origin: cs.origin, onCommit: &onCommit,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, fn := range onCommit {
+		cs.afterCommit(fn)
+	}
+
+	return nil
+}
+
+//afterCommit calls fn once the changes that are made with the context source have been
+//committed, or right away if the context source is not in a transaction
+func (cs *contextSource) afterCommit(fn func()) {
+	if cs.onCommit == nil {
+		fn()
+		return
+	}
+
+	*cs.onCommit = append(*cs.onCommit, fn)
+}
+
+//writeBatchResponse responds according to NGSI-LD, with the ids of any created entities if all
+//entities succeeded, or with the full BatchOperationResult if any of them failed
+func writeBatchResponse(w http.ResponseWriter, result BatchOperationResult, err error, created []string) {
+	if err != nil {
+		reportError(w, err)
+		return
+	}
+
+	if len(result.Errors) > 0 {
+		bytes, _ := json.Marshal(result)
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write(bytes)
+		return
+	}
+
+	if len(created) > 0 {
+		bytes, _ := json.Marshal(created)
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(bytes)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,165 @@
+package application
+
+import (
+	"math"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/models"
+	ngsitypes "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+//ControlledPropertyIDPrefix is the prefix used by all DeviceControlledProperty entity ids
+const ControlledPropertyIDPrefix string = "urn:ngsi-ld:DeviceControlledProperty:"
+
+//ControlledPropertyTypeName is the NGSI-LD entity type of the controlled property catalog entries
+const ControlledPropertyTypeName string = "DeviceControlledProperty"
+
+//DeviceControlledProperty is an NGSI-LD entity describing a property that devices can control or sense
+type DeviceControlledProperty struct {
+	ID            string                      `json:"id"`
+	Type          string                      `json:"type"`
+	Name          *ngsitypes.TextProperty     `json:"name"`
+	Abbreviation  *ngsitypes.TextProperty     `json:"abbreviation,omitempty"`
+	UnitCode      *ngsitypes.TextProperty     `json:"unitCode,omitempty"`
+	ValueType     *ngsitypes.TextProperty     `json:"valueType,omitempty"`
+	AllowedValues *ngsitypes.TextListProperty `json:"allowedValues,omitempty"`
+
+	RawValueRetentionDays  *ngsitypes.NumberProperty `json:"rawValueRetentionDays,omitempty"`
+	AggregateRetentionDays *ngsitypes.NumberProperty `json:"aggregateRetentionDays,omitempty"`
+
+	DeadbandAttributes
+
+	Context []string `json:"@context"`
+}
+
+func newControlledPropertyEntity(property *models.DeviceControlledProperty) *DeviceControlledProperty {
+	entity := &DeviceControlledProperty{
+		ID:        ControlledPropertyIDPrefix + property.Name,
+		Type:      ControlledPropertyTypeName,
+		Name:      ngsitypes.NewTextProperty(property.Name),
+		ValueType: ngsitypes.NewTextProperty(property.ValueType),
+
+		DeadbandAttributes: newDeadbandAttributes(property.Deadband),
+
+		Context: entityContext,
+	}
+
+	if property.Abbreviation != "" {
+		entity.Abbreviation = ngsitypes.NewTextProperty(property.Abbreviation)
+	}
+
+	if property.UnitCode != "" {
+		entity.UnitCode = ngsitypes.NewTextProperty(property.UnitCode)
+	}
+
+	if property.AllowedValues != "" {
+		entity.AllowedValues = ngsitypes.NewTextListProperty(property.GetAllowedValues())
+	}
+
+	if property.RawValueRetentionDays > 0 {
+		entity.RawValueRetentionDays = ngsitypes.NewNumberProperty(float64(property.RawValueRetentionDays))
+	}
+
+	if property.AggregateRetentionDays > 0 {
+		entity.AggregateRetentionDays = ngsitypes.NewNumberProperty(float64(property.AggregateRetentionDays))
+	}
+
+	return entity
+}
+
+func newControlledPropertyModel(entity *DeviceControlledProperty) (*models.DeviceControlledProperty, error) {
+	property := &models.DeviceControlledProperty{
+		Name:         entity.ID[len(ControlledPropertyIDPrefix):],
+		Abbreviation: textValueOrEmpty(entity.Abbreviation),
+		UnitCode:     textValueOrEmpty(entity.UnitCode),
+		ValueType:    textValueOrEmpty(entity.ValueType),
+	}
+
+	if entity.AllowedValues != nil {
+		property.SetAllowedValues(entity.AllowedValues.Value)
+	}
+
+	var err error
+
+	if entity.RawValueRetentionDays != nil {
+		property.RawValueRetentionDays, err = retentionDays(entity.RawValueRetentionDays)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if entity.AggregateRetentionDays != nil {
+		property.AggregateRetentionDays, err = retentionDays(entity.AggregateRetentionDays)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	property.Deadband, err = entity.Deadband()
+	if err != nil {
+		return nil, err
+	}
+
+	return property, nil
+}
+
+func retentionDays(property *ngsitypes.NumberProperty) (uint, error) {
+	days := property.Value
+	if days < 0 || days != math.Trunc(days) {
+		return 0, database.NewError(database.ErrInvalidInput, "retention must be a whole number of days, not %v", days)
+	}
+	return uint(days), nil
+}
+
+func textValueOrEmpty(property *ngsitypes.TextProperty) string {
+	if property != nil {
+		return property.Value
+	}
+	return ""
+}
+
+func newControlledPropertyUpdate(entity *DeviceControlledProperty) (database.ControlledPropertyUpdate, error) {
+	update := database.ControlledPropertyUpdate{}
+
+	if entity.Abbreviation != nil {
+		update.Abbreviation = &entity.Abbreviation.Value
+	}
+
+	if entity.UnitCode != nil {
+		update.UnitCode = &entity.UnitCode.Value
+	}
+
+	if entity.ValueType != nil {
+		update.ValueType = &entity.ValueType.Value
+	}
+
+	if entity.AllowedValues != nil {
+		update.AllowedValues = entity.AllowedValues.Value
+	}
+
+	if entity.RawValueRetentionDays != nil {
+		days, err := retentionDays(entity.RawValueRetentionDays)
+		if err != nil {
+			return update, err
+		}
+		update.RawValueRetentionDays = &days
+	}
+
+	if entity.AggregateRetentionDays != nil {
+		days, err := retentionDays(entity.AggregateRetentionDays)
+		if err != nil {
+			return update, err
+		}
+		update.AggregateRetentionDays = &days
+	}
+
+	if entity.DeadbandAttributes.IsSet() {
+		deadband, err := entity.DeadbandUpdate()
+		if err != nil {
+			return update, err
+		}
+		update.Deadband = &deadband
+	}
+
+	return update, nil
+}
@@ -0,0 +1,279 @@
+package application
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/models"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+	ngsitypes "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+//Device extends the fiware Device with the attributes of the FIWARE Device data model that
+//are not part of fiware.Device
+type Device struct {
+	*fiware.Device
+	DeviceAttributes
+	// Shadows the location of fiware.Device, so that it is encoded and decoded as in a PATCH
+	Location *pointProperty `json:"location,omitempty"`
+}
+
+//DeviceAttributes are the optional NGSI-LD attributes that describe a Device
+type DeviceAttributes struct {
+	Name            *ngsitypes.TextProperty     `json:"name,omitempty"`
+	Description     *ngsitypes.TextProperty     `json:"description,omitempty"`
+	SerialNumber    *ngsitypes.TextProperty     `json:"serialNumber,omitempty"`
+	FirmwareVersion *ngsitypes.TextProperty     `json:"firmwareVersion,omitempty"`
+	BatteryLevel    *ngsitypes.NumberProperty   `json:"batteryLevel,omitempty"`
+	RSSI            *ngsitypes.NumberProperty   `json:"rssi,omitempty"`
+	DeviceState     *ngsitypes.TextProperty     `json:"deviceState,omitempty"`
+	Owner           *ngsitypes.TextListProperty `json:"owner,omitempty"`
+	DateInstalled   *ngsitypes.DateTimeProperty `json:"dateInstalled,omitempty"`
+	DateFirstUsed   *ngsitypes.DateTimeProperty `json:"dateFirstUsed,omitempty"`
+}
+
+func newDeviceEntity(device *models.Device, deviceModelID string) *Device {
+	fiwareDevice := fiware.NewDevice(device.DeviceID, url.QueryEscape(device.Value))
+
+	if deviceModelID != "" {
+		fiwareDevice.RefDeviceModel, _ = fiware.NewDeviceModelRelationship(deviceModelID)
+	}
+
+	if device.DateLastValueReported != nil {
+		fiwareDevice.DateLastValueReported = ngsitypes.CreateDateTimeProperty(
+			device.DateLastValueReported.UTC().Format(time.RFC3339),
+		)
+	}
+
+	entity := &Device{
+		Device:           fiwareDevice,
+		DeviceAttributes: newDeviceAttributes(device),
+	}
+
+	// Devices that have never been given a location are stored at 0,0
+	if device.Longitude != 0 || device.Latitude != 0 {
+		entity.Location = newPointProperty(device.Longitude, device.Latitude)
+	}
+
+	return entity
+}
+
+func newDeviceAttributes(device *models.Device) DeviceAttributes {
+	attributes := DeviceAttributes{}
+
+	for _, text := range []struct {
+		value    string
+		property **ngsitypes.TextProperty
+	}{
+		{device.Name, &attributes.Name},
+		{device.Description, &attributes.Description},
+		{device.SerialNumber, &attributes.SerialNumber},
+		{device.FirmwareVersion, &attributes.FirmwareVersion},
+		{device.DeviceState, &attributes.DeviceState},
+	} {
+		if text.value != "" {
+			*text.property = ngsitypes.NewTextProperty(text.value)
+		}
+	}
+
+	if device.BatteryLevel != nil {
+		attributes.BatteryLevel = ngsitypes.NewNumberProperty(*device.BatteryLevel)
+	}
+
+	if device.RSSI != nil {
+		attributes.RSSI = ngsitypes.NewNumberProperty(*device.RSSI)
+	}
+
+	if device.Owner != "" {
+		attributes.Owner = ngsitypes.NewTextListProperty(device.GetOwners())
+	}
+
+	if device.DateInstalled != nil {
+		attributes.DateInstalled = ngsitypes.CreateDateTimeProperty(device.DateInstalled.UTC().Format(time.RFC3339))
+	}
+
+	if device.DateFirstUsed != nil {
+		attributes.DateFirstUsed = ngsitypes.CreateDateTimeProperty(device.DateFirstUsed.UTC().Format(time.RFC3339))
+	}
+
+	return attributes
+}
+
+//IsSet returns true if any of the attributes are present
+func (attributes DeviceAttributes) IsSet() bool {
+	return attributes != DeviceAttributes{}
+}
+
+//applyTo copies the attributes that are present into the update
+func (attributes DeviceAttributes) applyTo(update *database.DeviceUpdate) error {
+	for _, text := range []struct {
+		property *ngsitypes.TextProperty
+		value    **string
+	}{
+		{attributes.Name, &update.Name},
+		{attributes.Description, &update.Description},
+		{attributes.SerialNumber, &update.SerialNumber},
+		{attributes.FirmwareVersion, &update.FirmwareVersion},
+		{attributes.DeviceState, &update.DeviceState},
+	} {
+		if text.property != nil {
+			*text.value = &text.property.Value
+		}
+	}
+
+	if attributes.BatteryLevel != nil {
+		update.BatteryLevel = &attributes.BatteryLevel.Value
+	}
+
+	if attributes.RSSI != nil {
+		update.RSSI = &attributes.RSSI.Value
+	}
+
+	if attributes.Owner != nil {
+		update.Owner = attributes.Owner.Value
+		if update.Owner == nil {
+			update.Owner = []string{}
+		}
+	}
+
+	var err error
+
+	update.DateInstalled, err = parseDateTimeProperty("dateInstalled", attributes.DateInstalled)
+	if err != nil {
+		return err
+	}
+
+	update.DateFirstUsed, err = parseDateTimeProperty("dateFirstUsed", attributes.DateFirstUsed)
+	return err
+}
+
+func parseDateTimeProperty(name string, property *ngsitypes.DateTimeProperty) (*time.Time, error) {
+	if property == nil {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, property.Value.Value)
+	if err != nil {
+		return nil, database.NewError(
+			database.ErrInvalidInput, "%s must be an RFC3339 timestamp, not \"%s\"", name, property.Value.Value,
+		)
+	}
+
+	return &t, nil
+}
+
+//devicePatch holds the Device attributes that can be updated with a PATCH request
+type devicePatch struct {
+	DeviceAttributes
+	Location       *pointProperty                  `json:"location,omitempty"`
+	RefDeviceModel *fiware.DeviceModelRelationship `json:"refDeviceModel,omitempty"`
+	Value          *observedTextProperty           `json:"value,omitempty"`
+}
+
+//devicePatchAttributes are the attributes that can be updated with a PATCH request
+var devicePatchAttributes = map[string]bool{
+	"batteryLevel":    true,
+	"dateFirstUsed":   true,
+	"dateInstalled":   true,
+	"description":     true,
+	"deviceState":     true,
+	"firmwareVersion": true,
+	"location":        true,
+	"name":            true,
+	"owner":           true,
+	"refDeviceModel":  true,
+	"rssi":            true,
+	"serialNumber":    true,
+	"value":           true,
+}
+
+//newDevicePatch decodes a PATCH body for the device with the given id
+func newDevicePatch(entityID string, decodeBodyInto bodyDecoder) (*devicePatch, error) {
+	patch := &devicePatch{}
+	err := decodePatch(entityID, "Device", decodeBodyInto, devicePatchAttributes, patch)
+	if err != nil {
+		return nil, err
+	}
+
+	return patch, nil
+}
+
+//update returns the changes to the stored device, excluding the value
+func (patch *devicePatch) update() (database.DeviceUpdate, error) {
+	update := database.DeviceUpdate{}
+
+	if patch.Location != nil {
+		coordinates, err := patch.Location.GetCoordinates()
+		if err != nil {
+			return update, err
+		}
+		update.Location = &coordinates
+	}
+
+	if patch.RefDeviceModel != nil {
+		if patch.RefDeviceModel.Object == "" {
+			return update, database.NewError(database.ErrInvalidInput, "refDeviceModel must refer to a DeviceModel")
+		}
+		update.RefDeviceModel = &patch.RefDeviceModel.Object
+	}
+
+	err := patch.DeviceAttributes.applyTo(&update)
+	return update, err
+}
+
+//changesDevice returns true if the patch changes anything but the value of the device
+func (patch *devicePatch) changesDevice() bool {
+	return patch.Location != nil || patch.RefDeviceModel != nil || patch.DeviceAttributes.IsSet()
+}
+
+//pointProperty is a GeoProperty with a GeoJSON Point as its value
+type pointProperty struct {
+	Type  string `json:"type"`
+	Value struct {
+		Type        string    `json:"type"`
+		Coordinates []float64 `json:"coordinates"`
+	} `json:"value"`
+}
+
+func newPointProperty(longitude, latitude float64) *pointProperty {
+	p := &pointProperty{Type: "GeoProperty"}
+	p.Value.Type = "Point"
+	p.Value.Coordinates = []float64{longitude, latitude}
+	return p
+}
+
+//GetCoordinates returns the longitude and latitude of the point
+func (p *pointProperty) GetCoordinates() ([2]float64, error) {
+	if p.Value.Type != "Point" || len(p.Value.Coordinates) != 2 {
+		return [2]float64{}, database.NewError(
+			database.ErrInvalidInput, "location must be a GeoJSON Point with a longitude and a latitude",
+		)
+	}
+
+	return [2]float64{p.Value.Coordinates[0], p.Value.Coordinates[1]}, nil
+}
+
+//observedTextProperty is a text property with the optional NGSI-LD observedAt sub-property,
+//that tells when the value was observed rather than when it was received
+type observedTextProperty struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	ObservedAt string `json:"observedAt,omitempty"`
+}
+
+//GetObservedAt returns the parsed observedAt sub-property, or a zero time if it is missing
+func (p *observedTextProperty) GetObservedAt() (time.Time, error) {
+	if p.ObservedAt == "" {
+		return time.Time{}, nil
+	}
+
+	observedAt, err := time.Parse(time.RFC3339, p.ObservedAt)
+	if err != nil {
+		return time.Time{}, database.NewError(
+			database.ErrInvalidInput, "observedAt must be an RFC3339 timestamp, not \"%s\"", p.ObservedAt,
+		)
+	}
+
+	return observedAt.UTC(), nil
+}
@@ -0,0 +1,172 @@
+package application
+
+import (
+	"math"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/models"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+	ngsitypes "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+//DeviceModel extends the fiware DeviceModel with the attributes that are specific to this registry
+type DeviceModel struct {
+	*fiware.DeviceModel
+	DeadbandAttributes
+}
+
+//DeadbandAttributes are the NGSI-LD attributes used to configure a models.Deadband
+type DeadbandAttributes struct {
+	DeadbandAbsolute   *ngsitypes.NumberProperty `json:"deadbandAbsolute,omitempty"`
+	DeadbandRelative   *ngsitypes.NumberProperty `json:"deadbandRelative,omitempty"`
+	MaxSilenceInterval *ngsitypes.NumberProperty `json:"maxSilenceInterval,omitempty"`
+}
+
+func newDeviceModelEntity(deviceModel *models.DeviceModel) *DeviceModel {
+	fiwareDeviceModel := fiware.NewDeviceModel(deviceModel.DeviceModelID, []string{deviceModel.Category})
+	fiwareDeviceModel.BrandName = ngsitypes.NewTextProperty(deviceModel.BrandName)
+	fiwareDeviceModel.ModelName = ngsitypes.NewTextProperty(deviceModel.ModelName)
+	fiwareDeviceModel.ManufacturerName = ngsitypes.NewTextProperty(deviceModel.ManufacturerName)
+	fiwareDeviceModel.Name = ngsitypes.NewTextProperty(deviceModel.Name)
+
+	if len(deviceModel.ControlledProperties) > 0 {
+		names := []string{}
+		for _, property := range deviceModel.ControlledProperties {
+			names = append(names, property.Name)
+		}
+		fiwareDeviceModel.ControlledProperty = ngsitypes.NewTextListProperty(names)
+	}
+
+	return &DeviceModel{
+		DeviceModel:        fiwareDeviceModel,
+		DeadbandAttributes: newDeadbandAttributes(deviceModel.Deadband),
+	}
+}
+
+func newDeadbandAttributes(deadband models.Deadband) DeadbandAttributes {
+	attributes := DeadbandAttributes{}
+
+	if deadband.DeadbandAbsolute > 0 {
+		attributes.DeadbandAbsolute = ngsitypes.NewNumberProperty(deadband.DeadbandAbsolute)
+	}
+
+	if deadband.DeadbandRelative > 0 {
+		attributes.DeadbandRelative = ngsitypes.NewNumberProperty(deadband.DeadbandRelative)
+	}
+
+	if deadband.MaxSilenceSeconds > 0 {
+		attributes.MaxSilenceInterval = ngsitypes.NewNumberProperty(float64(deadband.MaxSilenceSeconds))
+	}
+
+	return attributes
+}
+
+//IsSet returns true if any of the deadband attributes are present
+func (attributes DeadbandAttributes) IsSet() bool {
+	return attributes.DeadbandAbsolute != nil || attributes.DeadbandRelative != nil ||
+		attributes.MaxSilenceInterval != nil
+}
+
+//Deadband converts the attributes into a models.Deadband, where missing attributes are zero
+func (attributes DeadbandAttributes) Deadband() (models.Deadband, error) {
+	deadband := models.Deadband{}
+
+	update, err := attributes.DeadbandUpdate()
+	if err != nil {
+		return deadband, err
+	}
+
+	return update.ApplyTo(deadband), nil
+}
+
+//DeadbandUpdate converts the attributes into a database.DeadbandUpdate, that only changes the
+//parts of a deadband whose attributes are present
+func (attributes DeadbandAttributes) DeadbandUpdate() (database.DeadbandUpdate, error) {
+	update := database.DeadbandUpdate{}
+
+	if attributes.DeadbandAbsolute != nil {
+		update.Absolute = &attributes.DeadbandAbsolute.Value
+	}
+
+	if attributes.DeadbandRelative != nil {
+		update.Relative = &attributes.DeadbandRelative.Value
+	}
+
+	if attributes.MaxSilenceInterval != nil {
+		seconds := attributes.MaxSilenceInterval.Value
+		if seconds < 0 || seconds != math.Trunc(seconds) {
+			return update, database.NewError(
+				database.ErrInvalidInput, "maxSilenceInterval must be a whole number of seconds, not %v", seconds,
+			)
+		}
+
+		maxSilenceSeconds := uint(seconds)
+		update.MaxSilenceSeconds = &maxSilenceSeconds
+	}
+
+	return update, nil
+}
+
+//deviceModelPatchAttributes are the attributes that can be updated with a PATCH request
+var deviceModelPatchAttributes = map[string]bool{
+	"brandName":          true,
+	"category":           true,
+	"controlledProperty": true,
+	"deadbandAbsolute":   true,
+	"deadbandRelative":   true,
+	"manufacturerName":   true,
+	"maxSilenceInterval": true,
+	"modelName":          true,
+	"name":               true,
+}
+
+//newDeviceModelUpdate decodes a PATCH body for the device model with the given id
+func newDeviceModelUpdate(entityID string, decodeBodyInto bodyDecoder) (database.DeviceModelUpdate, error) {
+	update := database.DeviceModelUpdate{}
+
+	patch := &DeviceModel{DeviceModel: &fiware.DeviceModel{}}
+	err := decodePatch(entityID, "DeviceModel", decodeBodyInto, deviceModelPatchAttributes, patch)
+	if err != nil {
+		return update, err
+	}
+
+	if patch.BrandName != nil {
+		update.BrandName = &patch.BrandName.Value
+	}
+
+	if patch.ModelName != nil {
+		update.ModelName = &patch.ModelName.Value
+	}
+
+	if patch.ManufacturerName != nil {
+		update.ManufacturerName = &patch.ManufacturerName.Value
+	}
+
+	if patch.Name != nil {
+		update.Name = &patch.Name.Value
+	}
+
+	if patch.Category != nil {
+		if len(patch.Category.Value) == 0 {
+			return update, database.NewError(database.ErrInvalidInput, "the category of a device model can not be empty")
+		}
+		update.Category = &patch.Category.Value[0]
+	}
+
+	if patch.ControlledProperty != nil {
+		update.ControlledProperties = patch.ControlledProperty.Value
+		if update.ControlledProperties == nil {
+			update.ControlledProperties = []string{}
+		}
+	}
+
+	if patch.DeadbandAttributes.IsSet() {
+		deadband, err := patch.DeadbandUpdate()
+		if err != nil {
+			return update, err
+		}
+		update.Deadband = &deadband
+	}
+
+	return update, nil
+}
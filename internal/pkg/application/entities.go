@@ -0,0 +1,258 @@
+package application
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
+)
+
+//entityContext is the JSON-LD context of the entities that are not part of the fiware data models
+var entityContext = []string{
+	"https://schema.lab.fiware.org/ld/context",
+	"https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld",
+}
+
+//maxPageSize is the largest number of entities that are returned from a single query
+const maxPageSize uint64 = 1000
+
+//defaultPageSize is the number of entities that are returned when the client does not specify a limit
+const defaultPageSize uint64 = 20
+
+//resultsCountHeader is the NGSI-LD header that reports the total number of matching entities
+const resultsCountHeader string = "NGSILD-Results-Count"
+
+//entityQuery holds the filters of an entity query, that are passed on to the database
+type entityQuery struct {
+	Geo *database.GeoQuery
+	Q   *database.AttributeQuery
+}
+
+func newQueryEntitiesHandler(cs *contextSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, err := newPagination(r)
+		if err != nil {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData, err.Error())
+			return
+		}
+
+		query := entityQuery{}
+		query.Geo, err = newGeoQuery(r)
+		if err != nil {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData, err.Error())
+			return
+		}
+
+		if q := r.URL.Query().Get("q"); q != "" {
+			query.Q, err = newAttributeQuery(q)
+			if err != nil {
+				reportProblem(w, http.StatusBadRequest, problemBadRequestData, err.Error())
+				return
+			}
+		}
+
+		if r.URL.Query().Get("type") == "" && query.Geo == nil && query.Q == nil {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData,
+				"entity queries require at least one of type, q or georel")
+			return
+		}
+
+		typeNames := queriedEntityTypes(cs, r.URL.Query().Get("type"), query)
+
+		if page.Limit > maxPageSize {
+			reportProblem(w, http.StatusForbidden, problemTooManyResults,
+				fmt.Sprintf("the limit must not be larger than %d", maxPageSize))
+			return
+		}
+
+		count := r.URL.Query().Get("count") == "true"
+		if count {
+			total := int64(0)
+			for _, typeName := range typeNames {
+				typeCount, err := cs.countEntities(typeName, query)
+				if err != nil {
+					cs.log.Errorf("Failed to count entities of type %s: %s", typeName, err.Error())
+					reportError(w, err)
+					return
+				}
+				total += typeCount
+			}
+
+			w.Header().Add(resultsCountHeader, strconv.FormatInt(total, 10))
+		}
+
+		entities := []ngsi.Entity{}
+
+		// A limit of zero is used to ask for the count alone
+		if page.Limit > 0 {
+			err = cs.queryEntitiesOfTypes(typeNames, query, page, func(entity ngsi.Entity) error {
+				entities = append(entities, entity)
+				return nil
+			})
+
+			if err != nil {
+				cs.log.Errorf("Failed to query entities of types %s: %s", strings.Join(typeNames, ","), err.Error())
+				reportError(w, err)
+				return
+			}
+		} else if !count {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData,
+				"a limit of zero is only allowed together with count=true")
+			return
+		}
+
+		writeEntityResponse(w, entities)
+	}
+}
+
+//queriedEntityTypes returns the entity types that a query can match, out of the comma separated
+//types in the type parameter, or all entity types if the parameter is empty
+func queriedEntityTypes(cs *contextSource, typeParameter string, query entityQuery) []string {
+	requested := []string{"Device", "DeviceModel", ControlledPropertyTypeName}
+	if typeParameter != "" {
+		requested = strings.Split(typeParameter, ",")
+	}
+
+	typeNames := []string{}
+	for _, typeName := range requested {
+		if !cs.providesType(typeName) {
+			// We have no entities of this type, which is not an error
+			continue
+		}
+
+		if query.Geo != nil && typeName != "Device" {
+			// Only devices have a location, so no other entities can match a geo query
+			continue
+		}
+
+		if query.Q != nil && typeParameter == "" && !queriesEntityType(query.Q, typeName) {
+			// Entities that lack the queried attributes can not match, which is only an error
+			// when their type is asked for explicitly
+			continue
+		}
+
+		typeNames = append(typeNames, typeName)
+	}
+
+	return typeNames
+}
+
+//queriesEntityType reports if every attribute in the query is an attribute of the entity type
+func queriesEntityType(q *database.AttributeQuery, typeName string) bool {
+	if typeName == "Device" {
+		return q.QueriesDevices()
+	} else if typeName == "DeviceModel" {
+		return q.QueriesDeviceModels()
+	}
+
+	return false
+}
+
+//newPagination reads the limit and offset query parameters from the request
+func newPagination(r *http.Request) (database.Pagination, error) {
+	page := database.Pagination{Limit: defaultPageSize}
+
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		value, err := strconv.ParseUint(limit, 10, 64)
+		if err != nil {
+			return page, fmt.Errorf("limit must be a non negative integer, not \"%s\"", limit)
+		}
+		page.Limit = value
+	}
+
+	if offset := r.URL.Query().Get("offset"); offset != "" {
+		value, err := strconv.ParseUint(offset, 10, 64)
+		if err != nil {
+			return page, fmt.Errorf("offset must be a non negative integer, not \"%s\"", offset)
+		}
+		page.Offset = value
+	}
+
+	return page, nil
+}
+
+func newCreateEntityHandler(cs *contextSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData, err.Error())
+			return
+		}
+
+		entity := struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		}{}
+
+		err = json.Unmarshal(body, &entity)
+		if err != nil {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData, err.Error())
+			return
+		}
+
+		err = cs.createEntity(entity.Type, func(v interface{}) error {
+			return json.Unmarshal(body, v)
+		})
+
+		if err != nil {
+			cs.log.Errorf("Failed to create entity %s: %s", entity.ID, err.Error())
+			reportError(w, err)
+			return
+		}
+
+		w.Header().Add("Location", "/ngsi-ld/v1/entities/"+entity.ID)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func newRetrieveEntityHandler(cs *contextSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entityID := chi.URLParam(r, "entity")
+
+		entity, err := cs.retrieveEntity(entityID)
+		if err != nil {
+			cs.log.Errorf("Failed to retrieve entity %s: %s", entityID, err.Error())
+			reportError(w, err)
+			return
+		}
+
+		writeEntityResponse(w, entity)
+	}
+}
+
+func newUpdateEntityAttributesHandler(cs *contextSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entityID := chi.URLParam(r, "entity")
+
+		err := cs.updateEntityAttributes(entityID, json.NewDecoder(r.Body).Decode)
+		if err != nil {
+			cs.log.Errorf("Failed to update attributes of entity %s: %s", entityID, err.Error())
+			reportError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newDeleteEntityHandler(cs *contextSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entityID := chi.URLParam(r, "entity")
+
+		err := cs.DeleteEntity(entityID)
+		if err != nil {
+			cs.log.Errorf("Failed to delete entity %s: %s", entityID, err.Error())
+			reportError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
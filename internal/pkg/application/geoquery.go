@@ -0,0 +1,76 @@
+package application
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+)
+
+//newGeoQuery translates the NGSI-LD georel, geometry and coordinates query parameters into
+//a GeoQuery, or returns nil if the request has no geo query
+func newGeoQuery(r *http.Request) (*database.GeoQuery, error) {
+	params := r.URL.Query()
+
+	geoRel := params.Get("georel")
+	if geoRel == "" {
+		if params.Get("geometry") != "" || params.Get("coordinates") != "" {
+			return nil, fmt.Errorf("the parameters geometry and coordinates require a georel")
+		}
+		return nil, nil
+	}
+
+	if geoProperty := params.Get("geoproperty"); geoProperty != "" && geoProperty != "location" {
+		return nil, fmt.Errorf("geo queries are only supported for the location property, not %s", geoProperty)
+	}
+
+	query := &database.GeoQuery{Geometry: params.Get("geometry")}
+
+	// The relation may be followed by modifiers, as in near;maxDistance==2000
+	modifiers := strings.Split(geoRel, ";")
+	query.Relation = modifiers[0]
+
+	for _, modifier := range modifiers[1:] {
+		parts := strings.Split(modifier, "==")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed georel modifier \"%s\"", modifier)
+		}
+
+		distance, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || distance < 0 {
+			return nil, fmt.Errorf("%s must be a non negative number of meters, not \"%s\"", parts[0], parts[1])
+		}
+
+		switch parts[0] {
+		case "maxDistance":
+			query.MaxDistance = distance
+		case "minDistance":
+			query.MinDistance = distance
+		default:
+			return nil, fmt.Errorf("georel modifier %s is not supported", parts[0])
+		}
+	}
+
+	coordinates := []byte(params.Get("coordinates"))
+	var err error
+
+	switch query.Geometry {
+	case database.GeometryPoint:
+		err = json.Unmarshal(coordinates, &query.Point)
+	case database.GeometryPolygon:
+		err = json.Unmarshal(coordinates, &query.Polygon)
+	case "":
+		return nil, fmt.Errorf("geo queries require a geometry")
+	default:
+		return nil, fmt.Errorf("geometry %s is not supported", query.Geometry)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("malformed coordinates for a %s: %s", query.Geometry, err.Error())
+	}
+
+	return query, query.Validate()
+}
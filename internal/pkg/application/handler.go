@@ -2,12 +2,12 @@ package application
 
 import (
 	"compress/flate"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
-	"strconv"
+	"sort"
 	"strings"
 	"time"
 
@@ -22,6 +22,7 @@ import (
 	gql "github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/_presentation/api/graphql"
 	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/logging"
 	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/models"
 	"github.com/iot-for-tillgenglighet/messaging-golang/pkg/messaging"
 	"github.com/iot-for-tillgenglighet/messaging-golang/pkg/messaging/telemetry"
 
@@ -29,7 +30,6 @@ import (
 
 	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
 	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
-	ngsitypes "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/types"
 )
 
 //RequestRouter needs a comment
@@ -46,11 +46,20 @@ func (router *RequestRouter) addGraphQLHandlers() {
 	router.impl.Handle("/api/graphql", gqlServer)
 }
 
-func (router *RequestRouter) addNGSIHandlers(contextRegistry ngsi.ContextRegistry) {
-	router.Get("/ngsi-ld/v1/entities/{entity}", ngsi.NewRetrieveEntityHandler(contextRegistry))
-	router.Get("/ngsi-ld/v1/entities", ngsi.NewQueryEntitiesHandler(contextRegistry))
-	router.Patch("/ngsi-ld/v1/entities/{entity}/attrs/", ngsi.NewUpdateEntityAttributesHandler(contextRegistry))
-	router.Post("/ngsi-ld/v1/entities", ngsi.NewCreateEntityHandler(contextRegistry))
+func (router *RequestRouter) addNGSIHandlers(ctxSource *contextSource) {
+	router.Get("/ngsi-ld/v1/entities/{entity}", forRequest(ctxSource, newRetrieveEntityHandler))
+	router.Get("/ngsi-ld/v1/entities", forRequest(ctxSource, newQueryEntitiesHandler))
+	router.Patch("/ngsi-ld/v1/entities/{entity}/attrs/", forRequest(ctxSource, newUpdateEntityAttributesHandler))
+	router.Post("/ngsi-ld/v1/entities", forRequest(ctxSource, newCreateEntityHandler))
+	router.Delete("/ngsi-ld/v1/entities/{entity}", forRequest(ctxSource, newDeleteEntityHandler))
+	router.Get("/ngsi-ld/v1/temporal/entities/{entity}", forRequest(ctxSource, newRetrieveTemporalEntityHandler))
+	router.Get("/ngsi-ld/v1/temporal/entities", forRequest(ctxSource, newQueryTemporalEntitiesHandler))
+	router.Post("/ngsi-ld/v1/entityOperations/create", forRequest(ctxSource, newBatchCreateHandler))
+	router.Post("/ngsi-ld/v1/entityOperations/upsert", forRequest(ctxSource, newBatchUpsertHandler))
+	router.Post("/ngsi-ld/v1/entityOperations/update", forRequest(ctxSource, newBatchUpdateHandler))
+	router.Post("/ngsi-ld/v1/entityOperations/delete", forRequest(ctxSource, newBatchDeleteHandler))
+	router.Get("/admin/audit", forAdminRequest(ctxSource, newAuditLogHandler))
+	router.Get("/admin/snapshot", forAdminRequest(ctxSource, newSnapshotHandler))
 }
 
 func (router *RequestRouter) addProbeHandlers() {
@@ -59,6 +68,11 @@ func (router *RequestRouter) addProbeHandlers() {
 	})
 }
 
+//Delete accepts a pattern that should be routed to the handlerFn on a DELETE request
+func (router *RequestRouter) Delete(pattern string, handlerFn http.HandlerFunc) {
+	router.impl.Delete(pattern, handlerFn)
+}
+
 //Get accepts a pattern that should be routed to the handlerFn on a GET request
 func (router *RequestRouter) Get(pattern string, handlerFn http.HandlerFunc) {
 	router.impl.Get(pattern, handlerFn)
@@ -79,6 +93,7 @@ func newRequestRouter() *RequestRouter {
 
 	router.impl.Use(cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
+		AllowedHeaders:   []string{"Origin", "Accept", "Content-Type", "X-Requested-With", tenantHeader, actorHeader},
 		AllowCredentials: true,
 		Debug:            false,
 	}).Handler)
@@ -91,11 +106,11 @@ func newRequestRouter() *RequestRouter {
 	return router
 }
 
-func createRequestRouter(contextRegistry ngsi.ContextRegistry) *RequestRouter {
+func createRequestRouter(ctxSource *contextSource) *RequestRouter {
 	router := newRequestRouter()
 
 	router.addGraphQLHandlers()
-	router.addNGSIHandlers(contextRegistry)
+	router.addNGSIHandlers(ctxSource)
 	router.addProbeHandlers()
 
 	return router
@@ -107,17 +122,32 @@ type MessagingContext interface {
 	SendCommandTo(command messaging.CommandMessage, key string) error
 }
 
-func createContextRegistry(log logging.Logger, messenger MessagingContext, db database.Datastore) ngsi.ContextRegistry {
-	contextRegistry := ngsi.NewContextRegistry()
-	ctxSource := contextSource{db: db, log: log, messenger: messenger}
-	contextRegistry.Register(&ctxSource)
-	return contextRegistry
+func newContextSource(log logging.Logger, messenger MessagingContext, db database.Datastore) *contextSource {
+	return &contextSource{db: db, log: log, messenger: messenger}
+}
+
+//NewRequestHandler returns the handler that serves the NGSI-LD and admin APIs, so that they can
+//be used in-process by tools that work directly against the database. The tools already have
+//access to the database, so the users that they forward requests for are trusted.
+func NewRequestHandler(log logging.Logger, messenger MessagingContext, db database.Datastore) http.Handler {
+	ctxSource := newContextSource(log, messenger, db)
+	ctxSource.proxies = trustedProxies{all: true}
+	return createRequestRouter(ctxSource).impl
 }
 
 //CreateRouterAndStartServing sets up the NGSI-LD router and starts serving incoming requests
 func CreateRouterAndStartServing(log logging.Logger, messenger MessagingContext, db database.Datastore) {
-	contextRegistry := createContextRegistry(log, messenger, db)
-	router := createRequestRouter(contextRegistry)
+	ctxSource := newContextSource(log, messenger, db)
+
+	proxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Invalid trusted proxies: %s", err.Error())
+	} else if len(proxies.networks) == 0 {
+		log.Infof("No trusted proxies are configured, so the admin API is disabled.")
+	}
+	ctxSource.proxies = proxies
+
+	router := createRequestRouter(ctxSource)
 
 	port := os.Getenv("SERVICE_PORT")
 	if port == "" {
@@ -132,96 +162,228 @@ type contextSource struct {
 	db        database.Datastore
 	log       logging.Logger
 	messenger MessagingContext
+	proxies   trustedProxies
+	origin    requestOrigin
+	onCommit  *[]func() // Called when the outermost transaction commits, or nil outside of transactions
 }
 
-func (cs contextSource) ProvidesEntitiesWithMatchingID(entityID string) bool {
-	if strings.Contains(entityID, "DeviceModel") {
-		return strings.HasPrefix(entityID, fiware.DeviceModelIDPrefix)
+//bodyDecoder decodes the body of a request into the given entity
+type bodyDecoder func(entity interface{}) error
+
+func (cs *contextSource) createEntity(typeName string, decodeBodyInto bodyDecoder) error {
+	// The body is decoded twice, first to find the id of the entity for the audit log
+	body := json.RawMessage{}
+	err := decodeBody(decodeBodyInto, &body)
+	if err != nil {
+		return err
 	}
-	return strings.HasPrefix(entityID, fiware.DeviceIDPrefix)
+
+	entity := struct {
+		ID string `json:"id"`
+	}{}
+	json.Unmarshal(body, &entity)
+
+	return cs.audited(models.AuditOperationCreate, entity.ID, func(tx *contextSource) error {
+		return tx.storeNewEntity(typeName, func(v interface{}) error {
+			return json.Unmarshal(body, v)
+		})
+	})
 }
 
-func (cs *contextSource) CreateEntity(typeName, entityID string, req ngsi.Request) error {
+func (cs *contextSource) storeNewEntity(typeName string, decodeBodyInto bodyDecoder) error {
 	var err error
 
 	if typeName == "Device" {
-		device := &fiware.Device{}
-		err = req.DecodeBodyInto(device)
+		device := &Device{}
+		err = decodeBody(decodeBodyInto, device)
 		if err != nil {
 			cs.log.Errorf("Failed to decode body into Device: %s", err.Error())
 			return err
 		}
 
-		_, err = cs.db.CreateDevice(device)
+		update := database.DeviceUpdate{}
+		err = device.DeviceAttributes.applyTo(&update)
+		if err != nil {
+			return err
+		}
+
+		if device.Location != nil {
+			coordinates, err := device.Location.GetCoordinates()
+			if err != nil {
+				return err
+			}
+			update.Location = &coordinates
+		}
+
+		err = cs.db.Transaction(func(tx database.Datastore) error {
+			created, err := tx.CreateDevice(device.Device)
+			if err == nil && (device.DeviceAttributes.IsSet() || update.Location != nil) {
+				_, err = tx.UpdateDevice(created.DeviceID, update)
+			}
+			return err
+		})
 
 	} else if typeName == "DeviceModel" {
-		deviceModel := &fiware.DeviceModel{}
-		err = req.DecodeBodyInto(deviceModel)
+		deviceModel := &DeviceModel{}
+		err = decodeBody(decodeBodyInto, deviceModel)
 		if err != nil {
 			cs.log.Errorf("Failed to decode body into DeviceModel: %s", err.Error())
 			return err
 		}
-		_, err = cs.db.CreateDeviceModel(deviceModel)
+
+		var deadband models.Deadband
+		deadband, err = deviceModel.Deadband()
+		if err != nil {
+			return err
+		}
+
+		_, err = cs.db.CreateDeviceModel(deviceModel.DeviceModel)
+		if err == nil && deadband.IsEnabled() {
+			err = cs.db.SetDeviceModelDeadband(deviceModel.ID[len(fiware.DeviceModelIDPrefix):], deadband)
+		}
+
+	} else if typeName == ControlledPropertyTypeName {
+		property := &DeviceControlledProperty{}
+		err = decodeBody(decodeBodyInto, property)
+		if err != nil {
+			cs.log.Errorf("Failed to decode body into DeviceControlledProperty: %s", err.Error())
+			return err
+		}
+
+		if !strings.HasPrefix(property.ID, ControlledPropertyIDPrefix) {
+			return database.NewError(
+				database.ErrInvalidInput, "entity id %s must start with \"%s\"", property.ID, ControlledPropertyIDPrefix,
+			)
+		}
+
+		controlledProperty, err := newControlledPropertyModel(property)
+		if err != nil {
+			return err
+		}
+
+		_, err = cs.db.CreateControlledProperty(controlledProperty)
 
 	} else {
 		errorMessage := fmt.Sprintf("Entity of type  " + typeName + " is not supported.")
 		cs.log.Errorf(errorMessage)
-		return errors.New(errorMessage)
+		return database.NewError(database.ErrInvalidInput, errorMessage)
 	}
 
 	return err
 }
 
-func (cs *contextSource) GetEntities(query ngsi.Query, callback ngsi.QueryEntitiesCallback) error {
+//decodeBody marks decoding failures as invalid input, so that they can be told apart from other errors
+func decodeBody(decodeBodyInto bodyDecoder, entity interface{}) error {
+	err := decodeBodyInto(entity)
+	if err != nil {
+		return database.NewError(database.ErrInvalidInput, "failed to decode request body: %s", err.Error())
+	}
+	return nil
+}
+
+//decodePatch decodes a PATCH body for an entity into the patch. The body may be a complete
+//entity, but it is an error if it contains attributes that are not in the supported set, or
+//if it tries to change the id or type of the entity.
+func decodePatch(entityID, typeName string, decodeBodyInto bodyDecoder, supported map[string]bool, patch interface{}) error {
+	attributes := map[string]json.RawMessage{}
+	err := decodeBody(decodeBodyInto, &attributes)
+	if err != nil {
+		return err
+	}
 
-	var err error
+	var id, entityType string
+	json.Unmarshal(attributes["id"], &id)
+	json.Unmarshal(attributes["type"], &entityType)
 
-	if query == nil {
-		return errors.New("GetEntities: query may not be nil")
+	if id != "" && id != entityID {
+		return database.NewError(database.ErrInvalidInput, "the id of %s %s can not be changed", typeName, entityID)
 	}
 
-	for _, typeName := range query.EntityTypes() {
-		if typeName == "Device" {
-			devices, err := cs.db.GetDevices()
-			if err != nil {
-				return fmt.Errorf("unable to get Device entities: %s", err.Error())
-			}
+	if entityType != "" && entityType != typeName {
+		return database.NewError(database.ErrInvalidInput, "the type of %s %s can not be changed", typeName, entityID)
+	}
 
-			for _, device := range devices {
-				fiwareDevice := fiware.NewDevice(device.DeviceID, url.QueryEscape(device.Value))
-				deviceModel, err := cs.db.GetDeviceModelFromPrimaryKey(device.DeviceModelID)
-				if err == nil {
-					fiwareDevice.RefDeviceModel, _ = fiware.NewDeviceModelRelationship(deviceModel.DeviceModelID)
-				}
+	delete(attributes, "@context")
+	delete(attributes, "id")
+	delete(attributes, "type")
 
-				if !device.DateLastValueReported.IsZero() {
-					fiwareDevice.DateLastValueReported = ngsitypes.CreateDateTimeProperty(
-						device.DateLastValueReported.Format(time.RFC3339),
-					)
-				}
+	unsupported := []string{}
+	for name := range attributes {
+		if !supported[name] {
+			unsupported = append(unsupported, name)
+		}
+	}
 
-				err = callback(fiwareDevice)
-				if err != nil {
-					break
-				}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return database.NewError(
+			database.ErrUnsupportedProperty,
+			"the attributes %s of a %s can not be updated", strings.Join(unsupported, ", "), typeName,
+		)
+	}
+
+	if len(attributes) == 0 {
+		return database.NewError(database.ErrInvalidInput, "the update of %s %s has no attributes", typeName, entityID)
+	}
+
+	// Decode the attributes again, now that we know that all of them are supported
+	body, _ := json.Marshal(attributes)
+	err = json.Unmarshal(body, patch)
+	if err != nil {
+		return database.NewError(database.ErrInvalidInput, "failed to decode request body: %s", err.Error())
+	}
+
+	return nil
+}
+
+//queryEntities calls the callback with a page of the entities of the given type that match the query
+func (cs *contextSource) queryEntities(typeName string, query entityQuery, page database.Pagination, callback ngsi.QueryEntitiesCallback) error {
+	var err error
+
+	if typeName == "Device" {
+		filter := database.DeviceFilter{Geo: query.Geo, Query: query.Q}
+		devices, err := cs.db.GetDevices(filter, page)
+		if err != nil {
+			return fmt.Errorf("unable to get Device entities: %w", err)
+		}
+
+		for idx := range devices {
+			// The device models are preloaded by GetDevices, so we do not need to look them up
+			device := &devices[idx]
+			err = callback(newDeviceEntity(device, device.DeviceModel.DeviceModelID))
+			if err != nil {
+				return err
 			}
-		} else if typeName == "DeviceModel" {
-			deviceModels, err := cs.db.GetDeviceModels()
+		}
+	} else if typeName == "DeviceModel" {
+		filter := database.DeviceModelFilter{Query: query.Q}
+		deviceModels, err := cs.db.GetDeviceModels(filter, page)
+		if err != nil {
+			return fmt.Errorf("unable to get DeviceModels: %w", err)
+		}
+
+		for idx := range deviceModels {
+			err = callback(newDeviceModelEntity(&deviceModels[idx]))
 			if err != nil {
-				return fmt.Errorf("unable to get DeviceModels: %s", err.Error())
+				return err
 			}
+		}
+	} else if typeName == ControlledPropertyTypeName {
+		if query.Q != nil {
+			return errControlledPropertyQuery
+		}
 
-			for _, deviceModel := range deviceModels {
-				fiwareDeviceModel := fiware.NewDeviceModel(deviceModel.DeviceModelID, []string{deviceModel.Category})
-				fiwareDeviceModel.BrandName = ngsitypes.NewTextProperty(deviceModel.BrandName)
-				fiwareDeviceModel.ModelName = ngsitypes.NewTextProperty(deviceModel.ModelName)
-				fiwareDeviceModel.ManufacturerName = ngsitypes.NewTextProperty(deviceModel.ManufacturerName)
-				fiwareDeviceModel.Name = ngsitypes.NewTextProperty(deviceModel.Name)
+		controlledProperties, err := cs.db.GetControlledProperties()
+		if err != nil {
+			return fmt.Errorf("unable to get DeviceControlledProperties: %w", err)
+		}
 
-				err = callback(fiwareDeviceModel)
-				if err != nil {
-					break
-				}
+		// The catalog of controlled properties is small enough to be paginated in memory
+		first, last := pageBounds(page, len(controlledProperties))
+		for idx := first; idx < last; idx++ {
+			err = callback(newControlledPropertyEntity(&controlledProperties[idx]))
+			if err != nil {
+				return err
 			}
 		}
 	}
@@ -229,66 +391,218 @@ func (cs *contextSource) GetEntities(query ngsi.Query, callback ngsi.QueryEntiti
 	return err
 }
 
-func (cs contextSource) ProvidesAttribute(attributeName string) bool {
-	return attributeName == "value"
+//queryEntitiesOfTypes calls the callback with a page of the entities of the given types that match
+//the query, paginating the entities of all the types as one list in the order of the types
+func (cs *contextSource) queryEntitiesOfTypes(typeNames []string, query entityQuery, page database.Pagination, callback ngsi.QueryEntitiesCallback) error {
+	for idx, typeName := range typeNames {
+		if page.Limit == 0 {
+			break
+		}
+
+		// Skip the types that the page starts after. The last type never has to be counted.
+		if page.Offset > 0 && idx < len(typeNames)-1 {
+			count, err := cs.countEntities(typeName, query)
+			if err != nil {
+				return err
+			}
+
+			if uint64(count) <= page.Offset {
+				page.Offset -= uint64(count)
+				continue
+			}
+		}
+
+		returned := uint64(0)
+		err := cs.queryEntities(typeName, query, page, func(entity ngsi.Entity) error {
+			returned++
+			return callback(entity)
+		})
+		if err != nil {
+			return err
+		}
+
+		page.Offset = 0
+		page.Limit -= returned
+	}
+
+	return nil
+}
+
+//countEntities returns the total number of entities of the given type
+func (cs *contextSource) countEntities(typeName string, query entityQuery) (int64, error) {
+	if typeName == "Device" {
+		return cs.db.GetDeviceCount(database.DeviceFilter{Geo: query.Geo, Query: query.Q})
+	} else if typeName == "DeviceModel" {
+		return cs.db.GetDeviceModelCount(database.DeviceModelFilter{Query: query.Q})
+	} else if typeName == ControlledPropertyTypeName {
+		if query.Q != nil {
+			return 0, errControlledPropertyQuery
+		}
+
+		controlledProperties, err := cs.db.GetControlledProperties()
+		return int64(len(controlledProperties)), err
+	}
+
+	return 0, nil
+}
+
+var errControlledPropertyQuery = database.NewError(
+	database.ErrInvalidInput, "the q parameter is not supported for entities of type %s", ControlledPropertyTypeName,
+)
+
+func pageBounds(page database.Pagination, count int) (int, int) {
+	first := int(page.Offset)
+	if first > count {
+		first = count
+	}
+
+	last := count
+	if page.Limit > 0 && first+int(page.Limit) < count {
+		last = first + int(page.Limit)
+	}
+
+	return first, last
+}
+
+//DeleteEntity removes the Device or DeviceModel with the given entity ID
+func (cs *contextSource) DeleteEntity(entityID string) error {
+	return cs.audited(models.AuditOperationDelete, entityID, func(tx *contextSource) error {
+		return tx.removeEntity(entityID)
+	})
+}
+
+func (cs *contextSource) removeEntity(entityID string) error {
+	if strings.HasPrefix(entityID, fiware.DeviceIDPrefix) {
+		shortEntityID := entityID[len(fiware.DeviceIDPrefix):]
+		return cs.db.DeleteDevice(shortEntityID)
+	} else if strings.HasPrefix(entityID, fiware.DeviceModelIDPrefix) {
+		shortEntityID := entityID[len(fiware.DeviceModelIDPrefix):]
+		return cs.db.DeleteDeviceModel(shortEntityID)
+	}
+
+	return database.NewError(database.ErrInvalidInput, "unable to find entity type from entity ID: %s", entityID)
 }
 
-func (cs contextSource) ProvidesType(typeName string) bool {
-	return (typeName == "DeviceModel" || typeName == "Device")
+func (cs contextSource) providesType(typeName string) bool {
+	return (typeName == "DeviceModel" || typeName == "Device" || typeName == ControlledPropertyTypeName)
 }
 
-func (cs *contextSource) RetrieveEntity(entityID string, req ngsi.Request) (ngsi.Entity, error) {
+func (cs *contextSource) retrieveEntity(entityID string) (ngsi.Entity, error) {
 	if strings.HasPrefix(entityID, fiware.DeviceIDPrefix) {
 		shortEntityID := entityID[len(fiware.DeviceIDPrefix):]
 
 		device, err := cs.db.GetDeviceFromID(shortEntityID)
 		if err != nil {
-			return nil, fmt.Errorf("no Device found with ID %s: %s", shortEntityID, err.Error())
+			return nil, fmt.Errorf("no Device found with ID %s: %w", shortEntityID, err)
 		}
 
-		fiwareDevice := fiware.NewDevice(device.DeviceID, url.QueryEscape(device.Value))
 		deviceModel, err := cs.db.GetDeviceModelFromPrimaryKey(device.DeviceModelID)
 		if err != nil {
-			return nil, fmt.Errorf("no valid DeviceModel found: %s", err.Error())
+			return nil, fmt.Errorf("no valid DeviceModel found: %w", err)
 		}
 
-		fiwareDevice.RefDeviceModel, _ = fiware.NewDeviceModelRelationship(deviceModel.DeviceModelID)
-		if !device.DateLastValueReported.IsZero() {
-			fiwareDevice.DateLastValueReported = ngsitypes.CreateDateTimeProperty(
-				device.DateLastValueReported.Format(time.RFC3339),
-			)
-		}
-
-		return fiwareDevice, nil
+		return newDeviceEntity(device, deviceModel.DeviceModelID), nil
 	} else if strings.HasPrefix(entityID, fiware.DeviceModelIDPrefix) {
 		shortEntityID := entityID[len(fiware.DeviceModelIDPrefix):]
 
 		deviceModel, err := cs.db.GetDeviceModelFromID(shortEntityID)
 		if err != nil {
-			return nil, fmt.Errorf("no DeviceModel found with ID %s: %s", shortEntityID, err.Error())
+			return nil, fmt.Errorf("no DeviceModel found with ID %s: %w", shortEntityID, err)
 		}
 
-		fiwareDeviceModel := fiware.NewDeviceModel(deviceModel.DeviceModelID, []string{deviceModel.Category})
-		fiwareDeviceModel.BrandName = ngsitypes.NewTextProperty(deviceModel.BrandName)
-		fiwareDeviceModel.ModelName = ngsitypes.NewTextProperty(deviceModel.ModelName)
-		fiwareDeviceModel.ManufacturerName = ngsitypes.NewTextProperty(deviceModel.ManufacturerName)
-		fiwareDeviceModel.Name = ngsitypes.NewTextProperty(deviceModel.Name)
+		return newDeviceModelEntity(deviceModel), nil
+	} else if strings.HasPrefix(entityID, ControlledPropertyIDPrefix) {
+		name := entityID[len(ControlledPropertyIDPrefix):]
 
-		return fiwareDeviceModel, nil
+		controlledProperty, err := cs.db.GetControlledPropertyFromName(name)
+		if err != nil {
+			return nil, fmt.Errorf("no DeviceControlledProperty found with name %s: %w", name, err)
+		}
+
+		return newControlledPropertyEntity(controlledProperty), nil
 	}
 
-	return nil, fmt.Errorf("unable to find entity type from entity ID: %s", entityID)
+	return nil, database.NewError(database.ErrNotFound, "unable to find entity type from entity ID: %s", entityID)
 }
 
-func (cs *contextSource) UpdateEntityAttributes(entityID string, req ngsi.Request) error {
+func (cs *contextSource) updateEntityAttributes(entityID string, decodeBodyInto bodyDecoder) error {
+	// The body is decoded twice, first to find out if the update only reports a new value
+	body := json.RawMessage{}
+	err := decodeBody(decodeBodyInto, &body)
+	if err != nil {
+		return err
+	}
+
+	decodeAgain := func(v interface{}) error {
+		return json.Unmarshal(body, v)
+	}
+
+	if reportsValueOnly(entityID, decodeAgain) {
+		return cs.storeEntityUpdate(entityID, decodeAgain, false)
+	}
+
+	return cs.audited(models.AuditOperationUpdate, entityID, func(tx *contextSource) error {
+		return tx.storeEntityUpdate(entityID, decodeAgain, false)
+	})
+}
+
+//replaceEntity replaces all the attributes of an existing entity, clearing the optional
+//attributes that are not part of the body
+func (cs *contextSource) replaceEntity(entityID string, decodeBodyInto bodyDecoder) error {
+	return cs.audited(models.AuditOperationUpdate, entityID, func(tx *contextSource) error {
+		return tx.storeEntityUpdate(entityID, decodeBodyInto, true)
+	})
+}
+
+func (cs *contextSource) storeEntityUpdate(entityID string, decodeBodyInto bodyDecoder, replace bool) error {
+
+	if strings.HasPrefix(entityID, ControlledPropertyIDPrefix) {
+		return cs.updateControlledProperty(entityID[len(ControlledPropertyIDPrefix):], decodeBodyInto, replace)
+	}
+
+	if strings.HasPrefix(entityID, fiware.DeviceModelIDPrefix) {
+		update, err := newDeviceModelUpdate(entityID, decodeBodyInto)
+		if err != nil {
+			cs.log.Errorf("Failed to decode PATCH body in UpdateEntityAttributes: %s", err.Error())
+			return err
+		}
 
-	updateSource := &fiware.Device{}
-	err := req.DecodeBodyInto(updateSource)
+		update.Replace = replace
+		_, err = cs.db.UpdateDeviceModel(entityID[len(fiware.DeviceModelIDPrefix):], update)
+		return err
+	}
+
+	if !strings.HasPrefix(entityID, fiware.DeviceIDPrefix) {
+		return database.NewError(database.ErrInvalidInput, "attributes of entity %s can not be updated", entityID)
+	}
+
+	patch, err := newDevicePatch(entityID, decodeBodyInto)
 	if err != nil {
 		cs.log.Errorf("Failed to decode PATCH body in UpdateEntityAttributes: %s", err.Error())
 		return err
 	}
 
+	update, err := patch.update()
+	if err != nil {
+		return err
+	}
+	update.Replace = replace
+
+	var value string
+	var observedAt time.Time
+
+	if patch.Value != nil {
+		value, err = url.QueryUnescape(patch.Value.Value)
+		if err != nil {
+			return database.NewError(database.ErrInvalidInput, "malformed value: %s", err.Error())
+		}
+
+		observedAt, err = patch.Value.GetObservedAt()
+		if err != nil {
+			return err
+		}
+	}
+
 	// Truncate the fiware prefix from the device id string
 	shortEntityID := entityID[len(fiware.DeviceIDPrefix):]
 	device, err := cs.db.GetDeviceFromID(shortEntityID)
@@ -297,59 +611,89 @@ func (cs *contextSource) UpdateEntityAttributes(entityID string, req ngsi.Reques
 		return err
 	}
 
-	value, err := url.QueryUnescape(updateSource.Value.Value)
-	if err == nil {
-		err = cs.db.UpdateDeviceValue(shortEntityID, value)
-		if err == nil {
+	var latestValues []database.LatestValue
+
+	err = cs.db.Transaction(func(tx database.Datastore) error {
+		if replace || patch.changesDevice() {
+			device, err = tx.UpdateDevice(shortEntityID, update)
+			if err != nil {
+				return err
+			}
+		}
+
+		if patch.Value != nil {
+			latestValues, err = tx.UpdateDeviceValue(shortEntityID, value, observedAt)
+			return err
+		}
+
+		return nil
+	})
+
+	// The values are only published once they are stored for certain
+	if err == nil && len(latestValues) > 0 {
+		cs.afterCommit(func() {
 			postWaterTempTelemetryIfDeviceIsAWaterTempDevice(
 				cs,
 				shortEntityID,
 				device.Latitude, device.Longitude,
-				value,
+				latestValues,
 			)
-		}
+		})
 	}
 
 	return err
 }
 
+func (cs *contextSource) updateControlledProperty(name string, decodeBodyInto bodyDecoder, replace bool) error {
+	updateSource := &DeviceControlledProperty{}
+	err := decodeBody(decodeBodyInto, updateSource)
+	if err != nil {
+		cs.log.Errorf("Failed to decode PATCH body in UpdateEntityAttributes: %s", err.Error())
+		return err
+	}
+
+	if updateSource.Name != nil && updateSource.Name.Value != name {
+		return database.NewError(database.ErrInvalidInput, "the name of controlled property %s can not be changed", name)
+	}
+
+	update, err := newControlledPropertyUpdate(updateSource)
+	if err != nil {
+		return err
+	}
+	update.Replace = replace
+
+	_, err = cs.db.UpdateControlledProperty(name, update)
+	return err
+}
+
 func isActiveWaterTempSensor(sensor string) bool {
 	// TODO: Replace this hard codery with a status flag on the actual Device instead
 	return strings.HasSuffix(sensor, "sk-elt-temp-01") || strings.HasSuffix(sensor, "sk-elt-temp-02")
 }
 
-//This is a hack to decode the value and send it as a telemetry message over RabbitMQ for PoC purposes.
-func postWaterTempTelemetryIfDeviceIsAWaterTempDevice(cs *contextSource, device string, lat, lon float64, value string) {
+//This is a hack to send the stored water temperatures as telemetry messages over RabbitMQ for PoC purposes.
+//Only the values that were stored as the latest values of the device are sent, so that values inside
+//of the deadband or that arrive out of order are not forwarded.
+func postWaterTempTelemetryIfDeviceIsAWaterTempDevice(cs *contextSource, device string, lat, lon float64, values []database.LatestValue) {
 	if isActiveWaterTempSensor(device) {
-		decodedValue, err := url.QueryUnescape(value)
-		if err != nil {
-			return
-		}
-
-		values := strings.Split(decodedValue, ";")
 		for _, v := range values {
-			parts := strings.Split(v, "=")
-			if len(parts) == 2 {
-				if parts[0] == "t" {
-					temp, err := strconv.ParseFloat(parts[1], 64)
-					if err == nil {
-						// TODO: Make this configurable
-						const MinTemp float64 = -0.5
-						const MaxTemp float64 = 28.0
-						if temp >= MinTemp && temp <= MaxTemp {
-							wtt := telemetry.NewWaterTemperatureTelemetry(temp, device, lat, lon)
-							storeTempCommand := &temperaturecmds.StoreWaterTemperatureUpdate{
-								WaterTemperature: *wtt,
-							}
-							cs.messenger.SendCommandTo(storeTempCommand, "api-temperature")
-						} else {
-							cs.log.Infof(
-								"ignored water temp value from %s: %f not in allowed range [%f,%f]",
-								device, temp, MinTemp, MaxTemp,
-							)
-						}
+			if v.ControlledProperty == "temperature" && v.Value.NumberValue != nil {
+				temp := *v.Value.NumberValue
+
+				// TODO: Make this configurable
+				const MinTemp float64 = -0.5
+				const MaxTemp float64 = 28.0
+				if temp >= MinTemp && temp <= MaxTemp {
+					wtt := telemetry.NewWaterTemperatureTelemetry(temp, device, lat, lon)
+					storeTempCommand := &temperaturecmds.StoreWaterTemperatureUpdate{
+						WaterTemperature: *wtt,
 					}
-					return
+					cs.messenger.SendCommandTo(storeTempCommand, "api-temperature")
+				} else {
+					cs.log.Infof(
+						"ignored water temp value from %s: %f not in allowed range [%f,%f]",
+						device, temp, MinTemp, MaxTemp,
+					)
 				}
 			}
 		}
@@ -7,16 +7,20 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	temperaturecmds "github.com/iot-for-tillgenglighet/api-temperature/pkg/infrastructure/messaging/commands"
 	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/logging"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
 	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/models"
 	"github.com/iot-for-tillgenglighet/messaging-golang/pkg/messaging"
 	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
-	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
 	ngsitypes "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/types"
+	"gorm.io/gorm"
 )
 
 func TestMain(m *testing.M) {
@@ -25,12 +29,12 @@ func TestMain(m *testing.M) {
 
 func TestThatCreateEntityDoesNotAcceptUnknownBody(t *testing.T) {
 	bodyContents := []byte("{\"json\":\"json\"}")
-	req, _ := http.NewRequest("POST", createURL("/ngsi-ld/v1/entities"), bytes.NewBuffer(bodyContents))
+	req, _ := http.NewRequest("POST", createURL("/entities"), bytes.NewBuffer(bodyContents))
 	w := httptest.NewRecorder()
 	log := logging.NewLogger()
 
-	ctxreg := createContextRegistry(log, nil, nil)
-	ngsi.NewCreateEntityHandler(ctxreg).ServeHTTP(w, req)
+	ctxSource := newContextSource(log, nil, &dbMock{})
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
 
 	if w.Code != http.StatusBadRequest {
 		t.Error("CreateEntity did not return a BadRequest status.")
@@ -47,11 +51,11 @@ func TestThatCreateEntityStoresCorrectDevice(t *testing.T) {
 	jsonBytes, _ := json.Marshal(device)
 	log := logging.NewLogger()
 
-	req, _ := http.NewRequest("POST", createURL("/ngsi-ld/v1/entities"), bytes.NewBuffer(jsonBytes))
+	req, _ := http.NewRequest("POST", createURL("/entities"), bytes.NewBuffer(jsonBytes))
 	w := httptest.NewRecorder()
 
-	ctxreg := createContextRegistry(log, nil, db)
-	ngsi.NewCreateEntityHandler(ctxreg).ServeHTTP(w, req)
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
 
 	if db.createCount != 1 {
 		t.Error("CreateCount should be 1, but was ", db.createCount, "!")
@@ -72,79 +76,1288 @@ func TestThatCreateEntityStoresCorrectDeviceModel(t *testing.T) {
 	jsonBytes, _ := json.Marshal(deviceModel)
 	log := logging.NewLogger()
 
-	req, _ := http.NewRequest("POST", createURL("/ngsi-ld/v1/entities"), bytes.NewBuffer(jsonBytes))
+	req, _ := http.NewRequest("POST", createURL("/entities"), bytes.NewBuffer(jsonBytes))
 	w := httptest.NewRecorder()
 
-	ctxreg := createContextRegistry(log, nil, db)
-	ngsi.NewCreateEntityHandler(ctxreg).ServeHTTP(w, req)
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
 
 	if db.createCount != 1 {
 		t.Error("CreateCount should be 1, but was ", db.createCount, "!")
 	}
 }
 
+func TestThatCreateEntityStoresDeviceModelDeadband(t *testing.T) {
+	db := &dbMock{}
+
+	deviceModel := &DeviceModel{
+		DeviceModel: fiware.NewDeviceModel("badtemperatur", []string{"sensor"}),
+		DeadbandAttributes: DeadbandAttributes{
+			DeadbandAbsolute:   ngsitypes.NewNumberProperty(0.5),
+			MaxSilenceInterval: ngsitypes.NewNumberProperty(3600),
+		},
+	}
+
+	jsonBytes, _ := json.Marshal(deviceModel)
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest("POST", createURL("/entities"), bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if db.deviceModelDeadband == nil {
+		t.Fatalf("Expected the device model deadband to be stored. Response was %d.", w.Code)
+	}
+
+	expected := models.Deadband{DeadbandAbsolute: 0.5, MaxSilenceSeconds: 3600}
+	if *db.deviceModelDeadband != expected {
+		t.Errorf("Stored deadband %+v did not match expected %+v", *db.deviceModelDeadband, expected)
+	}
+}
+
 func TestThatCreateEntityFailsOnUnknownEntity(t *testing.T) {
 	db := &dbMock{
-		createDeviceModelError: errors.New("test"),
+		createDeviceModelError: database.NewError(database.ErrInvalidInput, "test"),
+	}
+
+	categories := []string{"sensor"}
+	deviceModel := fiware.NewDeviceModel("badtemperatur", categories)
+	deviceModel.ControlledProperty = ngsitypes.NewTextListProperty([]string{"temperature"})
+
+	jsonBytes, _ := json.Marshal(deviceModel)
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest("POST", createURL("/entities"), bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Error("CreateEntity did not return a BadRequest status.")
+	}
+}
+
+func TestThatPatchWaterTempDevicePublishesOnTheMessageQueue(t *testing.T) {
+	temperature := 12.0
+	db := &dbMock{
+		deviceFromID: &models.Device{Latitude: 64, Longitude: 17},
+		latestValues: []database.LatestValue{
+			{ControlledProperty: "temperature", Value: models.DeviceValue{Value: "12", NumberValue: &temperature}},
+		},
+	}
+	m := msgMock{}
+
+	jsonBytes, _ := json.Marshal(createDevicePatchWithValue("sk-elt-temp-02", "t%3D12%402021-05-10T14%3A30%3A00Z"))
+	req, _ := http.NewRequest("PATCH", createURL("/entities/urn:ngsi-ld:Device:sk-elt-temp-02/attrs/"), bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+	log := logging.NewLogger()
+
+	ctxSource := newContextSource(log, &m, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if m.CommandCount != 1 {
+		t.Fatal("Wrong command count: ", m.CommandCount, "!=", 1)
+	}
+
+	command, ok := m.commands[0].(*temperaturecmds.StoreWaterTemperatureUpdate)
+	if !ok {
+		t.Fatalf("Unexpected command sent: %v", m.commands[0])
+	}
+
+	telemetry := command.WaterTemperature
+	if telemetry.Temp != 12 || telemetry.Origin.Device != "sk-elt-temp-02" ||
+		telemetry.Origin.Latitude != 64 || telemetry.Origin.Longitude != 17 {
+		t.Errorf("Unexpected telemetry payload: %+v", telemetry)
+	}
+}
+
+func TestThatPatchWaterTempDeviceDoesNotPublishValuesThatWereNotStoredAsLatest(t *testing.T) {
+	db := &dbMock{
+		deviceFromID: &models.Device{Latitude: 64, Longitude: 17},
+	}
+	m := msgMock{}
+
+	jsonBytes, _ := json.Marshal(createDevicePatchWithValue("sk-elt-temp-02", "t%3D12"))
+	req, _ := http.NewRequest("PATCH", createURL("/entities/urn:ngsi-ld:Device:sk-elt-temp-02/attrs/"), bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+	log := logging.NewLogger()
+
+	ctxSource := newContextSource(log, &m, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if m.CommandCount != 0 {
+		t.Errorf("Expected no telemetry for a value inside of the deadband, but %d commands were sent", m.CommandCount)
+	}
+}
+
+func TestThatPatchWaterTempDeviceDoesNotPublishValuesThatAreRolledBack(t *testing.T) {
+	temperature := 12.0
+	db := &dbMock{
+		deviceFromID: &models.Device{Latitude: 64, Longitude: 17},
+		latestValues: []database.LatestValue{
+			{ControlledProperty: "temperature", Value: models.DeviceValue{Value: "12", NumberValue: &temperature}},
+		},
+		auditError: errors.New("audit log unavailable"),
+	}
+	m := msgMock{}
+
+	body := `{"value":{"type":"Property","value":"t%3D12"},"serialNumber":{"type":"Property","value":"LB-0001"}}`
+	req, _ := http.NewRequest("PATCH", createURL("/entities/urn:ngsi-ld:Device:sk-elt-temp-02/attrs/"), strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(logging.NewLogger(), &m, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError || m.CommandCount != 0 {
+		t.Errorf("Expected no telemetry for a value that was rolled back, but %d commands were sent (status %d)", m.CommandCount, w.Code)
+	}
+}
+
+func TestThatPatchDeviceValuePassesObservedAt(t *testing.T) {
+	db := &dbMock{
+		deviceFromID: &models.Device{},
+	}
+	log := logging.NewLogger()
+
+	body := `{"value":{"type":"Property","value":"t%3D12","observedAt":"2021-05-10T14:30:00+02:00"}}`
+	req, _ := http.NewRequest("PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:Device:sk-elt-temp-01/attrs/", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, &msgMock{}, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	expected := time.Date(2021, 5, 10, 12, 30, 0, 0, time.UTC)
+	if w.Code != http.StatusNoContent || !db.observedAt.Equal(expected) {
+		t.Errorf("Expected observedAt %s to be passed on, but got %s (status %d)", expected, db.observedAt, w.Code)
+	}
+}
+
+func TestThatPatchDeviceLocationUpdatesTheDevice(t *testing.T) {
+	db := &dbMock{
+		deviceFromID: &models.Device{},
+	}
+	log := logging.NewLogger()
+
+	body := `{"location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[17.3069,62.3908]}},
+		"refDeviceModel":{"type":"Relationship","object":"urn:ngsi-ld:DeviceModel:livboj"}}`
+	req, _ := http.NewRequest("PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:Device:livboj-01/attrs/", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, &msgMock{}, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent || db.deviceUpdate == nil || db.deviceUpdate.Location == nil {
+		t.Fatalf("Expected the location to be updated (status %d)", w.Code)
+	}
+
+	if *db.deviceUpdate.Location != [2]float64{17.3069, 62.3908} || *db.deviceUpdate.RefDeviceModel != "urn:ngsi-ld:DeviceModel:livboj" {
+		t.Errorf("Unexpected device update: %v, %s", *db.deviceUpdate.Location, *db.deviceUpdate.RefDeviceModel)
+	}
+
+	if db.deviceValue != "" {
+		t.Errorf("Expected the value to be left unchanged, but it was set to %s", db.deviceValue)
+	}
+}
+
+func TestThatPatchDeviceWithUnsupportedAttributeIsRejected(t *testing.T) {
+	db := &dbMock{
+		deviceFromID: &models.Device{},
+	}
+	log := logging.NewLogger()
+
+	body := `{"value":{"type":"Property","value":"t%3D12"},"colour":{"type":"Property","value":"yellow"}}`
+	req, _ := http.NewRequest("PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:Device:livboj-01/attrs/", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, &msgMock{}, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, but got %d", http.StatusBadRequest, w.Code)
+	}
+
+	problem := problemDetails{}
+	json.Unmarshal(w.Body.Bytes(), &problem)
+	if !strings.Contains(problem.Detail, "colour") || db.deviceValue != "" {
+		t.Errorf("Expected the update to be rejected because of the colour attribute, but got: %s", problem.Detail)
+	}
+}
+
+func TestThatPatchDeviceModelUpdatesTheDeviceModel(t *testing.T) {
+	db := &dbMock{}
+	log := logging.NewLogger()
+
+	body := `{"brandName":{"type":"Property","value":"Elsys"},
+		"controlledProperty":{"type":"Property","value":["temperature","humidity"]}}`
+	req, _ := http.NewRequest("PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:DeviceModel:ers/attrs/", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent || db.deviceModelUpdate == nil {
+		t.Fatalf("Expected the device model to be updated (status %d)", w.Code)
+	}
+
+	update := db.deviceModelUpdate
+	if *update.BrandName != "Elsys" || strings.Join(update.ControlledProperties, ",") != "temperature,humidity" || update.Name != nil {
+		t.Errorf("Unexpected device model update: %+v", *update)
+	}
+}
+
+func TestThatPatchedControlledPropertiesOfADeviceModelAreRetrieved(t *testing.T) {
+	log := logging.NewLogger()
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	router := createRequestRouter(newContextSource(log, nil, db))
+
+	for _, request := range []struct {
+		method, path, body string
+	}{
+		{"POST", "/ngsi-ld/v1/entities", `{"id":"urn:ngsi-ld:DeviceModel:ers","type":"DeviceModel",
+			"category":{"type":"Property","value":["sensor"]},
+			"controlledProperty":{"type":"Property","value":["temperature"]}}`},
+		{"PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:DeviceModel:ers/attrs/",
+			`{"controlledProperty":{"type":"Property","value":["temperature","snowDepth"]}}`},
+	} {
+		req, _ := http.NewRequest(request.method, request.path, strings.NewReader(request.body))
+		w := httptest.NewRecorder()
+		router.impl.ServeHTTP(w, req)
+
+		if w.Code != http.StatusCreated && w.Code != http.StatusNoContent {
+			t.Fatalf("%s %s failed with status %d: %s", request.method, request.path, w.Code, w.Body.String())
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities/urn:ngsi-ld:DeviceModel:ers", nil)
+	w := httptest.NewRecorder()
+	router.impl.ServeHTTP(w, req)
+
+	deviceModel := struct {
+		ControlledProperty struct {
+			Value []string `json:"value"`
+		} `json:"controlledProperty"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &deviceModel)
+
+	if strings.Join(deviceModel.ControlledProperty.Value, ",") != "snowDepth,temperature" &&
+		strings.Join(deviceModel.ControlledProperty.Value, ",") != "temperature,snowDepth" {
+		t.Errorf("Expected the patched controlled properties to be retrieved, but got %s", w.Body.String())
+	}
+}
+
+func TestThatPatchDeviceModelReturnsConflictWhenRemovingPropertiesInUse(t *testing.T) {
+	db := &dbMock{
+		deviceModelUpdateError: database.NewError(database.ErrDeviceModelInUse, "unable to remove controlled properties [humidity]"),
+	}
+	log := logging.NewLogger()
+
+	body := `{"controlledProperty":{"type":"Property","value":["temperature"]}}`
+	req, _ := http.NewRequest("PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:DeviceModel:ers/attrs/", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, but got %d", http.StatusConflict, w.Code)
+	}
+}
+
+func TestThatCreateDeviceStoresFiwareAttributes(t *testing.T) {
+	db := &dbMock{}
+	log := logging.NewLogger()
+
+	body := `{"id":"urn:ngsi-ld:Device:livboj-01","type":"Device",
+		"refDeviceModel":{"type":"Relationship","object":"urn:ngsi-ld:DeviceModel:livboj"},
+		"serialNumber":{"type":"Property","value":"LB-0001"},
+		"batteryLevel":{"type":"Property","value":0.75},
+		"owner":{"type":"Property","value":["urn:ngsi-ld:Organisation:fritid"]},
+		"dateInstalled":{"type":"Property","value":{"@type":"DateTime","@value":"2021-05-01T08:00:00Z"}}}`
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entities", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated || db.deviceUpdate == nil {
+		t.Fatalf("Expected the device to be created with its attributes (status %d)", w.Code)
+	}
+
+	update := db.deviceUpdate
+	if *update.SerialNumber != "LB-0001" || *update.BatteryLevel != 0.75 || update.Owner[0] != "urn:ngsi-ld:Organisation:fritid" ||
+		!update.DateInstalled.Equal(time.Date(2021, 5, 1, 8, 0, 0, 0, time.UTC)) || update.Name != nil {
+		t.Errorf("Unexpected device attributes: %+v", *update)
+	}
+}
+
+func TestThatRetrieveDeviceReturnsFiwareAttributes(t *testing.T) {
+	batteryLevel := 0.5
+	db := &dbMock{
+		deviceFromID: &models.Device{
+			DeviceID: "livboj-01", Name: "Livboj 1", DeviceState: "ok", BatteryLevel: &batteryLevel,
+		},
+		deviceModelReturned: &models.DeviceModel{DeviceModelID: "livboj"},
+	}
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities/urn:ngsi-ld:Device:livboj-01", nil)
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	device := &Device{}
+	json.Unmarshal(w.Body.Bytes(), device)
+
+	if w.Code != http.StatusOK || device.Name == nil || device.Name.Value != "Livboj 1" ||
+		device.DeviceState.Value != "ok" || device.BatteryLevel.Value != 0.5 || device.SerialNumber != nil {
+		t.Errorf("Unexpected device attributes in response: %s", w.Body.String())
+	}
+}
+
+func TestThatRequestsAreServedOnBehalfOfTheTenantInTheHeader(t *testing.T) {
+	db := &dbMock{}
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=Device", nil)
+	req.Header.Set("NGSILD-Tenant", "sundsvall")
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || db.tenant == nil || *db.tenant != "sundsvall" {
+		t.Errorf("Expected the request to be scoped to the tenant sundsvall (status %d)", w.Code)
+	}
+
+	if w.Header().Get("NGSILD-Tenant") != "sundsvall" {
+		t.Errorf("Expected the tenant to be returned in the response headers")
+	}
+}
+
+func TestThatTenantsCanNotPatchTheSharedControlledProperties(t *testing.T) {
+	log := logging.NewLogger()
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	body := `{"deadbandAbsolute":{"type":"Property","value":100}}`
+	req, _ := http.NewRequest("PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:DeviceControlledProperty:temperature/attrs/", strings.NewReader(body))
+	req.Header.Set(tenantHeader, "sundsvall")
+	w := httptest.NewRecorder()
+
+	createRequestRouter(newContextSource(log, nil, db)).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, but got %d", http.StatusForbidden, w.Code)
+	}
+
+	temperature, _ := db.GetControlledPropertyFromName("temperature")
+	if temperature.Deadband.DeadbandAbsolute != 0 {
+		t.Errorf("Expected the deadband of the controlled property to be unchanged, but got %+v", temperature.Deadband)
+	}
+}
+
+func TestThatInvalidTenantNamesAreRejected(t *testing.T) {
+	db := &dbMock{}
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=Device", nil)
+	req.Header.Set("NGSILD-Tenant", "sundsvall; DROP TABLE devices")
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest || db.tenant != nil {
+		t.Errorf("Expected status code %d, but got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestThatChangesAreRecordedInTheAuditLog(t *testing.T) {
+	db := &dbMock{
+		deviceFromID:        &models.Device{DeviceID: "livboj-01"},
+		deviceModelReturned: &models.DeviceModel{DeviceModelID: "livboj"},
+	}
+	log := logging.NewLogger()
+
+	body := `{"serialNumber":{"type":"Property","value":"LB-0001"}}`
+	req, _ := http.NewRequest("PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:Device:livboj-01/attrs/", strings.NewReader(body))
+	req.RemoteAddr = "10.0.0.2:41234"
+	req.Header.Set("X-Forwarded-User", "technician")
+	req.Header.Set("X-Forwarded-For", "10.0.0.17, 10.0.0.1")
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, &msgMock{}, db)
+	ctxSource.proxies, _ = parseTrustedProxies("10.0.0.1, 10.0.0.2/32")
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent || len(db.auditEntries) != 1 {
+		t.Fatalf("Expected one audit entry for the update (status %d)", w.Code)
+	}
+
+	entry := db.auditEntries[0]
+	if entry.EntityID != "urn:ngsi-ld:Device:livboj-01" || entry.EntityType != "Device" || entry.Operation != "update" ||
+		entry.Actor != "technician" || entry.SourceIP != "10.0.0.17" || entry.Before == "" || entry.After == "" {
+		t.Errorf("Unexpected audit entry: %+v", entry)
+	}
+}
+
+func TestThatForwardedHeadersAreIgnoredUnlessTheyComeFromATrustedProxy(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/24, 2001:db8::1")
+	if err != nil {
+		t.Fatalf("Failed to parse trusted proxies: %s", err.Error())
+	}
+
+	for _, tc := range []struct {
+		remoteAddr, forwardedFor string
+		expected                 requestOrigin
+	}{
+		{"192.0.2.7:41234", "10.0.0.17", requestOrigin{sourceIP: "192.0.2.7"}},
+		{"10.0.0.1:41234", "192.0.2.99, 192.0.2.7", requestOrigin{actor: "technician", sourceIP: "192.0.2.7"}},
+		{"[2001:db8::1]:41234", "192.0.2.7, 10.0.0.2", requestOrigin{actor: "technician", sourceIP: "192.0.2.7"}},
+	} {
+		req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=Device", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set("X-Forwarded-User", "technician")
+		req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+
+		if origin := newRequestOrigin(req, proxies); origin != tc.expected {
+			t.Errorf("Expected a request from %s for %s to originate from %+v, but got %+v", tc.remoteAddr, tc.forwardedFor, tc.expected, origin)
+		}
+	}
+
+	_, err = parseTrustedProxies("10.0.0.0/33")
+	if err == nil {
+		t.Error("Expected a malformed trusted proxy to be rejected")
+	}
+}
+
+func TestThatDeviceValueReportsAreNotAudited(t *testing.T) {
+	db := &dbMock{
+		deviceFromID: &models.Device{},
+	}
+	log := logging.NewLogger()
+
+	body := `{"value":{"type":"Property","value":"t%3D12"}}`
+	req, _ := http.NewRequest("PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:Device:livboj-01/attrs/", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, &msgMock{}, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent || db.deviceValue != "t=12" || len(db.auditEntries) != 0 {
+		t.Errorf("Expected the value to be stored without an audit entry, but got %v (status %d)", db.auditEntries, w.Code)
+	}
+}
+
+func TestThatTheAdminAPIIsOnlyServedThroughATrustedProxy(t *testing.T) {
+	db := &dbMock{}
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest("GET", "/admin/audit", nil)
+	req.RemoteAddr = "192.0.2.7:41234"
+	req.Header.Set("X-Forwarded-User", "admin")
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	ctxSource.proxies, _ = parseTrustedProxies("10.0.0.1")
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden || db.auditQuery != nil {
+		t.Errorf("Expected the audit log to be forbidden for untrusted clients, but got status %d", w.Code)
+	}
+}
+
+func TestThatAuditLogCanBeQueriedByEntityAndTime(t *testing.T) {
+	db := &dbMock{
+		auditEntries: []models.AuditEntry{
+			{ID: 1, EntityID: "urn:ngsi-ld:Device:livboj-01", Operation: "create", After: `{"id":"urn:ngsi-ld:Device:livboj-01"}`},
+		},
+	}
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest("GET", "/admin/audit?entityId=urn:ngsi-ld:Device:livboj-01&from=2021-05-01T00:00:00Z", nil)
+	req.Header.Set("X-Forwarded-User", "admin")
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	ctxSource.proxies = trustedProxies{all: true}
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || db.auditQuery == nil || db.auditQuery.EntityID != "urn:ngsi-ld:Device:livboj-01" ||
+		!db.auditQuery.From.Equal(time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)) || !db.auditQuery.To.IsZero() {
+		t.Fatalf("Expected the audit query to be passed to the database (status %d)", w.Code)
+	}
+
+	entries := []auditEntry{}
+	json.Unmarshal(w.Body.Bytes(), &entries)
+	if len(entries) != 1 || string(entries[0].After) != `{"id":"urn:ngsi-ld:Device:livboj-01"}` || entries[0].Before != nil {
+		t.Errorf("Unexpected audit log response: %s", w.Body.String())
+	}
+}
+
+func TestThatAuditLogRejectsTooLargePages(t *testing.T) {
+	for _, limit := range []string{"0", "1001"} {
+		db := &dbMock{}
+
+		req, _ := http.NewRequest("GET", "/admin/audit?limit="+limit, nil)
+		req.Header.Set("X-Forwarded-User", "admin")
+		w := httptest.NewRecorder()
+
+		ctxSource := newContextSource(logging.NewLogger(), nil, db)
+		ctxSource.proxies = trustedProxies{all: true}
+		createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+		if w.Code != http.StatusForbidden || db.auditQuery != nil {
+			t.Errorf("Expected a limit of %s to be rejected, but got status %d", limit, w.Code)
+		}
+	}
+}
+
+func TestThatCSVImportRowsBecomeDevices(t *testing.T) {
+	csv := "id,model,lat,lon,name\nsk-01,livboj,62.3908,17.3069,Beach\nsk-02,livboj,north,17.3069,\n"
+
+	rows, err := readCSVRows(strings.NewReader(csv))
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("Expected two rows, but got %d (%v)", len(rows), err)
+	}
+
+	device := struct {
+		ID             string `json:"id"`
+		RefDeviceModel struct {
+			Object string `json:"object"`
+		} `json:"refDeviceModel"`
+		Location struct {
+			Value struct {
+				Coordinates [2]float64 `json:"coordinates"`
+			} `json:"value"`
+		} `json:"location"`
+	}{}
+	json.Unmarshal(rows[0].entity.Body, &device)
+
+	if rows[0].row != 1 || device.ID != "urn:ngsi-ld:Device:sk-01" || device.RefDeviceModel.Object != "urn:ngsi-ld:DeviceModel:livboj" ||
+		device.Location.Value.Coordinates != [2]float64{17.3069, 62.3908} {
+		t.Errorf("Unexpected device from CSV row: %s", string(rows[0].entity.Body))
+	}
+
+	if rows[1].row != 2 || rows[1].err == nil || rows[1].entity.ID != "urn:ngsi-ld:Device:sk-02" {
+		t.Errorf("Expected the row with a malformed latitude to fail, but got %+v", rows[1])
+	}
+
+	_, err = readCSVRows(strings.NewReader("id,lat,lon\n"))
+	if err == nil {
+		t.Error("Expected a CSV file without a model column to be rejected")
+	}
+}
+
+func TestThatImportReportsEveryRowInInputOrder(t *testing.T) {
+	db := &dbMock{}
+	log := logging.NewLogger()
+
+	input := `[
+		{"id":"urn:ngsi-ld:Device:livboj-01","type":"Device","value":{"type":"Property","value":"on"},
+		 "refDeviceModel":{"type":"Relationship","object":"urn:ngsi-ld:DeviceModel:livboj"}},
+		{"id":"urn:ngsi-ld:DeviceModel:livboj","type":"DeviceModel","category":{"type":"Property","value":["sensor"]},
+		 "controlledProperty":{"type":"Property","value":["temperature"]}},
+		{"type":"Device"}
+	]`
+
+	report, err := ImportEntities(log, db, strings.NewReader(input), ImportOptions{
+		Format: ImportFormatJSONLD, Tenant: "sundsvall", Actor: "onboarding",
+	})
+	if err != nil || len(report.Rows) != 3 {
+		t.Fatalf("Expected a report with three rows, but got %v (%v)", report.Rows, err)
+	}
+
+	statuses := []string{}
+	for _, row := range report.Rows {
+		statuses = append(statuses, fmt.Sprintf("%d:%s", row.Row, row.Status))
+	}
+
+	if strings.Join(statuses, ",") != "1:created,2:created,3:failed" || report.Rows[2].Error == "" {
+		t.Errorf("Unexpected import report: %v", report.Rows)
+	}
+
+	if db.tenant == nil || *db.tenant != "sundsvall" || db.deviceValue != "" {
+		t.Error("Expected the devices to be imported into the tenant without their values")
+	}
+
+	if len(db.auditEntries) != 2 || db.auditEntries[0].EntityID != "urn:ngsi-ld:DeviceModel:livboj" || db.auditEntries[0].Actor != "onboarding" {
+		t.Errorf("Expected the device model to be created before the device, but got %v", db.auditEntries)
+	}
+}
+
+func TestThatReimportingAnUnchangedEntityReportsItAsUnchanged(t *testing.T) {
+	db := &dbMock{
+		createDeviceModelError: database.NewError(database.ErrAlreadyExists, "device model livboj already exists"),
+		deviceModelReturned:    &models.DeviceModel{DeviceModelID: "livboj", Category: "sensor"},
+	}
+
+	input := `[{"id":"urn:ngsi-ld:DeviceModel:livboj","type":"DeviceModel","category":{"type":"Property","value":["sensor"]}}]`
+	report, err := ImportEntities(logging.NewLogger(), db, strings.NewReader(input), ImportOptions{Format: ImportFormatJSONLD})
+
+	if err != nil || report.Count(ImportStatusUnchanged) != 1 || db.deviceModelUpdate == nil || !db.deviceModelUpdate.Replace {
+		t.Errorf("Expected the existing device model to be reported as unchanged, but got %v (%v)", report.Rows, err)
+	}
+}
+
+func TestThatReimportingADeviceClearsTheAttributesThatAreNoLongerInTheInput(t *testing.T) {
+	log := logging.NewLogger()
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	model := `[{"id":"urn:ngsi-ld:DeviceModel:livboj","type":"DeviceModel","category":{"type":"Property","value":["sensor"]},
+		"controlledProperty":{"type":"Property","value":["temperature"]}}]`
+	_, err = ImportEntities(log, db, strings.NewReader(model), ImportOptions{Format: ImportFormatJSONLD})
+	if err != nil {
+		t.Fatalf("Failed to import the device model: %s", err.Error())
+	}
+
+	for idx, tc := range []struct {
+		csv, status string
+	}{
+		{"id,model,lat,lon,name\nsk-01,livboj,62.3908,17.3069,Beach\n", ImportStatusCreated},
+		{"id,model,lat,lon\nsk-01,livboj,62.3908,17.3069\n", ImportStatusUpdated},
+		{"id,model,lat,lon\nsk-01,livboj,62.3908,17.3069\n", ImportStatusUnchanged},
+	} {
+		report, err := ImportEntities(log, db, strings.NewReader(tc.csv), ImportOptions{Format: ImportFormatCSV})
+		if err != nil || len(report.Rows) != 1 || report.Rows[0].Status != tc.status {
+			t.Fatalf("Expected import %d to report the device as %s, but got %v (%v)", idx+1, tc.status, report.Rows, err)
+		}
+	}
+
+	device, err := db.GetDeviceFromID("sk-01")
+	if err != nil || device.Name != "" {
+		t.Errorf("Expected the name of the device to be cleared by the reimport, but got %+v (%v)", device, err)
+	}
+}
+
+func TestThatASnapshotCanBeRestored(t *testing.T) {
+	temperature := 21.5
+	observedAt := time.Date(2021, 5, 1, 12, 0, 0, 250000000, time.UTC)
+	db := &dbMock{
+		controlledProperties: []models.DeviceControlledProperty{{Model: gorm.Model{ID: 1}, Name: "temperature", Abbreviation: "t"}},
+		deviceModels: []models.DeviceModel{
+			{DeviceModelID: "livboj", Category: "sensor", ControlledProperties: []models.DeviceControlledProperty{{Name: "temperature"}}},
+		},
+		devices: []models.Device{
+			{DeviceID: "livboj-01", Longitude: 17.3069, Latitude: 62.3908, DeviceModel: models.DeviceModel{DeviceModelID: "livboj"}},
+		},
+		valueHistory: []models.DeviceValue{
+			{DeviceControlledPropertyID: 1, Value: "21.5", NumberValue: &temperature, ObservedAt: observedAt},
+		},
+	}
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest("GET", "/admin/snapshot?format=ndjson&values=true", nil)
+	req.Header.Set("X-Forwarded-User", "admin")
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	ctxSource.proxies = trustedProxies{all: true}
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" || len(lines) != 4 {
+		t.Fatalf("Expected a snapshot with four entities (status %d): %s", w.Code, w.Body.String())
+	}
+
+	if db.readTransactions != 1 {
+		t.Errorf("Expected the snapshot to be read in one read transaction, but %d were used", db.readTransactions)
+	}
+
+	if !strings.Contains(lines[2], `"coordinates":[17.3069,62.3908]`) {
+		t.Errorf("Expected the device to include its location, but got %s", lines[2])
+	}
+
+	restored := &dbMock{controlledProperty: &models.DeviceControlledProperty{Name: "temperature", Abbreviation: "t"}}
+	report, err := RestoreSnapshot(
+		log, restored, strings.NewReader(w.Body.String()), ImportOptions{Format: SnapshotFormatNDJSON, Tenant: "sundsvall"},
+	)
+	if err != nil || report.Count(ImportStatusCreated) != 3 || report.Count(ImportStatusUnchanged) != 1 {
+		t.Fatalf("Expected the tenant's three entities to be restored, but got %v (%v)", report.Rows, err)
+	}
+
+	if restored.controlledPropertyUpdate != nil || restored.createCount != 2 {
+		t.Error("Expected the shared controlled property to be left as it is")
+	}
+
+	if restored.deviceUpdate == nil || *restored.deviceUpdate.Location != [2]float64{17.3069, 62.3908} ||
+		len(restored.restoredValues) != 1 || restored.restoredValues[0].Value != "21.5" ||
+		!restored.restoredValues[0].ObservedAt.Equal(observedAt) ||
+		restored.deviceModel.ControlledProperty == nil || restored.deviceModel.ControlledProperty.Value[0] != "temperature" {
+		t.Errorf("Unexpected restored device %+v and values %v", restored.deviceUpdate, restored.restoredValues)
+	}
+}
+
+func TestThatRestoreIntoATenantFailsOnControlledPropertiesThatDifferFromTheCatalog(t *testing.T) {
+	snapshot := `{"id":"urn:ngsi-ld:DeviceControlledProperty:temperature","type":"DeviceControlledProperty",` +
+		`"name":{"type":"Property","value":"temperature"},"unitCode":{"type":"Property","value":"CEL"}}`
+
+	for _, tc := range []struct {
+		catalog *models.DeviceControlledProperty
+		reason  string
+	}{
+		{nil, "must be created first"},
+		{&models.DeviceControlledProperty{Name: "temperature", UnitCode: "FAH"}, "in the shared catalog"},
+	} {
+		restored := &dbMock{controlledProperty: tc.catalog}
+		report, err := RestoreSnapshot(
+			logging.NewLogger(), restored, strings.NewReader(snapshot), ImportOptions{Format: SnapshotFormatNDJSON, Tenant: "sundsvall"},
+		)
+		if err != nil || report.Count(ImportStatusFailed) != 1 || !strings.Contains(report.Rows[0].Error, tc.reason) ||
+			restored.createCount != 0 || restored.controlledPropertyUpdate != nil {
+			t.Errorf("Expected the controlled property to fail without being changed, but got %v (%v)", report.Rows, err)
+		}
+	}
+}
+
+func TestThatRestoreIntoTheDefaultTenantCreatesTheControlledProperties(t *testing.T) {
+	snapshot := `{"id":"urn:ngsi-ld:DeviceControlledProperty:snowDepth","type":"DeviceControlledProperty",` +
+		`"name":{"type":"Property","value":"snowDepth"},"unitCode":{"type":"Property","value":"CMT"}}`
+
+	restored := &dbMock{}
+	report, err := RestoreSnapshot(logging.NewLogger(), restored, strings.NewReader(snapshot), ImportOptions{Format: SnapshotFormatNDJSON})
+	if err != nil || report.Count(ImportStatusCreated) != 1 || restored.controlledProperty == nil ||
+		restored.controlledProperty.Name != "snowDepth" || restored.controlledProperty.UnitCode != "CMT" {
+		t.Errorf("Expected the controlled property to be created, but got %v (%v)", report.Rows, err)
+	}
+}
+
+func TestThatSnapshotRejectsUnknownFormat(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/snapshot?format=xml", nil)
+	req.Header.Set("X-Forwarded-User", "admin")
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(logging.NewLogger(), nil, &dbMock{})
+	ctxSource.proxies = trustedProxies{all: true}
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown snapshot format to be rejected, but got status %d", w.Code)
+	}
+}
+
+func TestRetrieveEntity(t *testing.T) {
+	db := &dbMock{
+		deviceFromID:        &models.Device{},
+		deviceModelReturned: &models.DeviceModel{},
+	}
+
+	log := logging.NewLogger()
+	req, _ := http.NewRequest("GET", createURL("/entities/urn:ngsi-ld:DeviceModel:sk-elt-temp-02"), nil)
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Request failed: %d", w.Code)
+	}
+}
+
+func TestThatCreateEntityReturnsConflictForExistingDeviceModel(t *testing.T) {
+	db := &dbMock{
+		createDeviceModelError: database.NewError(database.ErrAlreadyExists, "an entity with id badtemperatur already exists"),
+	}
+
+	deviceModel := fiware.NewDeviceModel("badtemperatur", []string{"sensor"})
+	deviceModel.ControlledProperty = ngsitypes.NewTextListProperty([]string{"temperature"})
+
+	jsonBytes, _ := json.Marshal(deviceModel)
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entities", bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, but got %d", http.StatusConflict, w.Code)
+	}
+
+	problem := problemDetails{}
+	json.Unmarshal(w.Body.Bytes(), &problem)
+	if problem.Type != problemAlreadyExists {
+		t.Errorf("Unexpected problem type: %s", problem.Type)
+	}
+}
+
+func TestThatPatchUnknownDeviceReturnsNotFound(t *testing.T) {
+	db := &dbMock{
+		deviceFromIDError: fmt.Errorf("device nosuchdevice: %w", database.ErrNotFound),
+	}
+	log := logging.NewLogger()
+
+	jsonBytes, _ := json.Marshal(createDevicePatchWithValue("nosuchdevice", "t%3D12"))
+	req, _ := http.NewRequest("PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:Device:nosuchdevice/attrs/", bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, but got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestThatQueryEntitiesIsPaginated(t *testing.T) {
+	db := &dbMock{
+		deviceModels:     []models.DeviceModel{{DeviceModelID: "badtemperatur", Category: "sensor"}},
+		deviceModelCount: 7,
+	}
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=DeviceModel&limit=2&offset=6&count=true", nil)
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, but got %d", http.StatusOK, w.Code)
+	}
+
+	if db.page == nil || *db.page != (database.Pagination{Limit: 2, Offset: 6}) {
+		t.Errorf("Unexpected pagination passed to the database: %v", db.page)
+	}
+
+	if w.Header().Get("NGSILD-Results-Count") != "7" {
+		t.Errorf("Unexpected results count header: \"%s\"", w.Header().Get("NGSILD-Results-Count"))
+	}
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+	if len(entities) != 1 {
+		t.Errorf("Expected one entity in the response, but got %d", len(entities))
+	}
+}
+
+func TestThatQueryEntitiesPaginatesOverSeveralTypes(t *testing.T) {
+	db := &dbMock{
+		devices:          []models.Device{{DeviceID: "sk-elt-temp-01"}},
+		deviceCount:      3,
+		deviceModels:     []models.DeviceModel{{DeviceModelID: "badtemperatur", Category: "sensor"}},
+		deviceModelCount: 7,
 	}
+	log := logging.NewLogger()
 
-	categories := []string{"sensor"}
-	deviceModel := fiware.NewDeviceModel("badtemperatur", categories)
-	deviceModel.ControlledProperty = ngsitypes.NewTextListProperty([]string{"temperature"})
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=Device,DeviceModel&limit=5&offset=2&count=true", nil)
+	w := httptest.NewRecorder()
 
-	jsonBytes, _ := json.Marshal(deviceModel)
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, but got %d", http.StatusOK, w.Code)
+	}
+
+	// One device is returned for the last page of devices, so the rest of the page is device models
+	if db.page == nil || *db.page != (database.Pagination{Limit: 4, Offset: 0}) {
+		t.Errorf("Unexpected pagination passed to the database for device models: %v", db.page)
+	}
+
+	if w.Header().Get("NGSILD-Results-Count") != "10" {
+		t.Errorf("Unexpected results count header: \"%s\"", w.Header().Get("NGSILD-Results-Count"))
+	}
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+	if len(entities) != 2 {
+		t.Errorf("Expected a device and a device model in the response, but got %d entities", len(entities))
+	}
+}
+
+func TestThatQueryEntitiesWithoutTypeOnlyQueriesTypesWithTheQueriedAttributes(t *testing.T) {
+	db := &dbMock{}
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?q=batteryLevel<0.2", nil)
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, but got %d", http.StatusOK, w.Code)
+	}
+
+	if db.deviceFilter == nil || db.deviceFilter.Query == nil {
+		t.Error("Expected the devices to be queried")
+	}
+
+	if db.deviceModelFilter != nil {
+		t.Error("Expected device models not to be queried, as they have no battery level")
+	}
+
+	if db.page == nil || db.page.Limit != defaultPageSize {
+		t.Errorf("Expected the default page size to be used, but got %v", db.page)
+	}
+}
+
+func TestThatQueryEntitiesRejectsTooLargePages(t *testing.T) {
+	db := &dbMock{}
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=Device&limit=100000", nil)
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, but got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestThatBatchUpsertReplacesAnExistingEntity(t *testing.T) {
+	for _, test := range []struct {
+		options string
+		replace bool
+	}{
+		{"", true},
+		{"?options=update", false},
+	} {
+		db := &dbMock{
+			createDeviceError:   database.NewError(database.ErrAlreadyExists, "device sk-elt-temp-01 already exists"),
+			deviceFromID:        &models.Device{DeviceID: "sk-elt-temp-01"},
+			deviceModelReturned: &models.DeviceModel{DeviceModelID: "livboj"},
+		}
+		log := logging.NewLogger()
+
+		// A full entity, as returned by the registry, with attributes that can not be written
+		lastReported := time.Now()
+		device := newDeviceEntity(&models.Device{
+			DeviceID: "sk-elt-temp-01", Value: "t=12", DateLastValueReported: &lastReported, Name: "Pier",
+		}, "livboj")
+		jsonBytes, _ := json.Marshal([]interface{}{device})
+
+		req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entityOperations/upsert"+test.options, bytes.NewBuffer(jsonBytes))
+		w := httptest.NewRecorder()
+
+		ctxSource := newContextSource(log, nil, db)
+		createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code %d, but got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+
+		if db.deviceUpdate == nil || db.deviceUpdate.Replace != test.replace {
+			t.Errorf("Expected the device to be updated with replace %v, but got %+v", test.replace, db.deviceUpdate)
+		} else if db.deviceUpdate.Name == nil || *db.deviceUpdate.Name != "Pier" {
+			t.Errorf("Expected the name of the device to be updated, but got %+v", db.deviceUpdate)
+		}
+
+		if db.deviceValue != "" {
+			t.Errorf("Expected the value of the upserted entity to be ignored, but %s was stored", db.deviceValue)
+		}
+	}
+}
+
+func TestBatchCreateReportsResultPerEntity(t *testing.T) {
+	db := &dbMock{}
+	log := logging.NewLogger()
+
+	entities := []interface{}{
+		fiware.NewDevice("sk-elt-temp-01", ""),
+		fiware.NewDevice("sk-elt-temp-02", ""),
+		map[string]string{"id": "urn:ngsi-ld:Spaceship:enterprise", "type": "Spaceship"},
+	}
+
+	jsonBytes, _ := json.Marshal(entities)
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entityOperations/create", bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusMultiStatus {
+		t.Errorf("Expected status code %d, but got %d", http.StatusMultiStatus, w.Code)
+	}
+
+	result := BatchOperationResult{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+
+	if db.createCount != 2 || len(result.Success) != 2 || len(result.Errors) != 1 {
+		t.Errorf("Unexpected batch result: %+v (create count %d)", result, db.createCount)
+	} else if result.Errors[0].EntityID != "urn:ngsi-ld:Spaceship:enterprise" || result.Errors[0].Error.Status != http.StatusBadRequest {
+		t.Errorf("Unexpected batch error: %+v", result.Errors[0])
+	}
+}
+
+func TestBatchDeleteRemovesAllEntities(t *testing.T) {
+	db := &dbMock{}
+	log := logging.NewLogger()
+
+	body := `["urn:ngsi-ld:Device:sk-elt-temp-01"]`
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entityOperations/delete", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent || db.deletedDeviceID != "sk-elt-temp-01" {
+		t.Errorf("Unexpected response %d when deleting device %s", w.Code, db.deletedDeviceID)
+	}
+}
+
+func TestThatQueryEntitiesPassesGeoQueryToTheDatabase(t *testing.T) {
+	db := &dbMock{}
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest("GET", createURL("/entities",
+		"type=Device", "georel=near%3BmaxDistance%3D%3D2000", "geometry=Point", "coordinates=%5B17.3,62.4%5D"), nil)
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || db.deviceFilter == nil || db.deviceFilter.Geo == nil {
+		t.Fatalf("Expected the geo query to be passed to the database (status %d)", w.Code)
+	}
+
+	expected := database.GeoQuery{Relation: "near", Geometry: "Point", Point: [2]float64{17.3, 62.4}, MaxDistance: 2000}
+	if db.deviceFilter.Geo.Relation != expected.Relation || db.deviceFilter.Geo.Point != expected.Point ||
+		db.deviceFilter.Geo.MaxDistance != expected.MaxDistance {
+		t.Errorf("Unexpected geo query %+v", *db.deviceFilter.Geo)
+	}
+}
+
+func TestThatQueryEntitiesRejectsMalformedGeoQuery(t *testing.T) {
+	db := &dbMock{}
 	log := logging.NewLogger()
 
-	req, _ := http.NewRequest("POST", createURL("/ngsi-ld/v1/entities"), bytes.NewBuffer(jsonBytes))
+	req, _ := http.NewRequest("GET", createURL("/entities",
+		"type=Device", "georel=within", "geometry=Polygon", "coordinates=%5B17.3,62.4%5D"), nil)
 	w := httptest.NewRecorder()
 
-	ctxreg := createContextRegistry(log, nil, db)
-	ngsi.NewCreateEntityHandler(ctxreg).ServeHTTP(w, req)
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
 
 	if w.Code != http.StatusBadRequest {
-		t.Error("CreateEntity did not return a BadRequest status.")
+		t.Errorf("Expected status code %d, but got %d", http.StatusBadRequest, w.Code)
 	}
 }
 
-func TestThatPatchWaterTempDevicePublishesOnTheMessageQueue(t *testing.T) {
+func TestThatQueryEntitiesPassesAttributeQueryToTheDatabase(t *testing.T) {
+	db := &dbMock{}
+	log := logging.NewLogger()
+
+	q := url.QueryEscape(`category=="sensor";(controlledProperty=="temperature"|controlledProperty=="snowDepth")`)
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=DeviceModel&q="+q, nil)
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || db.deviceModelFilter == nil || db.deviceModelFilter.Query == nil {
+		t.Fatalf("Expected the attribute query to be passed to the database (status %d)", w.Code)
+	}
+
+	query := db.deviceModelFilter.Query
+	if query.Operator != "and" || len(query.Operands) != 2 || query.Operands[0].Attribute != "category" ||
+		query.Operands[0].Values[0] != "sensor" || query.Operands[1].Operator != "or" {
+		t.Errorf("Unexpected attribute query %+v", *query)
+	}
+}
+
+func TestThatMalformedAttributeQueriesAreRejected(t *testing.T) {
+	for _, q := range []string{`category`, `category=="sensor`, `(category=="sensor"`, `category=="sensor";`} {
+		if _, err := newAttributeQuery(q); err == nil {
+			t.Errorf("Expected query %s to be rejected", q)
+		}
+	}
+
+	query, err := newAttributeQuery("dateLastValueReported==2021-05-01T00:00:00Z..2021-05-02T00:00:00Z")
+	if err != nil || query.Range == nil || query.Range[1] != "2021-05-02T00:00:00Z" {
+		t.Errorf("Failed to parse range query: %v (%v)", query, err)
+	}
+}
+
+func TestThatDeleteEntityRemovesDevice(t *testing.T) {
+	db := &dbMock{}
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest("DELETE", "/ngsi-ld/v1/entities/urn:ngsi-ld:Device:sk-elt-temp-02", nil)
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Request failed: %d", w.Code)
+	}
+
+	if db.deletedDeviceID != "sk-elt-temp-02" {
+		t.Errorf("Unexpected device deleted: \"%s\"", db.deletedDeviceID)
+	}
+}
+
+func TestThatDeleteEntityReturnsConflictForDeviceModelInUse(t *testing.T) {
 	db := &dbMock{
-		deviceFromID: &models.Device{Latitude: 64, Longitude: 17},
+		deleteError: fmt.Errorf("in use: %w", database.ErrDeviceModelInUse),
 	}
-	m := msgMock{}
+	log := logging.NewLogger()
 
-	jsonBytes, _ := json.Marshal(createDevicePatchWithValue("sk-elt-temp-02", "t%3D12"))
-	req, _ := http.NewRequest("PATCH", createURL("/ngsi-ld/v1/entities/urn:ngsi-ld:Device:sk-elt-temp-02/attrs/"), bytes.NewBuffer(jsonBytes))
+	req, _ := http.NewRequest("DELETE", "/ngsi-ld/v1/entities/urn:ngsi-ld:DeviceModel:livboj", nil)
 	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, but got %d", http.StatusConflict, w.Code)
+	}
+}
+
+func TestThatCreateEntityStoresControlledProperty(t *testing.T) {
+	db := &dbMock{}
 	log := logging.NewLogger()
 
-	ctxreg := createContextRegistry(log, &m, db)
-	ngsi.NewUpdateEntityAttributesHandler(ctxreg).ServeHTTP(w, req)
+	property := newControlledPropertyEntity(&models.DeviceControlledProperty{
+		Name: "humidity", Abbreviation: "h", UnitCode: "P1", ValueType: models.ValueTypeNumber,
+	})
+	jsonBytes, _ := json.Marshal(property)
 
-	if m.CommandCount != 1 {
-		t.Error("Wrong command count: ", m.CommandCount, "!=", 1)
+	req, _ := http.NewRequest("POST", createURL("/entities"), bytes.NewBuffer(jsonBytes))
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if db.createCount != 1 {
+		t.Error("CreateCount should be 1, but was ", db.createCount, "!")
+	}
+
+	if db.controlledProperty.Name != "humidity" || db.controlledProperty.UnitCode != "P1" {
+		t.Errorf("Unexpected controlled property stored: %v", db.controlledProperty)
 	}
 }
 
-func TestRetrieveEntity(t *testing.T) {
+func TestThatPatchControlledPropertyUpdatesUnitCode(t *testing.T) {
 	db := &dbMock{
-		deviceFromID:        &models.Device{},
-		deviceModelReturned: &models.DeviceModel{},
+		controlledProperty: &models.DeviceControlledProperty{Name: "humidity"},
 	}
-
 	log := logging.NewLogger()
-	req, _ := http.NewRequest("GET", createURL("/ngsi-ld/v1/entities/urn:ngsi-ld:DeviceModel:sk-elt-temp-02"), nil)
+
+	jsonBytes := []byte(`{"unitCode":{"type":"Property","value":"P1"}}`)
+	req, _ := http.NewRequest("PATCH", createURL("/entities/urn:ngsi-ld:DeviceControlledProperty:humidity/attrs/"), bytes.NewBuffer(jsonBytes))
 	w := httptest.NewRecorder()
 
-	ctxreg := createContextRegistry(log, nil, db)
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if db.controlledPropertyUpdate == nil || db.controlledPropertyUpdate.UnitCode == nil {
+		t.Error("Expected the unit code of the controlled property to be updated.")
+	} else if *db.controlledPropertyUpdate.UnitCode != "P1" {
+		t.Errorf("Unexpected unit code: %s", *db.controlledPropertyUpdate.UnitCode)
+	}
+
+	if db.controlledPropertyUpdate != nil && db.controlledPropertyUpdate.Abbreviation != nil {
+		t.Error("Abbreviation should not be updated when it is not part of the patch.")
+	}
+}
+
+func TestRetrieveTemporalEntity(t *testing.T) {
+	temperature := 12.5
+	db := &dbMock{
+		controlledProperties: []models.DeviceControlledProperty{
+			{Model: gorm.Model{ID: 4}, Name: "temperature", UnitCode: "CEL", ValueType: models.ValueTypeNumber},
+		},
+		valueHistory: []models.DeviceValue{
+			{DeviceControlledPropertyID: 4, Value: "12.5", NumberValue: &temperature, ObservedAt: time.Now()},
+		},
+	}
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest(
+		"GET",
+		"/ngsi-ld/v1/temporal/entities/urn:ngsi-ld:Device:sk-elt-temp-02?timerel=after&timeAt=2021-05-01T00:00:00Z&lastN=5",
+		nil,
+	)
+	w := httptest.NewRecorder()
 
-	ngsi.NewRetrieveEntityHandler(ctxreg).ServeHTTP(w, req)
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("Request failed: %d", w.Code)
+		return
+	}
+
+	if db.valueHistoryQuery.LastN != 5 || db.valueHistoryQuery.From.IsZero() || !db.valueHistoryQuery.To.IsZero() {
+		t.Errorf("Unexpected value history query: %v", db.valueHistoryQuery)
+	}
+
+	entity := map[string][]TemporalPropertyInstance{}
+	json.Unmarshal(w.Body.Bytes(), &entity)
+
+	if len(entity["temperature"]) != 1 || entity["temperature"][0].Value != temperature {
+		t.Errorf("Unexpected temporal entity returned: %s", w.Body.String())
+	}
+}
+
+func TestThatQueryTemporalEntitiesIsPaginated(t *testing.T) {
+	temperature := 12.5
+	db := &dbMock{
+		controlledProperties: []models.DeviceControlledProperty{{Model: gorm.Model{ID: 4}, Name: "temperature"}},
+		devices:              []models.Device{{DeviceID: "sk-elt-temp-01"}, {DeviceID: "sk-elt-temp-02"}},
+		valueHistory:         []models.DeviceValue{{DeviceControlledPropertyID: 4, NumberValue: &temperature, ObservedAt: time.Now()}},
+	}
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/temporal/entities?type=Device&attrs=temperature&limit=2&offset=4", nil)
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(logging.NewLogger(), nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	if w.Code != http.StatusOK || len(entities) != 2 || db.page == nil || db.page.Limit != 2 || db.page.Offset != 4 {
+		t.Errorf("Unexpected paginated temporal query (status %d, page %v): %s", w.Code, db.page, w.Body.String())
+	}
+}
+
+func TestThatQueryTemporalEntitiesRejectsTooLargePages(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/temporal/entities?type=Device&limit=5000", nil)
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(logging.NewLogger(), nil, &dbMock{})
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, but got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestThatRetrieveTemporalEntityFailsOnBadTimeRel(t *testing.T) {
+	db := &dbMock{}
+	log := logging.NewLogger()
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/temporal/entities/urn:ngsi-ld:Device:sk-elt-temp-02?timerel=during", nil)
+	w := httptest.NewRecorder()
+
+	ctxSource := newContextSource(log, nil, db)
+	createRequestRouter(ctxSource).impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, but got %d", http.StatusBadRequest, w.Code)
 	}
 }
 
-// write unit test for retrieve entity where device is nil.
+//write unit test for retrieve entity where device is nil.
 
 func createDevicePatchWithValue(deviceid, value string) *fiware.Device {
 	device := fiware.NewDevice(deviceid, value)
@@ -169,6 +1382,7 @@ func createURL(path string, params ...string) string {
 
 type msgMock struct {
 	CommandCount uint32
+	commands     []messaging.CommandMessage
 }
 
 func (m *msgMock) PublishOnTopic(message messaging.TopicMessage) error {
@@ -177,6 +1391,7 @@ func (m *msgMock) PublishOnTopic(message messaging.TopicMessage) error {
 
 func (m *msgMock) SendCommandTo(command messaging.CommandMessage, key string) error {
 	m.CommandCount++
+	m.commands = append(m.commands, command)
 	return nil
 }
 
@@ -185,17 +1400,70 @@ type dbMock struct {
 	device                   *fiware.Device
 	deviceModel              *fiware.DeviceModel
 	createDeviceModelError   error
+	createDeviceError        error
 	deviceFromID             *models.Device
 	deviceFromIDError        error
 	deviceModelReturned      *models.DeviceModel
 	deviceModelReturnedError error
+	deletedDeviceID          string
+	deletedDeviceModelID     string
+	deleteError              error
+	controlledProperty       *models.DeviceControlledProperty
+	controlledPropertyUpdate *database.ControlledPropertyUpdate
+	controlledProperties     []models.DeviceControlledProperty
+	valueHistory             []models.DeviceValue
+	valueHistoryQuery        *database.ValueHistoryQuery
+	deviceModelDeadband      *models.Deadband
+	deviceModels             []models.DeviceModel
+	deviceModelCount         int64
+	deviceCount              int64
+	page                     *database.Pagination
+	observedAt               time.Time
+	deviceFilter             *database.DeviceFilter
+	deviceModelFilter        *database.DeviceModelFilter
+	deviceUpdate             *database.DeviceUpdate
+	deviceModelUpdate        *database.DeviceModelUpdate
+	deviceModelUpdateError   error
+	deviceValue              string
+	latestValues             []database.LatestValue
+	tenant                   *string
+	auditEntries             []models.AuditEntry
+	auditError               error
+	readTransactions         int
+	auditQuery               *database.AuditQuery
+	restoredValues           []database.RestoredValue
+	devices                  []models.Device
+}
+
+func (db *dbMock) AppendAuditEntry(entry models.AuditEntry) error {
+	if db.auditError != nil {
+		return db.auditError
+	}
+
+	db.auditEntries = append(db.auditEntries, entry)
+	return nil
+}
+
+func (db *dbMock) ApplyRetentionPolicies(now time.Time) ([]database.RetentionReport, error) {
+	return []database.RetentionReport{}, nil
+}
+
+func (db *dbMock) CreateControlledProperty(property *models.DeviceControlledProperty) (*models.DeviceControlledProperty, error) {
+	db.createCount++
+	db.controlledProperty = property
+
+	return db.controlledProperty, nil
 }
 
 func (db *dbMock) CreateDevice(device *fiware.Device) (*models.Device, error) {
+	if db.createDeviceError != nil {
+		return nil, db.createDeviceError
+	}
+
 	db.createCount++
 	db.device = device
 
-	return nil, nil
+	return &models.Device{DeviceID: strings.TrimPrefix(device.ID, fiware.DeviceIDPrefix)}, nil
 }
 
 func (db *dbMock) CreateDeviceModel(deviceModel *fiware.DeviceModel) (*models.DeviceModel, error) {
@@ -209,30 +1477,137 @@ func (db *dbMock) CreateDeviceModel(deviceModel *fiware.DeviceModel) (*models.De
 	return nil, nil
 }
 
+func (db *dbMock) DeleteAuditEntriesBefore(cutoff time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (db *dbMock) DeleteDevice(id string) error {
+	db.deletedDeviceID = id
+	return db.deleteError
+}
+
+func (db *dbMock) DeleteDeviceModel(id string) error {
+	db.deletedDeviceModelID = id
+	return db.deleteError
+}
+
+func (db *dbMock) GetControlledProperties() ([]models.DeviceControlledProperty, error) {
+	return db.controlledProperties, nil
+}
+
+func (db *dbMock) GetAuditEntries(query database.AuditQuery, page database.Pagination) ([]models.AuditEntry, error) {
+	db.auditQuery = &query
+	return db.auditEntries, nil
+}
+
+func (db *dbMock) GetControlledPropertyFromName(name string) (*models.DeviceControlledProperty, error) {
+	if db.controlledProperty != nil {
+		return db.controlledProperty, nil
+	}
+
+	return nil, fmt.Errorf("no such controlled property %s: %w", name, database.ErrNotFound)
+}
+
 func (db *dbMock) GetDeviceFromID(id string) (*models.Device, error) {
 	if db.deviceFromID != nil || db.deviceFromIDError != nil {
 		return db.deviceFromID, db.deviceFromIDError
 	}
 
-	return nil, fmt.Errorf("Unexpected call to GetDeviceFromID with id %s", id)
+	return nil, fmt.Errorf("device %s: %w", id, database.ErrNotFound)
+}
+
+func (db *dbMock) GetDeviceValueHistory(deviceID string, query database.ValueHistoryQuery) ([]models.DeviceValue, error) {
+	db.valueHistoryQuery = &query
+	return db.valueHistory, nil
+}
+
+func (db *dbMock) GetDeviceValueHistories(deviceIDs []string, query database.ValueHistoryQuery, page database.Pagination) ([]database.DeviceValueHistory, error) {
+	db.valueHistoryQuery = &query
+	db.page = &page
+
+	histories := []database.DeviceValueHistory{}
+	for _, device := range db.devices {
+		histories = append(histories, database.DeviceValueHistory{DeviceID: device.DeviceID, Values: db.valueHistory})
+	}
+	return histories, nil
 }
 
-func (db *dbMock) GetDevices() ([]models.Device, error) {
+func (db *dbMock) GetDevices(filter database.DeviceFilter, page database.Pagination) ([]models.Device, error) {
+	db.deviceFilter = &filter
+	db.page = &page
+	if db.devices != nil {
+		return db.devices, nil
+	}
 	return []models.Device{}, nil
 }
 
-func (db *dbMock) GetDeviceModels() ([]models.DeviceModel, error) {
-	return []models.DeviceModel{}, nil
+func (db *dbMock) GetDeviceCount(filter database.DeviceFilter) (int64, error) {
+	return db.deviceCount, nil
+}
+
+func (db *dbMock) GetDeviceModels(filter database.DeviceModelFilter, page database.Pagination) ([]models.DeviceModel, error) {
+	db.deviceModelFilter = &filter
+	db.page = &page
+	return db.deviceModels, nil
+}
+
+func (db *dbMock) GetDeviceModelCount(filter database.DeviceModelFilter) (int64, error) {
+	return db.deviceModelCount, nil
 }
 
 func (db *dbMock) GetDeviceModelFromID(id string) (*models.DeviceModel, error) {
-	return db.deviceModelReturned, db.deviceModelReturnedError
+	return db.GetDeviceModelFromPrimaryKey(0)
 }
 
 func (db *dbMock) GetDeviceModelFromPrimaryKey(id uint) (*models.DeviceModel, error) {
+	if db.deviceModelReturned == nil && db.deviceModelReturnedError == nil {
+		return nil, fmt.Errorf("device model: %w", database.ErrNotFound)
+	}
+
 	return db.deviceModelReturned, db.deviceModelReturnedError
 }
 
-func (db *dbMock) UpdateDeviceValue(deviceID, value string) error {
+func (db *dbMock) SetDeviceModelDeadband(deviceModelID string, deadband models.Deadband) error {
+	db.deviceModelDeadband = &deadband
+	return nil
+}
+
+func (db *dbMock) RestoreDeviceValues(deviceID string, values []database.RestoredValue) error {
+	db.restoredValues = append(db.restoredValues, values...)
 	return nil
 }
+
+func (db *dbMock) ReadTransaction(fn func(tx database.Datastore) error) error {
+	db.readTransactions++
+	return fn(db)
+}
+
+func (db *dbMock) Transaction(fn func(tx database.Datastore) error) error {
+	return fn(db)
+}
+
+func (db *dbMock) UpdateControlledProperty(name string, update database.ControlledPropertyUpdate) (*models.DeviceControlledProperty, error) {
+	db.controlledPropertyUpdate = &update
+	return db.controlledProperty, nil
+}
+
+func (db *dbMock) WithTenant(tenant string) database.Datastore {
+	db.tenant = &tenant
+	return db
+}
+
+func (db *dbMock) UpdateDevice(deviceID string, update database.DeviceUpdate) (*models.Device, error) {
+	db.deviceUpdate = &update
+	return db.deviceFromID, nil
+}
+
+func (db *dbMock) UpdateDeviceModel(deviceModelID string, update database.DeviceModelUpdate) (*models.DeviceModel, error) {
+	db.deviceModelUpdate = &update
+	return db.deviceModelReturned, db.deviceModelUpdateError
+}
+
+func (db *dbMock) UpdateDeviceValue(deviceID, value string, observedAt time.Time) ([]database.LatestValue, error) {
+	db.deviceValue = value
+	db.observedAt = observedAt
+	return db.latestValues, nil
+}
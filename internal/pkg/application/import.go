@@ -0,0 +1,416 @@
+package application
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/logging"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+)
+
+//Supported formats of the input to ImportEntities
+const (
+	ImportFormatJSONLD  string = "jsonld"
+	ImportFormatCSV     string = "csv"
+	ImportFormatGeoJSON string = "geojson"
+)
+
+//The outcome of importing a single row
+const (
+	ImportStatusCreated   string = "created"
+	ImportStatusUpdated   string = "updated"
+	ImportStatusUnchanged string = "unchanged"
+	ImportStatusFailed    string = "failed"
+)
+
+//ImportOptions controls how ImportEntities reads and stores its input
+type ImportOptions struct {
+	Format string
+	Tenant string
+	Actor  string // Recorded as the actor in the audit log
+	DryRun bool   // Reports what the import would do, but rolls back all changes
+}
+
+//ImportRow reports the outcome of importing a single row of the input
+type ImportRow struct {
+	Row      int    `json:"row"` // The 1-based index of the entity, feature or CSV record, not counting the header
+	EntityID string `json:"entityId,omitempty"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+//ImportReport reports the outcome of an import per row, in the order of the input
+type ImportReport struct {
+	DryRun bool        `json:"dryRun"`
+	Rows   []ImportRow `json:"rows"`
+}
+
+//Count returns the number of rows that were imported with the given status
+func (report ImportReport) Count(status string) int {
+	count := 0
+	for _, row := range report.Rows {
+		if row.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+//importRow is an entity read from the input, or the reason why a row could not be read. Rows
+//with values hold the value history of a device rather than an entity.
+type importRow struct {
+	row    int
+	entity batchEntity
+	values []database.RestoredValue
+	shared bool // The entity is shared by all tenants, so it is only checked against the existing one
+	err    error
+}
+
+//order returns the position of the row in the import, as models must exist before the devices
+//that refer to them, and devices before their values
+func (row importRow) order() int {
+	if row.values != nil {
+		return 4
+	}
+
+	switch row.entity.Type {
+	case ControlledPropertyTypeName:
+		return 0
+	case "DeviceModel":
+		return 1
+	case "Device":
+		return 2
+	}
+	return 3
+}
+
+var errImportDryRun = errors.New("dry run")
+var errImportUnchanged = errors.New("unchanged")
+
+//ImportEntities creates the devices, device models and controlled properties in the input.
+//Entities that already exist are replaced instead, so that an import can safely be run again and
+//always leaves the registry as it is described by the input.
+//A row that fails does not stop the import, but is reported together with its error.
+func ImportEntities(log logging.Logger, db database.Datastore, input io.Reader, options ImportOptions) (ImportReport, error) {
+	var rows []importRow
+	var err error
+
+	switch options.Format {
+	case ImportFormatJSONLD:
+		rows, err = readJSONLDRows(input)
+	case ImportFormatCSV:
+		rows, err = readCSVRows(input)
+	case ImportFormatGeoJSON:
+		rows, err = readGeoJSONRows(input)
+	default:
+		err = fmt.Errorf("import format %s is not supported", options.Format)
+	}
+
+	if err != nil {
+		return ImportReport{DryRun: options.DryRun, Rows: []ImportRow{}}, err
+	}
+
+	return importRows(log, db, rows, options)
+}
+
+func importRows(log logging.Logger, db database.Datastore, rows []importRow, options ImportOptions) (ImportReport, error) {
+	report := ImportReport{DryRun: options.DryRun, Rows: []ImportRow{}}
+
+	err := checkTenantName(options.Tenant)
+	if err != nil {
+		return report, err
+	}
+
+	// The order of the rows in the input does not matter
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].order() < rows[j].order()
+	})
+
+	cs := newContextSource(log, nil, db).withTenant(options.Tenant)
+	cs.origin = requestOrigin{actor: options.Actor}
+
+	err = cs.withTransaction(func(tx *contextSource) error {
+		for _, row := range rows {
+			result := ImportRow{Row: row.row, EntityID: row.entity.ID}
+
+			if row.err == nil && row.values != nil {
+				result.Status, row.err = tx.restoreValues(row.entity.ID, row.values)
+			} else if row.err == nil && row.shared {
+				result.Status, row.err = tx.checkCatalogProperty(row.entity)
+			} else if row.err == nil {
+				result.Status, row.err = tx.importEntity(row.entity)
+			}
+
+			if row.err != nil {
+				result.Status, result.Error = ImportStatusFailed, row.err.Error()
+			}
+
+			report.Rows = append(report.Rows, result)
+		}
+
+		if options.DryRun {
+			return errImportDryRun
+		}
+
+		return nil
+	})
+
+	sort.SliceStable(report.Rows, func(i, j int) bool {
+		return report.Rows[i].Row < report.Rows[j].Row
+	})
+
+	if err != nil && !errors.Is(err, errImportDryRun) {
+		return report, err
+	}
+
+	return report, nil
+}
+
+//importEntity creates or replaces the entity in a nested transaction of its own, so that a
+//failing entity leaves no partial writes and an unchanged entity leaves no audit entry
+func (cs *contextSource) importEntity(entity batchEntity) (string, error) {
+	status := ImportStatusCreated
+
+	err := cs.withTransaction(func(tx *contextSource) error {
+		err := tx.createEntity(entity.Type, entity.decodeBodyInto)
+		if !errors.Is(err, database.ErrAlreadyExists) {
+			return err
+		}
+
+		before, err := tx.snapshot(entity.ID)
+		if err != nil {
+			return err
+		}
+
+		err = tx.replaceEntity(entity.ID, entity.decodeBodyInto)
+		if err != nil {
+			return err
+		}
+
+		after, err := tx.snapshot(entity.ID)
+		if err != nil {
+			return err
+		}
+
+		if before == after {
+			status = ImportStatusUnchanged
+			return errImportUnchanged
+		}
+
+		status = ImportStatusUpdated
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, errImportUnchanged) {
+		return "", err
+	}
+
+	return status, nil
+}
+
+func readJSONLDRows(input io.Reader) ([]importRow, error) {
+	body, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+
+	rawEntities := []json.RawMessage{}
+	err = json.Unmarshal(body, &rawEntities)
+	if err != nil {
+		return nil, errors.New("a JSON-LD import must be an array of entities")
+	}
+
+	rows := []importRow{}
+	for idx, raw := range rawEntities {
+		attributes := map[string]interface{}{}
+		err = json.Unmarshal(raw, &attributes)
+		if err != nil {
+			rows = append(rows, importRow{row: idx + 1, err: errors.New("the entity is not a JSON object")})
+			continue
+		}
+
+		rows = append(rows, newImportRow(idx+1, attributes))
+	}
+
+	return rows, nil
+}
+
+//readCSVRows reads devices from a CSV file with a header row that names the columns id, model,
+//lat and lon, and optionally name
+func readCSVRows(input io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(input)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CSV header: %s", err.Error())
+	}
+
+	columns := map[string]int{}
+	for idx, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = idx
+	}
+
+	for _, required := range []string{"id", "model", "lat", "lon"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("the CSV header must have a column named %s", required)
+		}
+	}
+
+	rows := []importRow{}
+	row := 0
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		row++
+
+		if err != nil {
+			rows = append(rows, importRow{row: row, err: err})
+			continue
+		}
+
+		column := func(name string) string {
+			if idx, ok := columns[name]; ok && idx < len(record) {
+				return strings.TrimSpace(record[idx])
+			}
+			return ""
+		}
+
+		position, err := parsePosition(column("lon"), column("lat"))
+		if err != nil {
+			rows = append(rows, importRow{row: row, entity: batchEntity{ID: deviceEntityID(column("id"))}, err: err})
+			continue
+		}
+
+		rows = append(rows, newImportRow(row, newDeviceImport(column("id"), column("model"), position, column("name"))))
+	}
+
+	return rows, nil
+}
+
+//readGeoJSONRows reads devices from the Point features of a GeoJSON FeatureCollection. The id
+//of a device is the id of its feature, and its properties must include the model.
+func readGeoJSONRows(input io.Reader) ([]importRow, error) {
+	collection := struct {
+		Type     string `json:"type"`
+		Features []struct {
+			ID       interface{} `json:"id"`
+			Geometry *struct {
+				Type        string    `json:"type"`
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}{}
+
+	err := json.NewDecoder(input).Decode(&collection)
+	if err != nil || collection.Type != "FeatureCollection" {
+		return nil, errors.New("a GeoJSON import must be a FeatureCollection")
+	}
+
+	rows := []importRow{}
+	for idx, feature := range collection.Features {
+		property := func(name string) string {
+			if value, ok := feature.Properties[name]; ok && value != nil {
+				return fmt.Sprintf("%v", value)
+			}
+			return ""
+		}
+
+		id := property("id")
+		if feature.ID != nil {
+			id = fmt.Sprintf("%v", feature.ID)
+		}
+
+		if feature.Geometry == nil || feature.Geometry.Type != "Point" || len(feature.Geometry.Coordinates) != 2 {
+			rows = append(rows, importRow{
+				row: idx + 1, entity: batchEntity{ID: deviceEntityID(id)},
+				err: errors.New("the geometry of a device must be a Point with a longitude and a latitude"),
+			})
+			continue
+		}
+
+		position := [2]float64{feature.Geometry.Coordinates[0], feature.Geometry.Coordinates[1]}
+		rows = append(rows, newImportRow(idx+1, newDeviceImport(id, property("model"), position, property("name"))))
+	}
+
+	return rows, nil
+}
+
+//newImportRow turns the attributes of an entity into a row to import. Device values are
+//observations rather than registry data, so they are left out to keep imports idempotent.
+func newImportRow(row int, attributes map[string]interface{}) importRow {
+	entity := batchEntity{}
+	entity.ID, _ = attributes["id"].(string)
+	entity.Type, _ = attributes["type"].(string)
+
+	if entity.ID == "" {
+		return importRow{row: row, err: errors.New("the entity has no id")}
+	}
+
+	if entity.Type == "Device" {
+		delete(attributes, "value")
+		delete(attributes, "dateLastValueReported")
+	}
+
+	entity.Body, _ = json.Marshal(attributes)
+	return importRow{row: row, entity: entity}
+}
+
+func newDeviceImport(id, model string, position [2]float64, name string) map[string]interface{} {
+	device := map[string]interface{}{
+		"id":   deviceEntityID(id),
+		"type": "Device",
+		"location": map[string]interface{}{
+			"type":  "GeoProperty",
+			"value": map[string]interface{}{"type": "Point", "coordinates": position},
+		},
+	}
+
+	if model != "" {
+		if !strings.HasPrefix(model, fiware.DeviceModelIDPrefix) {
+			model = fiware.DeviceModelIDPrefix + model
+		}
+		device["refDeviceModel"] = map[string]interface{}{"type": "Relationship", "object": model}
+	}
+
+	if name != "" {
+		device["name"] = map[string]interface{}{"type": "Property", "value": name}
+	}
+
+	return device
+}
+
+//deviceEntityID prefixes a short device id, as used in CSV and GeoJSON files, to an entity id
+func deviceEntityID(id string) string {
+	if id == "" || strings.HasPrefix(id, fiware.DeviceIDPrefix) {
+		return id
+	}
+	return fiware.DeviceIDPrefix + id
+}
+
+func parsePosition(lon, lat string) ([2]float64, error) {
+	position := [2]float64{}
+
+	for idx, coordinate := range []string{lon, lat} {
+		value, err := strconv.ParseFloat(coordinate, 64)
+		if err != nil {
+			return position, fmt.Errorf("\"%s\" is not a valid coordinate", coordinate)
+		}
+		position[idx] = value
+	}
+
+	return position, nil
+}
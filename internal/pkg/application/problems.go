@@ -0,0 +1,72 @@
+package application
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+)
+
+const (
+	problemAlreadyExists         string = "https://uri.etsi.org/ngsi-ld/errors/AlreadyExists"
+	problemBadRequestData        string = "https://uri.etsi.org/ngsi-ld/errors/BadRequestData"
+	problemInternalError         string = "https://uri.etsi.org/ngsi-ld/errors/InternalError"
+	problemOperationNotSupported string = "https://uri.etsi.org/ngsi-ld/errors/OperationNotSupported"
+	problemResourceNotFound      string = "https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound"
+	problemTooManyResults        string = "https://uri.etsi.org/ngsi-ld/errors/TooManyResults"
+)
+
+//problemDetails is the RFC 7807 body that NGSI-LD uses to report errors to clients
+type problemDetails struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+//newProblemDetails translates the errors returned by the database into the matching status
+//code and problem type. Errors of an unknown kind are reported as internal errors.
+func newProblemDetails(err error) problemDetails {
+	status, problemType := http.StatusInternalServerError, problemInternalError
+
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		status, problemType = http.StatusNotFound, problemResourceNotFound
+	case errors.Is(err, database.ErrAlreadyExists):
+		status, problemType = http.StatusConflict, problemAlreadyExists
+	case errors.Is(err, database.ErrDeviceModelInUse):
+		status, problemType = http.StatusConflict, problemOperationNotSupported
+	case errors.Is(err, database.ErrForbidden):
+		status, problemType = http.StatusForbidden, problemOperationNotSupported
+	case errors.Is(err, database.ErrInvalidInput), errors.Is(err, database.ErrUnsupportedProperty):
+		status, problemType = http.StatusBadRequest, problemBadRequestData
+	}
+
+	return problemDetails{
+		Type:   problemType,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: err.Error(),
+	}
+}
+
+func reportError(w http.ResponseWriter, err error) {
+	problem := newProblemDetails(err)
+	reportProblem(w, problem.Status, problem.Type, problem.Detail)
+}
+
+func reportProblem(w http.ResponseWriter, status int, problemType, detail string) {
+	problem := problemDetails{
+		Type:   problemType,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+
+	w.Header().Add("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+
+	bytes, _ := json.Marshal(problem)
+	w.Write(bytes)
+}
@@ -0,0 +1,169 @@
+package application
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+)
+
+//newAttributeQuery parses an NGSI-LD query language expression, such as
+//refDeviceModel=="urn:ngsi-ld:DeviceModel:livboj";dateLastValueReported<2021-05-01T00:00:00Z
+//into an AttributeQuery. A semicolon means AND and binds harder than a pipe, that means OR.
+func newAttributeQuery(q string) (*database.AttributeQuery, error) {
+	parser := &queryParser{input: q}
+
+	query, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.pos < len(parser.input) {
+		return nil, parser.errorf("unexpected \"%s\"", parser.input[parser.pos:])
+	}
+
+	return query, nil
+}
+
+type queryParser struct {
+	input string
+	pos   int
+}
+
+func (p *queryParser) parseOr() (*database.AttributeQuery, error) {
+	return p.parseLogical(database.QueryOperatorOr, '|', p.parseAnd)
+}
+
+func (p *queryParser) parseAnd() (*database.AttributeQuery, error) {
+	return p.parseLogical(database.QueryOperatorAnd, ';', p.parseTerm)
+}
+
+func (p *queryParser) parseLogical(operator string, separator byte, parseOperand func() (*database.AttributeQuery, error)) (*database.AttributeQuery, error) {
+	operand, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	operands := []database.AttributeQuery{*operand}
+
+	for p.pos < len(p.input) && p.input[p.pos] == separator {
+		p.pos++
+
+		operand, err = parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		operands = append(operands, *operand)
+	}
+
+	if len(operands) == 1 {
+		return &operands[0], nil
+	}
+
+	return &database.AttributeQuery{Operator: operator, Operands: operands}, nil
+}
+
+func (p *queryParser) parseTerm() (*database.AttributeQuery, error) {
+	if p.pos < len(p.input) && p.input[p.pos] == '(' {
+		p.pos++
+
+		query, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.pos >= len(p.input) || p.input[p.pos] != ')' {
+			return nil, p.errorf("missing closing parenthesis")
+		}
+		p.pos++
+
+		return query, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *queryParser) parseComparison() (*database.AttributeQuery, error) {
+	start := p.pos
+	for p.pos < len(p.input) && isAttributeNameChar(p.input[p.pos]) {
+		p.pos++
+	}
+
+	query := &database.AttributeQuery{Attribute: p.input[start:p.pos]}
+	if query.Attribute == "" {
+		return nil, p.errorf("expected an attribute name")
+	}
+
+	for _, operator := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if strings.HasPrefix(p.input[p.pos:], operator) {
+			query.Operator = operator
+			p.pos += len(operator)
+			break
+		}
+	}
+
+	if query.Operator == "" {
+		return nil, p.errorf("expected a comparison operator after %s", query.Attribute)
+	}
+
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(p.input[p.pos:], "..") && query.Range == nil && len(query.Values) == 0 {
+			p.pos += 2
+
+			max, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+
+			query.Range = &[2]string{value, max}
+			return query, nil
+		}
+
+		query.Values = append(query.Values, value)
+
+		if p.pos >= len(p.input) || p.input[p.pos] != ',' {
+			return query, nil
+		}
+		p.pos++
+	}
+}
+
+//parseValue parses a quoted string or an unquoted value such as a number or a timestamp
+func (p *queryParser) parseValue() (string, error) {
+	if p.pos < len(p.input) && p.input[p.pos] == '"' {
+		end := strings.IndexByte(p.input[p.pos+1:], '"')
+		if end < 0 {
+			return "", p.errorf("unterminated string")
+		}
+
+		value := p.input[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return value, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) && !strings.ContainsRune(";|(),", rune(p.input[p.pos])) &&
+		!strings.HasPrefix(p.input[p.pos:], "..") {
+		p.pos++
+	}
+
+	if start == p.pos {
+		return "", p.errorf("expected a value")
+	}
+
+	return p.input[start:p.pos], nil
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid query at position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func isAttributeNameChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '.'
+}
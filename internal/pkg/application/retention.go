@@ -0,0 +1,53 @@
+package application
+
+import (
+	"time"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/logging"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+)
+
+//StartRetentionJob applies the retention policies of the controlled properties in the background
+//at the given interval, and deletes the audit entries that are older than the audit retention.
+//A zero or negative interval disables the job, and a zero audit retention keeps the audit log
+//forever.
+func StartRetentionJob(log logging.Logger, db database.Datastore, interval, auditRetention time.Duration) {
+	if interval <= 0 {
+		log.Infof("Retention job is disabled.")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			runRetentionJob(log, db, now, auditRetention)
+		}
+	}()
+}
+
+func runRetentionJob(log logging.Logger, db database.Datastore, now time.Time, auditRetention time.Duration) {
+	reports, err := db.ApplyRetentionPolicies(now)
+	if err != nil {
+		log.Errorf("Failed to apply device value retention policies: %s", err.Error())
+	}
+
+	for _, report := range reports {
+		if report.ValuesDeleted > 0 || report.AggregatesDeleted > 0 {
+			log.Infof(
+				"Retention of %s deleted %d values and %d aggregates, and created %d new aggregates.",
+				report.ControlledProperty, report.ValuesDeleted, report.AggregatesDeleted, report.AggregatesCreated,
+			)
+		}
+	}
+
+	if auditRetention > 0 {
+		deleted, err := db.DeleteAuditEntriesBefore(now.Add(-auditRetention))
+		if err != nil {
+			log.Errorf("Failed to apply the audit log retention: %s", err.Error())
+		} else if deleted > 0 {
+			log.Infof("Retention of the audit log deleted %d entries.", deleted)
+		}
+	}
+}
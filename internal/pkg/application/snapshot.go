@@ -0,0 +1,378 @@
+package application
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/logging"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
+)
+
+//Supported formats of a snapshot
+const (
+	SnapshotFormatJSONLD string = "jsonld" // A JSON array of entities
+	SnapshotFormatNDJSON string = "ndjson" // One entity per line
+)
+
+//snapshotHistoryPageSize is the number of devices whose value history is read at a time
+const snapshotHistoryPageSize uint64 = 100
+
+//SnapshotOptions controls what WriteSnapshot writes
+type SnapshotOptions struct {
+	Format        string
+	Tenant        string
+	IncludeValues bool // Adds the value history of every device as a temporal entity
+}
+
+//WriteSnapshot writes the controlled properties, device models and devices of a tenant as
+//NGSI-LD entities, in the order that they must be restored in. The value history of the devices
+//follows last, in the NGSI-LD temporal representation, if it is included.
+func WriteSnapshot(log logging.Logger, db database.Datastore, output io.Writer, options SnapshotOptions) error {
+	err := checkTenantName(options.Tenant)
+	if err != nil {
+		return err
+	}
+
+	return newContextSource(log, nil, db).withTenant(options.Tenant).writeSnapshot(output, options)
+}
+
+func (cs *contextSource) writeSnapshot(output io.Writer, options SnapshotOptions) error {
+	if options.Format != SnapshotFormatJSONLD && options.Format != SnapshotFormatNDJSON {
+		return fmt.Errorf("snapshot format %s is not supported", options.Format)
+	}
+
+	// The snapshot is read in a single read only transaction, so that it is consistent even if the
+	// registry changes while the snapshot is being written
+	return cs.db.ReadTransaction(func(tx database.Datastore) error {
+		txSource := &contextSource{db: tx, log: cs.log, messenger: cs.messenger, proxies: cs.proxies, origin: cs.origin}
+		return txSource.writeSnapshotEntities(output, options)
+	})
+}
+
+func (cs *contextSource) writeSnapshotEntities(output io.Writer, options SnapshotOptions) error {
+	writer := &snapshotWriter{output: output, format: options.Format}
+
+	for _, typeName := range []string{ControlledPropertyTypeName, "DeviceModel", "Device"} {
+		err := cs.queryEntities(typeName, entityQuery{}, database.Pagination{}, func(entity ngsi.Entity) error {
+			return writer.write(entity)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if options.IncludeValues {
+		// The histories are read a few devices at a time, as they can be large
+		page := database.Pagination{Limit: snapshotHistoryPageSize}
+		for {
+			count := 0
+			err := cs.QueryTemporalEntities(nil, database.ValueHistoryQuery{}, page, func(entity TemporalEntity) error {
+				count++
+				return writer.write(entity)
+			})
+			if err != nil {
+				return err
+			}
+
+			if count < int(page.Limit) {
+				break
+			}
+			page.Offset += page.Limit
+		}
+	}
+
+	return writer.close()
+}
+
+//snapshotWriter writes entities one at a time, so that a snapshot never has to be held in memory
+type snapshotWriter struct {
+	output io.Writer
+	format string
+	count  int
+}
+
+func (writer *snapshotWriter) write(entity interface{}) error {
+	bytes, err := json.Marshal(entity)
+	if err != nil {
+		return err
+	}
+
+	if writer.format == SnapshotFormatNDJSON {
+		_, err = fmt.Fprintf(writer.output, "%s\n", bytes)
+	} else if writer.count == 0 {
+		_, err = fmt.Fprintf(writer.output, "[\n%s", bytes)
+	} else {
+		_, err = fmt.Fprintf(writer.output, ",\n%s", bytes)
+	}
+
+	writer.count++
+	return err
+}
+
+func (writer *snapshotWriter) close() error {
+	if writer.format != SnapshotFormatJSONLD {
+		return nil
+	}
+
+	var err error
+	if writer.count == 0 {
+		_, err = io.WriteString(writer.output, "[]\n")
+	} else {
+		_, err = io.WriteString(writer.output, "\n]\n")
+	}
+	return err
+}
+
+//RestoreSnapshot loads a snapshot that was written by WriteSnapshot into a tenant without any
+//devices or device models. The controlled properties are shared by all tenants, so they are only
+//restored into the default tenant, and must already exist, as they are in the snapshot, when the
+//snapshot is restored into any other tenant.
+func RestoreSnapshot(log logging.Logger, db database.Datastore, input io.Reader, options ImportOptions) (ImportReport, error) {
+	report := ImportReport{DryRun: options.DryRun, Rows: []ImportRow{}}
+
+	err := checkTenantName(options.Tenant)
+	if err != nil {
+		return report, err
+	}
+
+	tenantDB := db.WithTenant(options.Tenant)
+	deviceCount, err := tenantDB.GetDeviceCount(database.DeviceFilter{})
+	if err != nil {
+		return report, err
+	}
+
+	deviceModelCount, err := tenantDB.GetDeviceModelCount(database.DeviceModelFilter{})
+	if err != nil {
+		return report, err
+	}
+
+	if deviceCount > 0 || deviceModelCount > 0 {
+		return report, fmt.Errorf(
+			"a snapshot can only be restored into an empty registry, but the tenant has %d devices and %d device models",
+			deviceCount, deviceModelCount,
+		)
+	}
+
+	rows, err := readSnapshotRows(input, options.Format)
+	if err != nil {
+		return report, err
+	}
+
+	if options.Tenant != "" {
+		for idx := range rows {
+			rows[idx].shared = rows[idx].entity.Type == ControlledPropertyTypeName
+		}
+	}
+
+	return importRows(log, db, rows, options)
+}
+
+//checkCatalogProperty reports a controlled property that is already in the catalog as unchanged,
+//or fails if it is missing or values of it would be stored differently than in the snapshot
+func (cs *contextSource) checkCatalogProperty(entity batchEntity) (string, error) {
+	restored := &DeviceControlledProperty{}
+	err := decodeBody(entity.decodeBodyInto, restored)
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.TrimPrefix(entity.ID, ControlledPropertyIDPrefix)
+
+	existing, err := cs.db.GetControlledPropertyFromName(name)
+	if errors.Is(err, database.ErrNotFound) {
+		return "", fmt.Errorf("%s is shared by all tenants and is not restored, so it must be created first", entity.ID)
+	} else if err != nil {
+		return "", err
+	}
+
+	for _, attribute := range []struct {
+		name, restored, existing string
+	}{
+		{"unitCode", textValueOrEmpty(restored.UnitCode), existing.UnitCode},
+		{"valueType", textValueOrEmpty(restored.ValueType), existing.ValueType},
+	} {
+		if attribute.restored != attribute.existing {
+			return "", fmt.Errorf(
+				"the %s of %s is \"%s\" in the snapshot, but \"%s\" in the shared catalog",
+				attribute.name, entity.ID, attribute.restored, attribute.existing,
+			)
+		}
+	}
+
+	return ImportStatusUnchanged, nil
+}
+
+func readSnapshotRows(input io.Reader, format string) ([]importRow, error) {
+	rawEntities := []json.RawMessage{}
+
+	switch format {
+	case SnapshotFormatJSONLD:
+		err := json.NewDecoder(input).Decode(&rawEntities)
+		if err != nil {
+			return nil, errors.New("a JSON-LD snapshot must be an array of entities")
+		}
+	case SnapshotFormatNDJSON:
+		decoder := json.NewDecoder(input)
+		for {
+			raw := json.RawMessage{}
+			err := decoder.Decode(&raw)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("entity %d of the snapshot is not valid JSON: %s", len(rawEntities)+1, err.Error())
+			}
+			rawEntities = append(rawEntities, raw)
+		}
+	default:
+		return nil, fmt.Errorf("snapshot format %s is not supported", format)
+	}
+
+	rows := []importRow{}
+	for idx, raw := range rawEntities {
+		attributes := map[string]interface{}{}
+		err := json.Unmarshal(raw, &attributes)
+		if err != nil {
+			rows = append(rows, importRow{row: idx + 1, err: errors.New("the entity is not a JSON object")})
+			continue
+		}
+
+		if isTemporalEntity(attributes) {
+			rows = append(rows, newValueHistoryRow(idx+1, attributes))
+		} else {
+			rows = append(rows, newImportRow(idx+1, attributes))
+		}
+	}
+
+	return rows, nil
+}
+
+//isTemporalEntity tells the value history of a device from the device itself, as every attribute
+//of an entity in the temporal representation is an array of instances
+func isTemporalEntity(attributes map[string]interface{}) bool {
+	if attributes["type"] != "Device" {
+		return false
+	}
+
+	instances := 0
+	for name, attribute := range attributes {
+		if name == "id" || name == "type" || name == "@context" {
+			continue
+		}
+
+		if _, ok := attribute.([]interface{}); !ok {
+			return false
+		}
+		instances++
+	}
+
+	return instances > 0
+}
+
+func newValueHistoryRow(row int, attributes map[string]interface{}) importRow {
+	result := importRow{row: row, values: []database.RestoredValue{}}
+	result.entity.ID, _ = attributes["id"].(string)
+	result.entity.Type = "Device"
+
+	// The values are restored in the same order every time
+	names := []string{}
+	for name := range attributes {
+		if name != "id" && name != "type" && name != "@context" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		instances, _ := attributes[name].([]interface{})
+		for _, instance := range instances {
+			property, _ := instance.(map[string]interface{})
+			observedAt, _ := property["observedAt"].(string)
+
+			value := database.RestoredValue{ControlledProperty: name}
+
+			switch v := property["value"].(type) {
+			case string:
+				value.Value = v
+			case float64:
+				value.Value = strconv.FormatFloat(v, 'f', -1, 64)
+			case bool:
+				value.Value = strconv.FormatBool(v)
+			default:
+				result.err = fmt.Errorf("the %s values must be strings, numbers or booleans", name)
+				return result
+			}
+
+			var err error
+			value.ObservedAt, err = time.Parse(time.RFC3339, observedAt)
+			if err != nil {
+				result.err = fmt.Errorf("observedAt must be an RFC3339 timestamp, not \"%s\"", observedAt)
+				return result
+			}
+
+			result.values = append(result.values, value)
+		}
+	}
+
+	return result
+}
+
+//restoreValues adds the value history of a device in a nested transaction of its own
+func (cs *contextSource) restoreValues(entityID string, values []database.RestoredValue) (string, error) {
+	if !strings.HasPrefix(entityID, fiware.DeviceIDPrefix) {
+		return "", database.NewError(database.ErrInvalidInput, "device id %s must start with \"%s\"", entityID, fiware.DeviceIDPrefix)
+	}
+
+	err := cs.withTransaction(func(tx *contextSource) error {
+		return tx.db.RestoreDeviceValues(entityID[len(fiware.DeviceIDPrefix):], values)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return ImportStatusCreated, nil
+}
+
+func newSnapshotHandler(cs *contextSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		options := SnapshotOptions{Format: SnapshotFormatJSONLD}
+		contentType := "application/ld+json"
+
+		if format := r.URL.Query().Get("format"); format == SnapshotFormatNDJSON {
+			options.Format = format
+			contentType = "application/x-ndjson"
+		} else if format != "" && format != SnapshotFormatJSONLD {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData,
+				fmt.Sprintf("format must be one of jsonld or ndjson, not \"%s\"", format))
+			return
+		}
+
+		if values := r.URL.Query().Get("values"); values != "" {
+			var err error
+			options.IncludeValues, err = strconv.ParseBool(values)
+			if err != nil {
+				reportProblem(w, http.StatusBadRequest, problemBadRequestData,
+					fmt.Sprintf("values must be true or false, not \"%s\"", values))
+				return
+			}
+		}
+
+		w.Header().Add("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+
+		// The status has already been sent once the snapshot is streaming, so all we can do
+		// about a failure is to log it and leave the snapshot incomplete
+		err := cs.writeSnapshot(w, options)
+		if err != nil {
+			cs.log.Errorf("Failed to write snapshot: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package application
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/database"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/models"
+)
+
+//TemporalEntity is the NGSI-LD temporal representation of an entity, where every attribute
+//holds an array with the instances of that attribute over time
+type TemporalEntity map[string]interface{}
+
+//TemporalPropertyInstance is a single instance of a property at a point in time
+type TemporalPropertyInstance struct {
+	Type       string      `json:"type"`
+	Value      interface{} `json:"value"`
+	ObservedAt string      `json:"observedAt"`
+	UnitCode   string      `json:"unitCode,omitempty"`
+}
+
+func newRetrieveTemporalEntityHandler(cs *contextSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entityID := chi.URLParam(r, "entity")
+
+		query, err := newValueHistoryQuery(r)
+		if err != nil {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData, err.Error())
+			return
+		}
+
+		entity, err := cs.RetrieveTemporalEntity(entityID, query)
+		if err != nil {
+			cs.log.Errorf("Failed to retrieve temporal entity %s: %s", entityID, err.Error())
+			reportError(w, err)
+			return
+		}
+
+		writeEntityResponse(w, entity)
+	}
+}
+
+func newQueryTemporalEntitiesHandler(cs *contextSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entityType := r.URL.Query().Get("type")
+		if entityType != "" && entityType != "Device" {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData,
+				fmt.Sprintf("temporal queries are not supported for entities of type %s", entityType))
+			return
+		}
+
+		query, err := newValueHistoryQuery(r)
+		if err != nil {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData, err.Error())
+			return
+		}
+
+		page, err := newPagination(r)
+		if err != nil {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData, err.Error())
+			return
+		}
+
+		if page.Limit == 0 || page.Limit > maxPageSize {
+			reportProblem(w, http.StatusForbidden, problemTooManyResults,
+				fmt.Sprintf("the limit must be between 1 and %d", maxPageSize))
+			return
+		}
+
+		entityIDs := []string{}
+		if ids := r.URL.Query().Get("id"); ids != "" {
+			entityIDs = strings.Split(ids, ",")
+		} else if entityType == "" && len(query.ControlledProperties) == 0 {
+			reportProblem(w, http.StatusBadRequest, problemBadRequestData,
+				"temporal queries require at least one of the parameters id, type or attrs")
+			return
+		}
+
+		entities := []TemporalEntity{}
+		err = cs.QueryTemporalEntities(entityIDs, query, page, func(entity TemporalEntity) error {
+			entities = append(entities, entity)
+			return nil
+		})
+
+		if err != nil {
+			cs.log.Errorf("Failed to query temporal entities: %s", err.Error())
+			reportError(w, err)
+			return
+		}
+
+		writeEntityResponse(w, entities)
+	}
+}
+
+//newValueHistoryQuery translates the NGSI-LD temporal query parameters into a ValueHistoryQuery
+func newValueHistoryQuery(r *http.Request) (database.ValueHistoryQuery, error) {
+	query := database.ValueHistoryQuery{}
+	params := r.URL.Query()
+
+	if attrs := params.Get("attrs"); attrs != "" {
+		query.ControlledProperties = strings.Split(attrs, ",")
+	}
+
+	if lastN := params.Get("lastN"); lastN != "" {
+		n, err := strconv.ParseUint(lastN, 10, 64)
+		if err != nil || n == 0 {
+			return query, fmt.Errorf("lastN must be a positive integer, not \"%s\"", lastN)
+		}
+		query.LastN = n
+	}
+
+	timeRel := params.Get("timerel")
+	if timeRel == "" {
+		return query, nil
+	}
+
+	timeAt, err := parseTemporalParameter(params.Get("timeAt"), "timeAt")
+	if err != nil {
+		return query, err
+	}
+
+	switch timeRel {
+	case "before":
+		query.To = timeAt
+	case "after":
+		query.From = timeAt
+	case "between":
+		endTimeAt, err := parseTemporalParameter(params.Get("endTimeAt"), "endTimeAt")
+		if err != nil {
+			return query, err
+		}
+
+		if !endTimeAt.After(timeAt) {
+			return query, errors.New("endTimeAt must be later than timeAt")
+		}
+
+		query.From = timeAt
+		query.To = endTimeAt
+	default:
+		return query, fmt.Errorf("timerel must be one of before, after or between, not \"%s\"", timeRel)
+	}
+
+	return query, nil
+}
+
+func parseTemporalParameter(value, name string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("the parameter %s is required by timerel", name)
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC3339 timestamp, not \"%s\"", name, value)
+	}
+
+	return t, nil
+}
+
+//RetrieveTemporalEntity returns the value history of a Device in the NGSI-LD temporal representation
+func (cs *contextSource) RetrieveTemporalEntity(entityID string, query database.ValueHistoryQuery) (TemporalEntity, error) {
+	if !strings.HasPrefix(entityID, fiware.DeviceIDPrefix) {
+		return nil, database.NewError(database.ErrInvalidInput, "temporal representation is only supported for Device entities, not %s", entityID)
+	}
+
+	deviceID := entityID[len(fiware.DeviceIDPrefix):]
+	values, err := cs.db.GetDeviceValueHistory(deviceID, query)
+	if err != nil {
+		return nil, err
+	}
+
+	controlledProperties, err := cs.db.GetControlledProperties()
+	if err != nil {
+		return nil, err
+	}
+
+	return newTemporalDeviceEntity(deviceID, values, controlledProperties), nil
+}
+
+//QueryTemporalEntities calls the callback with the temporal representation of a page of the
+//Devices in entityIDs, or of all Devices if entityIDs is empty. Devices without any values that
+//match the query are left out.
+func (cs *contextSource) QueryTemporalEntities(entityIDs []string, query database.ValueHistoryQuery, page database.Pagination, callback func(TemporalEntity) error) error {
+	deviceIDs := []string{}
+	for _, entityID := range entityIDs {
+		if !strings.HasPrefix(entityID, fiware.DeviceIDPrefix) {
+			return database.NewError(database.ErrInvalidInput, "temporal representation is only supported for Device entities, not %s", entityID)
+		}
+		deviceIDs = append(deviceIDs, entityID[len(fiware.DeviceIDPrefix):])
+	}
+
+	histories, err := cs.db.GetDeviceValueHistories(deviceIDs, query, page)
+	if err != nil {
+		return fmt.Errorf("unable to get the value history of Device entities: %w", err)
+	}
+
+	controlledProperties, err := cs.db.GetControlledProperties()
+	if err != nil {
+		return err
+	}
+
+	for _, history := range histories {
+		err = callback(newTemporalDeviceEntity(history.DeviceID, history.Values, controlledProperties))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newTemporalDeviceEntity(deviceID string, values []models.DeviceValue, controlledProperties []models.DeviceControlledProperty) TemporalEntity {
+	propertiesByID := map[uint]*models.DeviceControlledProperty{}
+	for idx, p := range controlledProperties {
+		propertiesByID[p.ID] = &controlledProperties[idx]
+	}
+
+	entity := TemporalEntity{
+		"id":       fiware.DeviceIDPrefix + deviceID,
+		"type":     "Device",
+		"@context": entityContext,
+	}
+
+	for _, value := range values {
+		property, ok := propertiesByID[value.DeviceControlledPropertyID]
+		if !ok {
+			continue
+		}
+
+		instances, _ := entity[property.Name].([]TemporalPropertyInstance)
+		entity[property.Name] = append(instances, TemporalPropertyInstance{
+			Type:       "Property",
+			Value:      typedValue(value),
+			ObservedAt: value.ObservedAt.UTC().Format(time.RFC3339Nano),
+			UnitCode:   property.UnitCode,
+		})
+	}
+
+	return entity
+}
+
+func typedValue(value models.DeviceValue) interface{} {
+	if value.NumberValue != nil {
+		return *value.NumberValue
+	} else if value.BoolValue != nil {
+		return *value.BoolValue
+	}
+	return value.Value
+}
+
+func writeEntityResponse(w http.ResponseWriter, entity interface{}) {
+	bytes, err := json.Marshal(entity)
+	if err != nil {
+		reportProblem(w, http.StatusInternalServerError, problemInternalError, err.Error())
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/ld+json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
@@ -0,0 +1,56 @@
+package application
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+//tenantHeader is the NGSI-LD header that selects the tenant a request is made on behalf of.
+//Requests without the header are served by the default tenant.
+const tenantHeader string = "NGSILD-Tenant"
+
+var validTenantName = regexp.MustCompile(`^[a-zA-Z0-9_\-]{1,64}$`)
+
+//contextSourceHandler creates a handler that serves requests using the given context source
+type contextSourceHandler func(cs *contextSource) http.HandlerFunc
+
+//forRequest returns a handler that serves each request with a context source that is scoped to
+//the tenant in the NGSILD-Tenant header, so that one tenant never sees the entities of another.
+//The context source also knows where the request came from, so that changes can be audited.
+func forRequest(cs *contextSource, newHandler contextSourceHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant := r.Header.Get(tenantHeader)
+
+		if tenant != "" {
+			if err := checkTenantName(tenant); err != nil {
+				reportProblem(w, http.StatusBadRequest, problemBadRequestData, err.Error())
+				return
+			}
+
+			w.Header().Set(tenantHeader, tenant)
+		}
+
+		tenantSource := cs.withTenant(tenant)
+		tenantSource.origin = newRequestOrigin(r, cs.proxies)
+
+		newHandler(tenantSource)(w, r)
+	}
+}
+
+//checkTenantName returns an error if the name can not be used for a tenant. An empty name selects
+//the default tenant.
+func checkTenantName(tenant string) error {
+	if tenant != "" && !validTenantName.MatchString(tenant) {
+		return fmt.Errorf("the tenant name \"%s\" must be at most 64 letters, digits, dashes or underscores", tenant)
+	}
+	return nil
+}
+
+//withTenant returns a copy of the context source that only sees the entities of the tenant
+func (cs *contextSource) withTenant(tenant string) *contextSource {
+	return &contextSource{
+		db: cs.db.WithTenant(tenant), log: cs.log, messenger: cs.messenger, proxies: cs.proxies, origin: cs.origin,
+		onCommit: cs.onCommit,
+	}
+}
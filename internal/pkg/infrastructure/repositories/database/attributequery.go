@@ -0,0 +1,223 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+	"gorm.io/gorm"
+)
+
+//Logical operators that combine the operands of an AttributeQuery
+const (
+	QueryOperatorAnd string = "and"
+	QueryOperatorOr  string = "or"
+)
+
+//AttributeQuery is a tree of comparisons between entity attributes and values, as expressed
+//with the NGSI-LD query language. A node is either a logical operator with operands, or a
+//comparison (==, !=, <, <=, > or >=) of an attribute against its values. An equality with
+//several values matches any of them, and a single Range value matches an inclusive range.
+type AttributeQuery struct {
+	Operator  string
+	Operands  []AttributeQuery
+	Attribute string
+	Values    []string
+	Range     *[2]string
+}
+
+//attributeColumn describes how an attribute is stored in the database
+type attributeColumn struct {
+	// column is the SQL expression for the attribute, or a subquery selecting the primary
+	// keys of the entities that match a value if isSubquery is true
+	column     string
+	isSubquery bool
+	isTime     bool
+	isNumber   bool
+	idPrefix   string
+}
+
+//deviceAttributes are the attributes that devices can be queried on. Battery levels and RSSIs
+//that can not be determined are stored as -1, and match no comparison.
+var deviceAttributes = map[string]attributeColumn{
+	"id":                    {column: "device_id", idPrefix: fiware.DeviceIDPrefix},
+	"dateLastValueReported": {column: "date_last_value_reported", isTime: true},
+	"name":                  {column: "name"},
+	"description":           {column: "description"},
+	"serialNumber":          {column: "serial_number"},
+	"firmwareVersion":       {column: "firmware_version"},
+	"batteryLevel":          {column: "NULLIF(battery_level, -1)", isNumber: true},
+	"rssi":                  {column: "NULLIF(rssi, -1)", isNumber: true},
+	"deviceState":           {column: "device_state"},
+	"dateInstalled":         {column: "date_installed", isTime: true},
+	"dateFirstUsed":         {column: "date_first_used", isTime: true},
+	"refDeviceModel": {
+		column:     "device_model_id IN (SELECT id FROM device_models WHERE device_model_id %s)",
+		isSubquery: true,
+		idPrefix:   fiware.DeviceModelIDPrefix,
+	},
+}
+
+var deviceModelAttributes = map[string]attributeColumn{
+	"id":               {column: "device_model_id", idPrefix: fiware.DeviceModelIDPrefix},
+	"brandName":        {column: "brand_name"},
+	"category":         {column: "category"},
+	"manufacturerName": {column: "manufacturer_name"},
+	"modelName":        {column: "model_name"},
+	"name":             {column: "name"},
+	"controlledProperty": {
+		column: `id IN (SELECT j.device_model_id FROM devicemodel_ctrlprops j
+			JOIN device_controlled_properties p ON p.id = j.device_controlled_property_id
+			WHERE p.name %s)`,
+		isSubquery: true,
+	},
+}
+
+var queryComparisonOperators = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+//QueriesDevices reports if every attribute in the query is an attribute of devices
+func (q *AttributeQuery) QueriesDevices() bool {
+	return q.onlyQueries(deviceAttributes)
+}
+
+//QueriesDeviceModels reports if every attribute in the query is an attribute of device models
+func (q *AttributeQuery) QueriesDeviceModels() bool {
+	return q.onlyQueries(deviceModelAttributes)
+}
+
+func (q *AttributeQuery) onlyQueries(attributes map[string]attributeColumn) bool {
+	if q.Attribute != "" {
+		_, ok := attributes[q.Attribute]
+		return ok
+	}
+
+	for idx := range q.Operands {
+		if !q.Operands[idx].onlyQueries(attributes) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//attributeFilter is a gorm scope that applies the attribute query to a query on a table with
+//the given attributes. The query must have been translated successfully beforehand.
+func attributeFilter(q *AttributeQuery, attributes map[string]attributeColumn) func(tx *gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		if q == nil {
+			return tx
+		}
+
+		sql, args, _ := translateAttributeQuery(q, attributes)
+		return tx.Where(sql, args...)
+	}
+}
+
+//translateAttributeQuery translates the query into an SQL condition with bound parameters
+func translateAttributeQuery(q *AttributeQuery, attributes map[string]attributeColumn) (string, []interface{}, error) {
+	if q.Operator == QueryOperatorAnd || q.Operator == QueryOperatorOr {
+		if len(q.Operands) == 0 {
+			return "", nil, NewError(ErrInvalidInput, "the %s operator requires at least one operand", q.Operator)
+		}
+
+		conditions := []string{}
+		args := []interface{}{}
+
+		for idx := range q.Operands {
+			condition, operandArgs, err := translateAttributeQuery(&q.Operands[idx], attributes)
+			if err != nil {
+				return "", nil, err
+			}
+
+			conditions = append(conditions, "("+condition+")")
+			args = append(args, operandArgs...)
+		}
+
+		return strings.Join(conditions, " "+strings.ToUpper(q.Operator)+" "), args, nil
+	}
+
+	attribute, ok := attributes[q.Attribute]
+	if !ok {
+		return "", nil, NewError(ErrInvalidInput, "querying on the attribute %s is not supported", q.Attribute)
+	}
+
+	if !queryComparisonOperators[q.Operator] {
+		return "", nil, NewError(ErrInvalidInput, "query operator %s is not supported", q.Operator)
+	}
+
+	values := q.Values
+	if q.Range != nil {
+		values = q.Range[:]
+	}
+
+	if len(values) == 0 {
+		return "", nil, NewError(ErrInvalidInput, "the attribute %s must be compared to a value", q.Attribute)
+	}
+
+	args := []interface{}{}
+	for _, value := range values {
+		arg, err := attribute.newArgument(q.Attribute, value)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, arg)
+	}
+
+	var comparison string
+
+	if q.Range != nil {
+		if q.Operator != "==" && q.Operator != "!=" {
+			return "", nil, NewError(ErrInvalidInput, "a range can only be compared with == or !=")
+		}
+
+		comparison = "BETWEEN ? AND ?"
+		if q.Operator == "!=" {
+			comparison = "NOT " + comparison
+		}
+	} else if len(args) > 1 {
+		if q.Operator != "==" && q.Operator != "!=" {
+			return "", nil, NewError(ErrInvalidInput, "a list of values can only be compared with == or !=")
+		}
+
+		comparison = "IN ?"
+		if q.Operator == "!=" {
+			comparison = "NOT IN ?"
+		}
+		args = []interface{}{args}
+	} else {
+		operator := q.Operator
+		if operator == "==" {
+			operator = "="
+		} else if operator == "!=" {
+			operator = "<>"
+		}
+		comparison = operator + " ?"
+	}
+
+	if attribute.isSubquery {
+		return strings.Replace(attribute.column, "%s", comparison, 1), args, nil
+	}
+
+	return attribute.column + " " + comparison, args, nil
+}
+
+func (attribute attributeColumn) newArgument(name, value string) (interface{}, error) {
+	if attribute.isTime {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, NewError(ErrInvalidInput, "%s must be compared to an RFC3339 timestamp, not \"%s\"", name, value)
+		}
+		return t.UTC(), nil
+	}
+
+	if attribute.isNumber {
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, NewError(ErrInvalidInput, "%s must be compared to a number, not \"%s\"", name, value)
+		}
+		return number, nil
+	}
+
+	return strings.TrimPrefix(value, attribute.idPrefix), nil
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"time"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/models"
+)
+
+//AuditQuery selects the audit entries returned by GetAuditEntries. Zero values mean that the
+//corresponding limit is not applied.
+type AuditQuery struct {
+	EntityID string
+	From     time.Time // Inclusive
+	To       time.Time // Exclusive
+}
+
+//AppendAuditEntry adds an entry to the audit log of the tenant. The timestamp is set to the
+//current time unless the entry already has one.
+func (db *myDB) AppendAuditEntry(entry models.AuditEntry) error {
+	if entry.EntityID == "" || entry.Operation == "" {
+		return NewError(ErrInvalidInput, "an audit entry must have an entity id and an operation")
+	}
+
+	entry.ID = 0
+	entry.Tenant = db.tenant
+
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	entry.Timestamp = entry.Timestamp.UTC()
+
+	return db.impl.Create(&entry).Error
+}
+
+//GetAuditEntries returns the audit entries of the tenant that match the query, oldest first
+func (db *myDB) GetAuditEntries(query AuditQuery, page Pagination) ([]models.AuditEntry, error) {
+	if !query.From.IsZero() && !query.To.IsZero() && !query.From.Before(query.To) {
+		return nil, NewError(ErrInvalidInput, "the start of the time range must be before its end")
+	}
+
+	tx := db.impl.Scopes(db.inTenant)
+
+	if query.EntityID != "" {
+		tx = tx.Where("entity_id = ?", query.EntityID)
+	}
+
+	if !query.From.IsZero() {
+		tx = tx.Where("timestamp >= ?", query.From.UTC())
+	}
+
+	if !query.To.IsZero() {
+		tx = tx.Where("timestamp < ?", query.To.UTC())
+	}
+
+	entries := []models.AuditEntry{}
+	result := tx.Order("timestamp, id").Scopes(paginate(page)).Find(&entries)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return entries, nil
+}
+
+//DeleteAuditEntriesBefore deletes the audit entries of all tenants that are older than the
+//cutoff, and returns the number of deleted entries
+func (db *myDB) DeleteAuditEntriesBefore(cutoff time.Time) (int64, error) {
+	result := db.impl.Where("timestamp < ?", cutoff.UTC()).Delete(&models.AuditEntry{})
+	return result.RowsAffected, result.Error
+}
@@ -2,10 +2,13 @@ package database
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -16,19 +19,211 @@ import (
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 )
 
 //Datastore is an interface that is used to inject the database into different handlers to improve testability
 type Datastore interface {
+	AppendAuditEntry(entry models.AuditEntry) error
+	ApplyRetentionPolicies(now time.Time) ([]RetentionReport, error)
+	CreateControlledProperty(property *models.DeviceControlledProperty) (*models.DeviceControlledProperty, error)
 	CreateDevice(device *fiware.Device) (*models.Device, error)
 	CreateDeviceModel(deviceModel *fiware.DeviceModel) (*models.DeviceModel, error)
+	DeleteAuditEntriesBefore(cutoff time.Time) (int64, error)
+	DeleteDevice(id string) error
+	DeleteDeviceModel(id string) error
+	GetAuditEntries(query AuditQuery, page Pagination) ([]models.AuditEntry, error)
+	GetControlledProperties() ([]models.DeviceControlledProperty, error)
+	GetControlledPropertyFromName(name string) (*models.DeviceControlledProperty, error)
 	GetDeviceFromID(id string) (*models.Device, error)
-	GetDevices() ([]models.Device, error)
-	GetDeviceModels() ([]models.DeviceModel, error)
+	GetDeviceValueHistory(deviceID string, query ValueHistoryQuery) ([]models.DeviceValue, error)
+	GetDeviceValueHistories(deviceIDs []string, query ValueHistoryQuery, page Pagination) ([]DeviceValueHistory, error)
+	GetDevices(filter DeviceFilter, page Pagination) ([]models.Device, error)
+	GetDeviceCount(filter DeviceFilter) (int64, error)
+	GetDeviceModels(filter DeviceModelFilter, page Pagination) ([]models.DeviceModel, error)
+	GetDeviceModelCount(filter DeviceModelFilter) (int64, error)
 	GetDeviceModelFromID(id string) (*models.DeviceModel, error)
 	GetDeviceModelFromPrimaryKey(id uint) (*models.DeviceModel, error)
-	UpdateDeviceValue(deviceID, value string) error
+	ReadTransaction(fn func(tx Datastore) error) error
+	SetDeviceModelDeadband(deviceModelID string, deadband models.Deadband) error
+	Transaction(fn func(tx Datastore) error) error
+	UpdateControlledProperty(name string, update ControlledPropertyUpdate) (*models.DeviceControlledProperty, error)
+	UpdateDevice(deviceID string, update DeviceUpdate) (*models.Device, error)
+	UpdateDeviceModel(deviceModelID string, update DeviceModelUpdate) (*models.DeviceModel, error)
+	UpdateDeviceValue(deviceID, value string, observedAt time.Time) ([]LatestValue, error)
+	RestoreDeviceValues(deviceID string, values []RestoredValue) error
+	WithTenant(tenant string) Datastore
+}
+
+//ValueHistoryQuery limits the device values returned by GetDeviceValueHistory. Zero values
+//mean that the corresponding limit is not applied.
+type ValueHistoryQuery struct {
+	ControlledProperties []string
+	From                 time.Time // Inclusive
+	To                   time.Time // Exclusive
+	LastN                uint64    // Only return the last N values per controlled property
+}
+
+//RestoredValue is a value of a controlled property, by name, as it was observed by a device
+type RestoredValue struct {
+	ControlledProperty string
+	Value              string
+	ObservedAt         time.Time
+}
+
+//LatestValue is a value that UpdateDeviceValue stored as the latest value of a controlled
+//property, by name, of a device
+type LatestValue struct {
+	ControlledProperty string
+	Value              models.DeviceValue
+}
+
+//DeviceFilter selects the devices returned by GetDevices. A zero filter matches all devices.
+type DeviceFilter struct {
+	Geo   *GeoQuery
+	Query *AttributeQuery
+}
+
+func (filter DeviceFilter) validate() error {
+	if filter.Geo != nil {
+		err := filter.Geo.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if filter.Query != nil {
+		_, _, err := translateAttributeQuery(filter.Query, deviceAttributes)
+		return err
+	}
+
+	return nil
+}
+
+func (filter DeviceFilter) apply(tx *gorm.DB) *gorm.DB {
+	return tx.Scopes(geoFilter(filter.Geo), attributeFilter(filter.Query, deviceAttributes))
+}
+
+//DeviceModelFilter selects the device models returned by GetDeviceModels. A zero filter
+//matches all device models.
+type DeviceModelFilter struct {
+	Query *AttributeQuery
+}
+
+func (filter DeviceModelFilter) validate() error {
+	if filter.Query != nil {
+		_, _, err := translateAttributeQuery(filter.Query, deviceModelAttributes)
+		return err
+	}
+
+	return nil
+}
+
+func (filter DeviceModelFilter) apply(tx *gorm.DB) *gorm.DB {
+	return tx.Scopes(attributeFilter(filter.Query, deviceModelAttributes))
+}
+
+//Pagination selects a page of the results from GetDevices, GetDeviceModels, GetAuditEntries and
+//GetDeviceValueHistories. A Limit of zero means that all results from the Offset and onwards are returned.
+type Pagination struct {
+	Limit  uint64
+	Offset uint64
+}
+
+//paginate is a gorm scope that applies the pagination to a query
+func paginate(page Pagination) func(tx *gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		if page.Limit > 0 {
+			tx = tx.Limit(int(page.Limit))
+		}
+
+		if page.Offset > 0 {
+			if page.Limit == 0 {
+				// SQLite does not allow an OFFSET without a LIMIT
+				tx = tx.Limit(math.MaxInt32)
+			}
+			tx = tx.Offset(int(page.Offset))
+		}
+
+		return tx
+	}
+}
+
+//ControlledPropertyUpdate holds the attributes of a controlled property that should be changed.
+//Attributes that are nil are left unchanged, unless Replace is set.
+type ControlledPropertyUpdate struct {
+	Abbreviation           *string
+	UnitCode               *string
+	ValueType              *string
+	AllowedValues          []string
+	RawValueRetentionDays  *uint
+	AggregateRetentionDays *uint
+	Deadband               *DeadbandUpdate
+	// Replace clears the optional attributes that are nil, so that the update replaces the
+	// controlled property. The required abbreviation and value type are always kept.
+	Replace bool
+}
+
+//DeviceUpdate holds the attributes of a device that should be changed. Attributes that are
+//nil are left unchanged, unless Replace is set.
+type DeviceUpdate struct {
+	Location        *[2]float64 // Longitude and latitude
+	RefDeviceModel  *string
+	Name            *string
+	Description     *string
+	SerialNumber    *string
+	FirmwareVersion *string
+	BatteryLevel    *float64
+	RSSI            *float64
+	DeviceState     *string
+	Owner           []string
+	DateInstalled   *time.Time
+	DateFirstUsed   *time.Time
+	// Replace clears the optional attributes that are nil, so that the update replaces the
+	// device. The required device model is always kept.
+	Replace bool
+}
+
+//DeviceModelUpdate holds the attributes of a device model that should be changed. Attributes
+//that are nil are left unchanged, unless Replace is set, and ControlledProperties replaces the
+//whole list.
+type DeviceModelUpdate struct {
+	BrandName            *string
+	Category             *string
+	ModelName            *string
+	ManufacturerName     *string
+	Name                 *string
+	ControlledProperties []string
+	Deadband             *DeadbandUpdate
+	// Replace clears the optional attributes that are nil, so that the update replaces the
+	// device model. The required category and controlled properties are always kept.
+	Replace bool
+}
+
+//DeadbandUpdate holds the parts of a deadband that should be changed. Parts that are nil are
+//left unchanged.
+type DeadbandUpdate struct {
+	Absolute          *float64
+	Relative          *float64
+	MaxSilenceSeconds *uint
+}
+
+//ApplyTo returns the deadband with the changes of the update applied to it
+func (update DeadbandUpdate) ApplyTo(deadband models.Deadband) models.Deadband {
+	if update.Absolute != nil {
+		deadband.DeadbandAbsolute = *update.Absolute
+	}
+
+	if update.Relative != nil {
+		deadband.DeadbandRelative = *update.Relative
+	}
+
+	if update.MaxSilenceSeconds != nil {
+		deadband.MaxSilenceSeconds = *update.MaxSilenceSeconds
+	}
+
+	return deadband
 }
 
 var dbCtxKey = &databaseContextKey{"database"}
@@ -61,9 +256,14 @@ func GetFromContext(ctx context.Context) (Datastore, error) {
 }
 
 type myDB struct {
-	impl *gorm.DB
+	impl         *gorm.DB
+	maxClockSkew time.Duration
+	tenant       string
+}
 
-	controlledProperties []models.DeviceControlledProperty
+//inTenant is a gorm scope that limits a query on devices or device models to the tenant of the Datastore
+func (db *myDB) inTenant(tx *gorm.DB) *gorm.DB {
+	return tx.Where("tenant = ?", db.tenant)
 }
 
 func getEnv(key, fallback string) string {
@@ -109,6 +309,14 @@ func NewSQLiteConnector() ConnectorFunc {
 
 		if err == nil {
 			db.Exec("PRAGMA foreign_keys = ON")
+
+			// Every new connection to an in-memory database gets a database of its own,
+			// so we need to make sure that all queries share the same connection.
+			sqlDB, err := db.DB()
+			if err != nil {
+				return nil, err
+			}
+			sqlDB.SetMaxOpenConns(1)
 		}
 
 		return db, err
@@ -122,44 +330,19 @@ func NewDatabaseConnection(connect ConnectorFunc, log logging.Logger) (Datastore
 		return nil, err
 	}
 
-	db := &myDB{
-		impl: impl,
+	maxClockSkew, err := time.ParseDuration(getEnv("DEVICE_VALUE_MAX_CLOCK_SKEW", "5m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEVICE_VALUE_MAX_CLOCK_SKEW: %s", err.Error())
 	}
 
-	db.impl.AutoMigrate(&models.DeviceControlledProperty{})
-	db.impl.AutoMigrate(&models.DeviceModel{})
-	db.impl.AutoMigrate(&models.DeviceValue{})
-	db.impl.AutoMigrate(&models.Device{})
-
-	db.impl.Model(&models.DeviceModel{}).Association("DeviceControlledProperty")
-	db.impl.Model(&models.Device{}).Association("DeviceModel")
-
-	// Make sure that the controlled properties table is properly seeded
-	props := map[string]string{
-		"state":        "",
-		"fillingLevel": "l",
-		"snowDepth":    "snow",
-		"temperature":  "t",
+	db := &myDB{
+		impl:         impl,
+		maxClockSkew: maxClockSkew,
 	}
 
-	for property, abbreviation := range props {
-		controlledProperty := models.DeviceControlledProperty{}
-
-		result := db.impl.Where("name = ?", property).First(&controlledProperty)
-		if result.RowsAffected == 0 {
-			log.Infof("ControlledProperty %s not found in database. Creating ...", property)
-
-			controlledProperty.Name = property
-			controlledProperty.Abbreviation = abbreviation
-			result = db.impl.Create(&controlledProperty)
-
-			if result.Error != nil {
-				log.Fatalf("Failed to seed DeviceControlledProperty into database %s", result.Error.Error())
-				return nil, result.Error
-			}
-		}
-
-		db.controlledProperties = append(db.controlledProperties, controlledProperty)
+	err = migrate(db.impl, log)
+	if err != nil {
+		return nil, err
 	}
 
 	/*badtemp := models.DeviceModel{DeviceModelID: "urn:ngsi-ld:DeviceModel:badtemperatur", Category: "sensor"}
@@ -189,19 +372,80 @@ func NewDatabaseConnection(connect ConnectorFunc, log logging.Logger) (Datastore
 	return db, nil
 }
 
+func (db *myDB) CreateControlledProperty(property *models.DeviceControlledProperty) (*models.DeviceControlledProperty, error) {
+	err := db.checkCatalogIsWritable()
+	if err != nil {
+		return nil, err
+	}
+
+	if property.Name == "" {
+		return nil, NewError(ErrInvalidInput, "creating a controlled property is not allowed without a name")
+	}
+
+	if property.ValueType == "" {
+		property.ValueType = models.ValueTypeText
+	}
+
+	err = validateValueType(property.ValueType, property.GetAllowedValues())
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateDeadband(property.Deadband)
+	if err != nil {
+		return nil, err
+	}
+
+	var count int64
+	result := db.impl.Model(&models.DeviceControlledProperty{}).Where("name = ?", property.Name).Count(&count)
+	if result.Error != nil {
+		return nil, result.Error
+	} else if count > 0 {
+		return nil, NewError(ErrAlreadyExists, "controlled property %s already exists", property.Name)
+	}
+
+	err = db.checkAbbreviationIsAvailable(property.Abbreviation, property.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	controlledProperty := &models.DeviceControlledProperty{
+		Name:                   property.Name,
+		Abbreviation:           property.Abbreviation,
+		UnitCode:               property.UnitCode,
+		ValueType:              property.ValueType,
+		AllowedValues:          property.AllowedValues,
+		RawValueRetentionDays:  property.RawValueRetentionDays,
+		AggregateRetentionDays: property.AggregateRetentionDays,
+		Deadband:               property.Deadband,
+	}
+
+	result = db.impl.Create(controlledProperty)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return controlledProperty, nil
+}
+
 func (db *myDB) CreateDevice(src *fiware.Device) (*models.Device, error) {
 
 	// TODO: Separate fiware.Device from the repository layer so that we do not
 	// have to deal with ID strings like this
 	if !strings.HasPrefix(src.ID, fiware.DeviceIDPrefix) {
-		return nil, fmt.Errorf("device id %s must start with \"%s\"", src.ID, fiware.DeviceIDPrefix)
+		return nil, NewError(ErrInvalidInput, "device id %s must start with \"%s\"", src.ID, fiware.DeviceIDPrefix)
 	}
 
 	// Truncate the leading fiware prefix from the device id string
 	shortDeviceID := src.ID[len(fiware.DeviceIDPrefix):]
 
 	if src.RefDeviceModel == nil {
-		return nil, fmt.Errorf("CreateDevice requires non-empty device model")
+		return nil, NewError(ErrInvalidInput, "CreateDevice requires non-empty device model")
+	}
+
+	err := db.checkDoesNotExist(&models.Device{}, "device_id = ?", shortDeviceID)
+	if err != nil {
+		return nil, err
 	}
 
 	deviceModel, err := db.getDeviceModelFromString(src.RefDeviceModel.Object)
@@ -210,14 +454,20 @@ func (db *myDB) CreateDevice(src *fiware.Device) (*models.Device, error) {
 	}
 
 	device := &models.Device{
+		Tenant:      db.tenant,
 		DeviceID:    shortDeviceID,
 		DeviceModel: *deviceModel,
 	}
 
 	if src.Location != nil {
 		pt := src.Location.Value.GetAsPoint()
-		device.Longitude = pt.Coordinates[0]
-		device.Latitude = pt.Coordinates[1]
+		position := [2]float64{pt.Coordinates[0], pt.Coordinates[1]}
+		if !isValidPosition(position) {
+			return nil, NewError(ErrInvalidInput, "location %v is not a valid [longitude, latitude] position", position)
+		}
+
+		device.Longitude = position[0]
+		device.Latitude = position[1]
 	}
 
 	result := db.impl.Create(device)
@@ -233,26 +483,32 @@ func (db *myDB) CreateDeviceModel(src *fiware.DeviceModel) (*models.DeviceModel,
 	// TODO: Separate fiware.DeviceModel from the repository layer so that we do not
 	// have to deal with ID strings like this
 	if !strings.HasPrefix(src.ID, fiware.DeviceModelIDPrefix) {
-		return nil, fmt.Errorf("device id %s must start with \"%s\"", src.ID, fiware.DeviceModelIDPrefix)
+		return nil, NewError(ErrInvalidInput, "device model id %s must start with \"%s\"", src.ID, fiware.DeviceModelIDPrefix)
 	}
 
 	// Truncate the leading fiware prefix from the device model id string
 	shortDeviceID := src.ID[len(fiware.DeviceModelIDPrefix):]
 
 	if src.ControlledProperty == nil {
-		return nil, fmt.Errorf("creating device model is not allowed without controlled properties")
+		return nil, NewError(ErrInvalidInput, "creating device model is not allowed without controlled properties")
 	}
 
-	controlledProperties, err := db.getControlledProperties(src.ControlledProperty.Value)
+	if src.Category == nil || len(src.Category.Value) == 0 {
+		return nil, NewError(ErrInvalidInput, "creating device model is not allowed without a specified category")
+	}
+
+	err := db.checkDoesNotExist(&models.DeviceModel{}, "device_model_id = ?", shortDeviceID)
 	if err != nil {
-		return nil, fmt.Errorf("controlled property is not supported: %s", err.Error())
+		return nil, err
 	}
 
-	if src.Category == nil {
-		return nil, fmt.Errorf("creating device model is not allowed without a specified category")
+	controlledProperties, err := db.getControlledProperties(src.ControlledProperty.Value)
+	if err != nil {
+		return nil, fmt.Errorf("controlled property is not supported: %w", err)
 	}
 
 	deviceModel := &models.DeviceModel{
+		Tenant:               db.tenant,
 		DeviceModelID:        shortDeviceID,
 		Category:             src.Category.Value[0],
 		ControlledProperties: controlledProperties,
@@ -282,81 +538,263 @@ func (db *myDB) CreateDeviceModel(src *fiware.DeviceModel) (*models.DeviceModel,
 	return deviceModel, nil
 }
 
-func (db *myDB) GetDeviceFromID(id string) (*models.Device, error) {
-	device := &models.Device{DeviceID: id}
-	result := db.impl.Where(device).First(device)
+func (db *myDB) DeleteDevice(id string) error {
+	return db.impl.Transaction(func(tx *gorm.DB) error {
+		device := &models.Device{}
+		result := tx.Scopes(db.inTenant).Where("device_id = ?", id).First(device)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("unable to delete device %s: %w", id, ErrNotFound)
+		} else if result.Error != nil {
+			return result.Error
+		}
+
+		// The value history has no meaning without its device, so it is removed as well
+		result = tx.Unscoped().Where("device_id = ?", device.ID).Delete(&models.DeviceValue{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		result = tx.Unscoped().Where("device_id = ?", device.ID).Delete(&models.DeviceValueAggregate{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		return tx.Unscoped().Delete(device).Error
+	})
+}
+
+func (db *myDB) DeleteDeviceModel(id string) error {
+	return db.impl.Transaction(func(tx *gorm.DB) error {
+		deviceModel := &models.DeviceModel{}
+		result := tx.Scopes(db.inTenant).Where("device_model_id = ?", id).First(deviceModel)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("unable to delete device model %s: %w", id, ErrNotFound)
+		} else if result.Error != nil {
+			return result.Error
+		}
+
+		var deviceCount int64
+		result = tx.Model(&models.Device{}).Where("device_model_id = ?", deviceModel.ID).Count(&deviceCount)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if deviceCount > 0 {
+			return fmt.Errorf(
+				"unable to delete device model %s that is referenced by %d device(s): %w",
+				id, deviceCount, ErrDeviceModelInUse,
+			)
+		}
+
+		err := tx.Model(deviceModel).Association("ControlledProperties").Clear()
+		if err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Delete(deviceModel).Error
+	})
+}
+
+func (db *myDB) GetControlledProperties() ([]models.DeviceControlledProperty, error) {
+	controlledProperties := []models.DeviceControlledProperty{}
+	result := db.impl.Order("name").Find(&controlledProperties)
 	if result.Error != nil {
 		return nil, result.Error
 	}
+	return controlledProperties, nil
+}
 
-	deviceValue := &models.DeviceValue{DeviceID: device.ID}
-	deviceValues := []models.DeviceValue{}
-
-	// TODO: DISTINCT ON is PostgreSQL specific and fails on SQLite. Find a compatible solution.
-	result = db.impl.Select("DISTINCT ON (device_controlled_property_id) device_controlled_property_id, value").Where(deviceValue).Order("device_controlled_property_id, observed_at desc").Find(&deviceValues)
+func (db *myDB) GetControlledPropertyFromName(name string) (*models.DeviceControlledProperty, error) {
+	controlledProperty := &models.DeviceControlledProperty{}
+	result := db.impl.Where("name = ?", name).First(controlledProperty)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("controlled property %s: %w", name, ErrNotFound)
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	return controlledProperty, nil
+}
 
-	if result.Error != nil {
+func (db *myDB) GetDeviceFromID(id string) (*models.Device, error) {
+	device := &models.Device{}
+	result := db.impl.Scopes(db.inTenant).Where("device_id = ?", id).First(device)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("device %s: %w", id, ErrNotFound)
+	} else if result.Error != nil {
 		return nil, result.Error
 	}
 
-	if result.RowsAffected > 0 {
-		values := []string{}
+	devices := []models.Device{*device}
+	err := db.setLatestDeviceValues(devices)
+	if err != nil {
+		return nil, err
+	}
+
+	return &devices[0], nil
+}
+
+//setLatestDeviceValues sets the Value of each device to its latest values as "abbr=value" pairs
+//separated by semicolons, using a constant number of queries regardless of the number of devices
+func (db *myDB) setLatestDeviceValues(devices []models.Device) error {
+	deviceKeys := make([]uint, 0, len(devices))
+	for _, device := range devices {
+		deviceKeys = append(deviceKeys, device.ID)
+	}
+
+	deviceValues, err := db.getLatestDeviceValues(deviceKeys)
+	if err != nil {
+		return err
+	}
+
+	if len(deviceValues) > 0 {
+		controlledProperties, err := db.GetControlledProperties()
+		if err != nil {
+			return err
+		}
+
+		abbreviations := map[uint]string{}
+		for _, controlledProperty := range controlledProperties {
+			abbreviations[controlledProperty.ID] = controlledProperty.Abbreviation
+		}
+
+		valuesPerDevice := map[uint][]string{}
 
 		for _, value := range deviceValues {
-			for _, controlledProperty := range db.controlledProperties {
-				if controlledProperty.ID == value.DeviceControlledPropertyID {
-					if len(controlledProperty.Abbreviation) > 0 {
-						values = append(values, fmt.Sprintf("%s=%s", controlledProperty.Abbreviation, value.Value))
-					} else {
-						values = append(values, value.Value)
-					}
-				}
+			abbreviation, ok := abbreviations[value.DeviceControlledPropertyID]
+			if !ok {
+				continue
+			}
+
+			if len(abbreviation) > 0 {
+				valuesPerDevice[value.DeviceID] = append(
+					valuesPerDevice[value.DeviceID], fmt.Sprintf("%s=%s", abbreviation, value.Value),
+				)
+			} else {
+				valuesPerDevice[value.DeviceID] = append(valuesPerDevice[value.DeviceID], value.Value)
 			}
 		}
 
-		device.Value = strings.Join(values, ";")
+		for idx := range devices {
+			if values, ok := valuesPerDevice[devices[idx].ID]; ok {
+				sort.Strings(values)
+				devices[idx].Value = strings.Join(values, ";")
+			}
+		}
 	}
 
-	// TODO: Remove this temporary quick fix after the erroneous seed data is fixed
-	if device.Longitude > device.Latitude {
-		swap := device.Latitude
-		device.Latitude = device.Longitude
-		device.Longitude = swap
+	return nil
+}
+
+//latestDeviceValuesQuery selects the most recent value per controlled property for a set of
+//devices using a correlated subquery, as DISTINCT ON is only available in PostgreSQL
+const latestDeviceValuesQuery string = `
+	SELECT dv.device_id, dv.device_controlled_property_id, dv.value, dv.number_value, dv.bool_value, dv.observed_at
+	FROM device_values dv
+	WHERE dv.device_id IN ? AND dv.deleted_at IS NULL AND dv.observed_at = (
+		SELECT MAX(latest.observed_at)
+		FROM device_values latest
+		WHERE latest.device_id = dv.device_id
+			AND latest.device_controlled_property_id = dv.device_controlled_property_id
+			AND latest.deleted_at IS NULL
+	)
+	ORDER BY dv.device_id, dv.device_controlled_property_id, dv.id DESC`
+
+//maxDeviceKeysPerQuery limits the number of bound parameters in a single IN clause, as
+//some databases have a rather low limit on the number of parameters in a statement
+const maxDeviceKeysPerQuery int = 500
+
+func (db *myDB) getLatestDeviceValues(deviceKeys []uint) ([]models.DeviceValue, error) {
+	latestValues := []models.DeviceValue{}
+
+	for first := 0; first < len(deviceKeys); first += maxDeviceKeysPerQuery {
+		last := first + maxDeviceKeysPerQuery
+		if last > len(deviceKeys) {
+			last = len(deviceKeys)
+		}
+
+		deviceValues := []models.DeviceValue{}
+
+		result := db.impl.Raw(latestDeviceValuesQuery, deviceKeys[first:last]).Scan(&deviceValues)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+
+		// Several values for the same property may share the same timestamp. Keep only
+		// the first one (the last inserted) for each property and device.
+		for _, value := range deviceValues {
+			count := len(latestValues)
+			if count == 0 || latestValues[count-1].DeviceID != value.DeviceID ||
+				latestValues[count-1].DeviceControlledPropertyID != value.DeviceControlledPropertyID {
+				latestValues = append(latestValues, value)
+			}
+		}
 	}
 
-	return device, nil
+	return latestValues, nil
 }
 
-func (db *myDB) GetDevices() ([]models.Device, error) {
+func (db *myDB) GetDevices(filter DeviceFilter, page Pagination) ([]models.Device, error) {
+	err := filter.validate()
+	if err != nil {
+		return nil, err
+	}
+
 	devices := []models.Device{}
-	result := db.impl.Order("device_id").Find(&devices)
+	result := db.impl.Preload("DeviceModel").Scopes(db.inTenant, filter.apply).Order("device_id").Scopes(paginate(page)).Find(&devices)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 
-	for idx, d := range devices {
-		d, err := db.GetDeviceFromID(d.DeviceID)
-		if err == nil {
-			devices[idx] = *d
-		}
+	err = db.setLatestDeviceValues(devices)
+	if err != nil {
+		return nil, err
 	}
 
 	return devices, nil
 }
 
-func (db *myDB) GetDeviceModels() ([]models.DeviceModel, error) {
+func (db *myDB) GetDeviceCount(filter DeviceFilter) (int64, error) {
+	err := filter.validate()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	result := db.impl.Model(&models.Device{}).Scopes(db.inTenant, filter.apply).Count(&count)
+	return count, result.Error
+}
+
+func (db *myDB) GetDeviceModels(filter DeviceModelFilter, page Pagination) ([]models.DeviceModel, error) {
+	err := filter.validate()
+	if err != nil {
+		return nil, err
+	}
+
 	deviceModels := []models.DeviceModel{}
-	result := db.impl.Order("device_model_id").Find(&deviceModels)
+	result := db.impl.Preload("ControlledProperties").Scopes(db.inTenant, filter.apply).Order("device_model_id").Scopes(paginate(page)).Find(&deviceModels)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 	return deviceModels, nil
 }
 
+func (db *myDB) GetDeviceModelCount(filter DeviceModelFilter) (int64, error) {
+	err := filter.validate()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	result := db.impl.Model(&models.DeviceModel{}).Scopes(db.inTenant, filter.apply).Count(&count)
+	return count, result.Error
+}
+
 func (db *myDB) GetDeviceModelFromID(id string) (*models.DeviceModel, error) {
-	deviceModel := &models.DeviceModel{DeviceModelID: id}
-	result := db.impl.Where(deviceModel).First(deviceModel)
-	if result.Error != nil {
+	deviceModel := &models.DeviceModel{}
+	result := db.impl.Preload("ControlledProperties").Scopes(db.inTenant).Where("device_model_id = ?", id).First(deviceModel)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("device model %s: %w", id, ErrNotFound)
+	} else if result.Error != nil {
 		return nil, result.Error
 	}
 	return deviceModel, nil
@@ -364,46 +802,433 @@ func (db *myDB) GetDeviceModelFromID(id string) (*models.DeviceModel, error) {
 
 func (db *myDB) GetDeviceModelFromPrimaryKey(id uint) (*models.DeviceModel, error) {
 	deviceModel := &models.DeviceModel{}
-	result := db.impl.Find(deviceModel, id)
+	result := db.impl.Preload("ControlledProperties").Scopes(db.inTenant).First(deviceModel, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("device model with key %d: %w", id, ErrNotFound)
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return deviceModel, nil
+}
+
+func (db *myDB) SetDeviceModelDeadband(deviceModelID string, deadband models.Deadband) error {
+	err := validateDeadband(deadband)
+	if err != nil {
+		return err
+	}
+
+	result := db.impl.Model(&models.DeviceModel{}).Scopes(db.inTenant).Where("device_model_id = ?", deviceModelID).Updates(
+		map[string]interface{}{
+			"deadband_absolute":   deadband.DeadbandAbsolute,
+			"deadband_relative":   deadband.DeadbandRelative,
+			"max_silence_seconds": deadband.MaxSilenceSeconds,
+		},
+	)
+
 	if result.Error != nil {
+		return result.Error
+	} else if result.RowsAffected == 0 {
+		return fmt.Errorf("device model %s: %w", deviceModelID, ErrNotFound)
+	}
+
+	return nil
+}
+
+//Transaction calls fn with a Datastore that runs all its operations in a single database
+//transaction, which is committed if fn returns nil and rolled back otherwise. Transactions
+//can be nested, in which case the inner transaction is a savepoint in the outer one.
+func (db *myDB) Transaction(fn func(tx Datastore) error) error {
+	return db.impl.Transaction(func(tx *gorm.DB) error {
+		return fn(&myDB{impl: tx, maxClockSkew: db.maxClockSkew, tenant: db.tenant})
+	})
+}
+
+//ReadTransaction is like Transaction, but the transaction is read only and sees the database as
+//it was when the transaction started, so that several queries give a consistent view of it
+func (db *myDB) ReadTransaction(fn func(tx Datastore) error) error {
+	return db.impl.Transaction(func(tx *gorm.DB) error {
+		return fn(&myDB{impl: tx, maxClockSkew: db.maxClockSkew, tenant: db.tenant})
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+}
+
+func (db *myDB) UpdateControlledProperty(name string, update ControlledPropertyUpdate) (*models.DeviceControlledProperty, error) {
+	err := db.checkCatalogIsWritable()
+	if err != nil {
+		return nil, err
+	}
+
+	controlledProperty, err := db.GetControlledPropertyFromName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if update.Abbreviation != nil && *update.Abbreviation != controlledProperty.Abbreviation {
+		err = db.checkAbbreviationIsAvailable(*update.Abbreviation, name)
+		if err != nil {
+			return nil, err
+		}
+		controlledProperty.Abbreviation = *update.Abbreviation
+	}
+
+	if update.Replace {
+		controlledProperty.UnitCode = ""
+		controlledProperty.SetAllowedValues([]string{})
+		controlledProperty.RawValueRetentionDays = 0
+		controlledProperty.AggregateRetentionDays = 0
+		controlledProperty.Deadband = models.Deadband{}
+	}
+
+	if update.UnitCode != nil {
+		controlledProperty.UnitCode = *update.UnitCode
+	}
+
+	if update.ValueType != nil {
+		controlledProperty.ValueType = *update.ValueType
+	}
+
+	if update.AllowedValues != nil {
+		controlledProperty.SetAllowedValues(update.AllowedValues)
+	}
+
+	if update.RawValueRetentionDays != nil {
+		controlledProperty.RawValueRetentionDays = *update.RawValueRetentionDays
+	}
+
+	if update.AggregateRetentionDays != nil {
+		controlledProperty.AggregateRetentionDays = *update.AggregateRetentionDays
+	}
+
+	if update.Deadband != nil {
+		deadband := update.Deadband.ApplyTo(controlledProperty.Deadband)
+		err = validateDeadband(deadband)
+		if err != nil {
+			return nil, err
+		}
+		controlledProperty.Deadband = deadband
+	}
+
+	err = validateValueType(controlledProperty.ValueType, controlledProperty.GetAllowedValues())
+	if err != nil {
+		return nil, err
+	}
+
+	result := db.impl.Save(controlledProperty)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return controlledProperty, nil
+}
+
+//UpdateDevice changes the attributes of a device that are set in the update
+func (db *myDB) UpdateDevice(deviceID string, update DeviceUpdate) (*models.Device, error) {
+	device := &models.Device{}
+	result := db.impl.Scopes(db.inTenant).Where("device_id = ?", deviceID).First(device)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("device %s: %w", deviceID, ErrNotFound)
+	} else if result.Error != nil {
 		return nil, result.Error
 	}
 
+	changes := map[string]interface{}{}
+
+	if update.Replace {
+		// Devices without a location are stored at 0,0
+		for _, column := range []string{"name", "description", "serial_number", "firmware_version", "device_state", "owner"} {
+			changes[column] = ""
+		}
+
+		for _, column := range []string{"longitude", "latitude"} {
+			changes[column] = 0.0
+		}
+
+		for _, column := range []string{"battery_level", "rssi", "date_installed", "date_first_used"} {
+			changes[column] = nil
+		}
+	}
+
+	if update.Location != nil {
+		if !isValidPosition(*update.Location) {
+			return nil, NewError(ErrInvalidInput, "location %v is not a valid [longitude, latitude] position", *update.Location)
+		}
+
+		changes["longitude"] = update.Location[0]
+		changes["latitude"] = update.Location[1]
+	}
+
+	if update.RefDeviceModel != nil {
+		deviceModel, err := db.getDeviceModelFromString(*update.RefDeviceModel)
+		if err != nil {
+			return nil, err
+		}
+		changes["device_model_id"] = deviceModel.ID
+	}
+
+	for column, value := range map[string]*string{
+		"name":             update.Name,
+		"description":      update.Description,
+		"serial_number":    update.SerialNumber,
+		"firmware_version": update.FirmwareVersion,
+		"device_state":     update.DeviceState,
+	} {
+		if value != nil {
+			changes[column] = *value
+		}
+	}
+
+	for column, value := range map[string]*float64{"battery_level": update.BatteryLevel, "rssi": update.RSSI} {
+		if value != nil {
+			// FIWARE uses -1 for a level that can not be determined
+			if (*value < 0 && *value != models.UndeterminedLevel) || *value > 1 {
+				return nil, NewError(ErrInvalidInput, "%s must be between 0 and 1, or -1 if unknown, not %v", column, *value)
+			}
+			changes[column] = *value
+		}
+	}
+
+	if update.Owner != nil {
+		owners := &models.Device{}
+		owners.SetOwners(update.Owner)
+		changes["owner"] = owners.Owner
+	}
+
+	for column, value := range map[string]*time.Time{
+		"date_installed":  update.DateInstalled,
+		"date_first_used": update.DateFirstUsed,
+	} {
+		if value != nil {
+			changes[column] = value.UTC()
+		}
+	}
+
+	if len(changes) > 0 {
+		result = db.impl.Model(device).Updates(changes)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+	}
+
+	return db.GetDeviceFromID(deviceID)
+}
+
+//UpdateDeviceModel changes the attributes of a device model. Controlled properties can only be
+//removed from a device model if none of its devices have reported values for them.
+func (db *myDB) UpdateDeviceModel(deviceModelID string, update DeviceModelUpdate) (*models.DeviceModel, error) {
+	deviceModel := &models.DeviceModel{}
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		result := tx.Preload("ControlledProperties").Scopes(db.inTenant).Where("device_model_id = ?", deviceModelID).First(deviceModel)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("device model %s: %w", deviceModelID, ErrNotFound)
+		} else if result.Error != nil {
+			return result.Error
+		}
+
+		changes := map[string]interface{}{}
+
+		if update.Replace {
+			for _, column := range []string{"brand_name", "model_name", "manufacturer_name", "name"} {
+				changes[column] = ""
+			}
+
+			if update.Deadband == nil {
+				update.Deadband = &DeadbandUpdate{}
+			}
+			deviceModel.Deadband = models.Deadband{}
+		}
+
+		for column, value := range map[string]*string{
+			"brand_name":        update.BrandName,
+			"category":          update.Category,
+			"model_name":        update.ModelName,
+			"manufacturer_name": update.ManufacturerName,
+			"name":              update.Name,
+		} {
+			if value != nil {
+				changes[column] = *value
+			}
+		}
+
+		if update.Deadband != nil {
+			deadband := update.Deadband.ApplyTo(deviceModel.Deadband)
+			err := validateDeadband(deadband)
+			if err != nil {
+				return err
+			}
+
+			changes["deadband_absolute"] = deadband.DeadbandAbsolute
+			changes["deadband_relative"] = deadband.DeadbandRelative
+			changes["max_silence_seconds"] = deadband.MaxSilenceSeconds
+		}
+
+		if len(changes) > 0 {
+			result = tx.Model(deviceModel).Updates(changes)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		if update.ControlledProperties != nil {
+			txDB := &myDB{impl: tx, maxClockSkew: db.maxClockSkew, tenant: db.tenant}
+			return txDB.replaceControlledProperties(deviceModel, update.ControlledProperties)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
 	return deviceModel, nil
 }
 
-func (db *myDB) UpdateDeviceValue(deviceID, value string) error {
+func (db *myDB) replaceControlledProperties(deviceModel *models.DeviceModel, names []string) error {
+	if len(names) == 0 {
+		return NewError(ErrInvalidInput, "device model %s must have at least one controlled property", deviceModel.DeviceModelID)
+	}
+
+	controlledProperties, err := db.getControlledProperties(names)
+	if err != nil {
+		return fmt.Errorf("controlled property is not supported: %w", err)
+	}
+
+	keep := map[uint]bool{}
+	for _, p := range controlledProperties {
+		keep[p.ID] = true
+	}
+
+	removedKeys := []uint{}
+	for _, p := range deviceModel.ControlledProperties {
+		if !keep[p.ID] {
+			removedKeys = append(removedKeys, p.ID)
+		}
+	}
+
+	if len(removedKeys) > 0 {
+		// The values that devices have reported for a property would become unreachable if the
+		// property was removed from their device model, so we refuse to remove such properties
+		inUse := []string{}
+		result := db.impl.Model(&models.DeviceControlledProperty{}).
+			Where("id IN ?", removedKeys).
+			Where(`id IN (SELECT v.device_controlled_property_id FROM device_values v
+				JOIN devices d ON d.id = v.device_id WHERE d.device_model_id = ?
+				UNION SELECT a.device_controlled_property_id FROM device_value_aggregates a
+				JOIN devices d ON d.id = a.device_id WHERE d.device_model_id = ?)`, deviceModel.ID, deviceModel.ID).
+			Order("name").
+			Pluck("name", &inUse)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if len(inUse) > 0 {
+			return NewError(
+				ErrDeviceModelInUse,
+				"unable to remove controlled properties %v from device model %s, that its devices have reported values for",
+				inUse, deviceModel.DeviceModelID,
+			)
+		}
+	}
+
+	err = db.impl.Model(deviceModel).Association("ControlledProperties").Replace(controlledProperties)
+	if err != nil {
+		return err
+	}
+
+	deviceModel.ControlledProperties = controlledProperties
+	return nil
+}
+
+//UpdateDeviceValue stores the semicolon separated values reported by a device. The values are
+//observed at observedAt, or now if it is zero, unless a value has a timestamp of its own
+//appended to it as in "t=12@2021-05-10T14:30:00Z". The values that became the latest values of
+//their controlled properties are returned, which excludes the values that were inside of their
+//deadband or arrived out of order.
+func (db *myDB) UpdateDeviceValue(deviceID, value string, observedAt time.Time) ([]LatestValue, error) {
+	var latest []LatestValue
+
+	// Everything is read within the transaction, with the device row locked, so that concurrent
+	// updates of the same device compare their values against each other's and not against
+	// the same stale latest values
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		var err error
+		latest, err = db.updateDeviceValue(tx, deviceID, value, observedAt)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return latest, nil
+}
+
+func (db *myDB) updateDeviceValue(tx *gorm.DB, deviceID, value string, observedAt time.Time) ([]LatestValue, error) {
+	txdb := &myDB{impl: tx, maxClockSkew: db.maxClockSkew, tenant: db.tenant}
+
 	// Make sure that we have a corresponding device ...
 	device := &models.Device{}
-	result := db.impl.Where("device_id = ?", deviceID).First(device)
-	if result.Error != nil {
-		return result.Error
-	} else if result.RowsAffected != 1 {
-		//TODO: We need error groups and introduce a NOT FOUND error here
-		return errors.New("attempt to update non existing device")
+	result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Scopes(db.inTenant).Where("device_id = ?", deviceID).First(device)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("attempt to update non existing device %s: %w", deviceID, ErrNotFound)
+	} else if result.Error != nil {
+		return nil, result.Error
 	}
 
 	// Get the corresponding device model
 	deviceModel := &models.DeviceModel{}
-	result = db.impl.Preload("ControlledProperties").Find(deviceModel, device.DeviceModelID)
+	result = tx.Preload("ControlledProperties").Find(deviceModel, device.DeviceModelID)
 	if result.Error != nil {
-		return result.Error
+		return nil, result.Error
 	} else if result.RowsAffected != 1 {
-		return fmt.Errorf("failed to find corresponding device model for device %s", deviceID)
+		return nil, fmt.Errorf("failed to find corresponding device model for device %s", deviceID)
+	}
+
+	// Build a lookup table for controlled property abbrevations to controlled properties
+	ctrlPropMap := map[string]*models.DeviceControlledProperty{}
+	ctrlPropByKey := map[uint]*models.DeviceControlledProperty{}
+	for idx, prop := range deviceModel.ControlledProperties {
+		ctrlPropMap[prop.Abbreviation] = &deviceModel.ControlledProperties[idx]
+		ctrlPropByKey[prop.ID] = &deviceModel.ControlledProperties[idx]
 	}
 
-	// Build a lookup table for controlled property abbrevations to db primary keys
-	ctrlPropMap := map[string]uint{}
-	for _, prop := range deviceModel.ControlledProperties {
-		ctrlPropMap[prop.Abbreviation] = prop.ID
+	latestValues, err := txdb.getLatestDeviceValues([]uint{device.ID})
+	if err != nil {
+		return nil, err
 	}
 
-	// TODO: Check that all values are supported before starting to add them
-	// TODO: Support a delta to not store too small changes
+	latestValueMap := map[uint]*models.DeviceValue{}
+	for idx, v := range latestValues {
+		latestValueMap[v.DeviceControlledPropertyID] = &latestValues[idx]
+	}
 
 	timeNow := time.Now().UTC()
+	if observedAt.IsZero() {
+		observedAt = timeNow
+	}
+
+	// The device has reported in at the time of its most recent value
+	lastValueReported := time.Time{}
+
+	// Validate and parse all the values before anything is written, so that a single bad
+	// value rejects the whole update and we can report every problem at once
+	deviceValues := []*models.DeviceValue{}
+	problems := []string{}
+	problemKind := ErrInvalidInput
 
 	for _, v := range strings.Split(value, ";") {
+		v, valueObservedAt := splitObservedAt(v, observedAt)
+		if valueObservedAt.After(timeNow.Add(db.maxClockSkew)) {
+			problems = append(problems, fmt.Sprintf(
+				"value %s is observed at %s, which is too far in the future", v, valueObservedAt.Format(time.RFC3339),
+			))
+			continue
+		}
+
+		if valueObservedAt.After(lastValueReported) {
+			lastValueReported = valueObservedAt
+		}
+
 		kv := strings.Split(v, "=")
 		if len(kv) != 2 {
 			// If the value can not be split around an equal sign
@@ -412,32 +1237,193 @@ func (db *myDB) UpdateDeviceValue(deviceID, value string) error {
 				// link the value to the "state" property
 				kv = []string{"", v}
 			} else {
-				return fmt.Errorf("unable to store value %s. Failed to split value in two", v)
+				problems = append(problems, fmt.Sprintf("failed to split value %s in two", v))
+				continue
 			}
 		}
 
-		if ctrlPropMap[kv[0]] == 0 {
-			return fmt.Errorf("device %s does not support this controlled property: %s", deviceID, kv[0])
+		controlledProperty, ok := ctrlPropMap[kv[0]]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unsupported controlled property %s", kv[0]))
+			problemKind = ErrUnsupportedProperty
+			continue
+		}
+
+		deviceValue, err := newDeviceValue(controlledProperty, kv[1])
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+
+		deviceValue.DeviceID = device.ID
+		deviceValue.ObservedAt = valueObservedAt
+
+		latestValue := latestValueMap[controlledProperty.ID]
+		if latestValue != nil && deviceValue.ObservedAt.Before(latestValue.ObservedAt) {
+			// Values that arrive out of order are stored in the history as they are, but they
+			// must not replace the latest value or be compared against it
+			deviceValues = append(deviceValues, deviceValue)
+			continue
+		}
+
+		deadband := controlledProperty.Deadband.OverriddenBy(deviceModel.Deadband)
+		if isInsideDeadband(deadband, latestValue, deviceValue) {
+			// The value is too close to the last stored value, so we only record that the
+			// device has reported in (see below)
+			continue
+		}
+
+		latestValueMap[controlledProperty.ID] = deviceValue
+		deviceValues = append(deviceValues, deviceValue)
+	}
+
+	if len(problems) > 0 {
+		return nil, NewError(problemKind, "unable to store values for device %s: %s", deviceID, strings.Join(problems, ", "))
+	}
+
+	for _, deviceValue := range deviceValues {
+		result := tx.Create(deviceValue)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+	}
+
+	// Buffered values that are forwarded late must not move the last reported date backwards
+	result = tx.Model(&models.Device{}).Where(
+		"id = ? AND (date_last_value_reported IS NULL OR date_last_value_reported < ?)",
+		device.ID, lastValueReported,
+	).Update("date_last_value_reported", lastValueReported)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	latest := []LatestValue{}
+	for _, deviceValue := range deviceValues {
+		controlledProperty := ctrlPropByKey[deviceValue.DeviceControlledPropertyID]
+		if latestValueMap[controlledProperty.ID] == deviceValue {
+			latest = append(latest, LatestValue{ControlledProperty: controlledProperty.Name, Value: *deviceValue})
+		}
+	}
+
+	return latest, nil
+}
+
+//RestoreDeviceValues adds values from a snapshot to the history of a device. The values are
+//stored as they are, without applying any deadbands, as they have already passed them once.
+func (db *myDB) RestoreDeviceValues(deviceID string, values []RestoredValue) error {
+	device := &models.Device{}
+	result := db.impl.Scopes(db.inTenant).Where("device_id = ?", deviceID).First(device)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("device %s: %w", deviceID, ErrNotFound)
+	} else if result.Error != nil {
+		return result.Error
+	}
+
+	deviceModel := &models.DeviceModel{}
+	result = db.impl.Preload("ControlledProperties").Find(deviceModel, device.DeviceModelID)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	ctrlPropMap := map[string]*models.DeviceControlledProperty{}
+	for idx, prop := range deviceModel.ControlledProperties {
+		ctrlPropMap[prop.Name] = &deviceModel.ControlledProperties[idx]
+	}
+
+	lastValueReported := time.Time{}
+	deviceValues := []*models.DeviceValue{}
+
+	for _, value := range values {
+		controlledProperty, ok := ctrlPropMap[value.ControlledProperty]
+		if !ok {
+			return NewError(ErrUnsupportedProperty, "device %s does not support %s", deviceID, value.ControlledProperty)
+		}
+
+		if value.ObservedAt.IsZero() {
+			return NewError(ErrInvalidInput, "the %s value \"%s\" has no observation time", value.ControlledProperty, value.Value)
 		}
 
-		deviceValue := &models.DeviceValue{
-			DeviceID:                   device.ID,
-			DeviceControlledPropertyID: ctrlPropMap[kv[0]],
-			Value:                      kv[1],
-			ObservedAt:                 timeNow,
+		deviceValue, err := newDeviceValue(controlledProperty, value.Value)
+		if err != nil {
+			return err
 		}
 
-		result = db.impl.Create(deviceValue)
+		deviceValue.DeviceID = device.ID
+		deviceValue.ObservedAt = value.ObservedAt.UTC()
+		deviceValues = append(deviceValues, deviceValue)
+
+		if deviceValue.ObservedAt.After(lastValueReported) {
+			lastValueReported = deviceValue.ObservedAt
+		}
+	}
+
+	if len(deviceValues) == 0 {
+		return nil
+	}
+
+	return db.impl.Transaction(func(tx *gorm.DB) error {
+		result := tx.CreateInBatches(deviceValues, 500)
 		if result.Error != nil {
 			return result.Error
 		}
+
+		result = tx.Model(&models.Device{}).Where(
+			"id = ? AND (date_last_value_reported IS NULL OR date_last_value_reported < ?)",
+			device.ID, lastValueReported,
+		).Update("date_last_value_reported", lastValueReported)
+		return result.Error
+	})
+}
+
+//WithTenant returns a Datastore that only sees and creates the devices and device models of the
+//given tenant. Controlled properties are shared by all tenants, and can only be changed by the
+//default tenant.
+func (db *myDB) WithTenant(tenant string) Datastore {
+	return &myDB{impl: db.impl, maxClockSkew: db.maxClockSkew, tenant: tenant}
+}
+
+//checkCatalogIsWritable returns an ErrForbidden error unless the Datastore belongs to the default
+//tenant, as a change to a controlled property affects the devices of every tenant
+func (db *myDB) checkCatalogIsWritable() error {
+	if db.tenant != "" {
+		return NewError(
+			ErrForbidden, "controlled properties are shared by all tenants and can not be changed by tenant %s", db.tenant,
+		)
 	}
+	return nil
+}
 
-	db.impl.Model(&models.Device{}).Where("id = ?", device.ID).Update("date_last_value_reported", timeNow)
+//checkAbbreviationIsAvailable makes sure that an abbreviation can be used by the named property,
+//as the abbreviations are used to tell the values in a device update apart
+func (db *myDB) checkAbbreviationIsAvailable(abbreviation, name string) error {
+	var count int64
+	result := db.impl.Model(&models.DeviceControlledProperty{}).Where(
+		"abbreviation = ? AND name <> ?", abbreviation, name,
+	).Count(&count)
+
+	if result.Error != nil {
+		return result.Error
+	} else if count > 0 {
+		return NewError(ErrAlreadyExists, "abbreviation \"%s\" is already used by another controlled property", abbreviation)
+	}
 
 	return nil
 }
 
+//splitObservedAt splits an optional "@timestamp" suffix from a value, and returns the value
+//without the suffix together with the timestamp, or the fallback if there is no valid suffix
+func splitObservedAt(value string, fallback time.Time) (string, time.Time) {
+	idx := strings.LastIndex(value, "@")
+	if idx >= 0 {
+		observedAt, err := time.Parse(time.RFC3339, value[idx+1:])
+		if err == nil {
+			return value[:idx], observedAt.UTC()
+		}
+	}
+
+	return value, fallback
+}
+
 func isStateValue(value string) bool {
 	return (strings.Compare(value, "on") == 0 || strings.Compare(value, "off") == 0)
 }
@@ -445,22 +1431,43 @@ func isStateValue(value string) bool {
 func (db *myDB) getControlledProperties(properties []string) ([]models.DeviceControlledProperty, error) {
 	found := []models.DeviceControlledProperty{}
 
-	for _, p := range properties {
-		for _, controlledProperty := range db.controlledProperties {
-			if controlledProperty.Name == p {
-				found = append(found, controlledProperty)
-				break
-			}
-		}
+	result := db.impl.Where("name IN ?", properties).Find(&found)
+	if result.Error != nil {
+		return nil, result.Error
 	}
 
 	if len(found) != len(properties) {
-		return nil, fmt.Errorf("unable to find all controlled properties %v", properties)
+		missing := []string{}
+		for _, name := range properties {
+			isFound := false
+			for _, p := range found {
+				isFound = isFound || p.Name == name
+			}
+			if !isFound {
+				missing = append(missing, name)
+			}
+		}
+
+		return nil, NewError(ErrUnsupportedProperty, "unable to find all controlled properties %v", missing)
 	}
 
 	return found, nil
 }
 
+//checkDoesNotExist returns an ErrAlreadyExists error if any rows of the model within the tenant
+//match the query
+func (db *myDB) checkDoesNotExist(model interface{}, query string, id string) error {
+	var count int64
+	result := db.impl.Model(model).Scopes(db.inTenant).Where(query, id).Count(&count)
+	if result.Error != nil {
+		return result.Error
+	} else if count > 0 {
+		return NewError(ErrAlreadyExists, "an entity with id %s already exists", id)
+	}
+
+	return nil
+}
+
 func (db *myDB) getDeviceModelFromString(deviceModelID string) (*models.DeviceModel, error) {
 	truncatedID := deviceModelID
 
@@ -469,10 +1476,12 @@ func (db *myDB) getDeviceModelFromString(deviceModelID string) (*models.DeviceMo
 	}
 
 	m := &models.DeviceModel{}
-	result := db.impl.Where("device_model_id = ?", truncatedID).First(m)
+	result := db.impl.Scopes(db.inTenant).Where("device_model_id = ?", truncatedID).First(m)
 	if result.RowsAffected == 1 {
 		return m, nil
+	} else if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, result.Error
 	}
 
-	return nil, errors.New("No DeviceModel found matching " + deviceModelID)
+	return nil, NewError(ErrInvalidInput, "No DeviceModel found matching %s", deviceModelID)
 }
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -8,6 +9,7 @@ import (
 	"time"
 
 	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/logging"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/models"
 	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
 	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/types"
 )
@@ -81,10 +83,12 @@ func TestGetDeviceModels(t *testing.T) {
 	if db, ok := newDatabaseForTest(t); ok {
 		if _, _, ok := seedNewDeviceModel(t, db); ok {
 
-			models, _ := db.GetDeviceModels()
+			models, _ := db.GetDeviceModels(DeviceModelFilter{}, Pagination{})
 
 			if len(models) != 1 {
 				t.Errorf("Returned number (%d) is different from expected %d.", len(models), 1)
+			} else if len(models[0].ControlledProperties) != 2 {
+				t.Errorf("Expected the controlled properties of the device model to be loaded, but got %v", models[0].ControlledProperties)
 			}
 		}
 	}
@@ -174,7 +178,7 @@ func TestGetDevices(t *testing.T) {
 			)
 			db.CreateDevice(device)
 
-			devices, _ := db.GetDevices()
+			devices, _ := db.GetDevices(DeviceFilter{}, Pagination{})
 
 			if len(devices) != 1 {
 				t.Errorf("Number of returned devices (%d) does not match expected %d.", len(devices), 1)
@@ -183,33 +187,650 @@ func TestGetDevices(t *testing.T) {
 	}
 }
 
+func TestThatGetDeviceModelsCanBePaginated(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		for i := 0; i < 5; i++ {
+			seedNewDeviceModel(t, db)
+		}
+
+		count, err := db.GetDeviceModelCount(DeviceModelFilter{})
+		if err != nil || count != 5 {
+			t.Errorf("Expected a count of 5 device models, but got %d (%v)", count, err)
+		}
+
+		all, _ := db.GetDeviceModels(DeviceModelFilter{}, Pagination{})
+		page, _ := db.GetDeviceModels(DeviceModelFilter{}, Pagination{Limit: 2, Offset: 1})
+		if len(page) != 2 || page[0].DeviceModelID != all[1].DeviceModelID {
+			t.Errorf("Unexpected page of device models: %v", page)
+		}
+
+		page, _ = db.GetDeviceModels(DeviceModelFilter{}, Pagination{Offset: 4})
+		if len(page) != 1 || page[0].DeviceModelID != all[4].DeviceModelID {
+			t.Errorf("Unexpected last page of device models: %v", page)
+		}
+	}
+}
+
+func TestThatGetDevicesReturnsLatestValuesAndDeviceModels(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		if _, modelID, ok := seedNewDeviceModel(t, db); ok {
+			deviceIDs := []string{}
+			for i := 0; i < 3; i++ {
+				device := newDevice()
+				device.RefDeviceModel, _ = fiware.NewDeviceModelRelationship(fiware.DeviceModelIDPrefix + modelID)
+				d, _ := db.CreateDevice(device)
+				deviceIDs = append(deviceIDs, d.DeviceID)
+			}
+
+			db.UpdateDeviceValue(deviceIDs[0], "t=10", time.Time{})
+			db.UpdateDeviceValue(deviceIDs[2], "l=3;t=12", time.Time{})
+
+			devices, err := db.GetDevices(DeviceFilter{}, Pagination{})
+			if err != nil {
+				t.Errorf("Failed to get devices: %s", err.Error())
+				return
+			}
+
+			expectedValues := map[string]string{deviceIDs[0]: "t=10", deviceIDs[1]: "", deviceIDs[2]: "l=3;t=12"}
+			for _, device := range devices {
+				if device.Value != expectedValues[device.DeviceID] {
+					t.Errorf("Unexpected value \"%s\" for device %s", device.Value, device.DeviceID)
+				}
+
+				if device.DeviceModel.DeviceModelID != modelID {
+					t.Errorf("Expected device model %s to be loaded, but got \"%s\"", modelID, device.DeviceModel.DeviceModelID)
+				}
+			}
+		}
+	}
+}
+
+func TestThatGetDevicesCanFilterOnLocation(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		// Devices at a beach, in the city centre and far away (longitude, latitude)
+		positions := [][2]float64{{17.3069, 62.3908}, {17.3100, 62.3920}, {17.9000, 62.6000}}
+		deviceIDs := []string{}
+
+		for _, position := range positions {
+			key, deviceID, ok := seedNewDevice(t, db)
+			if !ok {
+				return
+			}
+
+			db.(*myDB).impl.Model(&models.Device{}).Where("id = ?", key).Updates(
+				map[string]interface{}{"longitude": position[0], "latitude": position[1]},
+			)
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+
+		checkDevices := func(description string, filter DeviceFilter, expected ...string) {
+			devices, err := db.GetDevices(filter, Pagination{})
+			if err != nil {
+				t.Errorf("%s: failed to get devices: %s", description, err.Error())
+				return
+			}
+
+			found := []string{}
+			for _, d := range devices {
+				found = append(found, d.DeviceID)
+			}
+
+			if strings.Join(found, ",") != strings.Join(expected, ",") {
+				t.Errorf("%s: expected devices %v, but got %v", description, expected, found)
+			}
+
+			count, _ := db.GetDeviceCount(filter)
+			if count != int64(len(expected)) {
+				t.Errorf("%s: expected a count of %d, but got %d", description, len(expected), count)
+			}
+		}
+
+		checkDevices("near", DeviceFilter{Geo: &GeoQuery{
+			Relation: GeoRelationNear, Geometry: GeometryPoint, Point: [2]float64{17.3070, 62.3909}, MaxDistance: 100,
+		}}, deviceIDs[0])
+
+		checkDevices("near with min distance", DeviceFilter{Geo: &GeoQuery{
+			Relation: GeoRelationNear, Geometry: GeometryPoint, Point: [2]float64{17.3070, 62.3909}, MinDistance: 100,
+		}}, deviceIDs[1], deviceIDs[2])
+
+		district := [][2]float64{{17.2, 62.3}, {17.4, 62.3}, {17.4, 62.5}, {17.2, 62.5}, {17.2, 62.3}}
+		checkDevices("within", DeviceFilter{Geo: &GeoQuery{
+			Relation: GeoRelationWithin, Geometry: GeometryPolygon, Polygon: [][][2]float64{district},
+		}}, deviceIDs[0], deviceIDs[1])
+
+		hole := [][2]float64{{17.305, 62.39}, {17.305, 62.391}, {17.308, 62.391}, {17.308, 62.39}, {17.305, 62.39}}
+		checkDevices("intersects with hole", DeviceFilter{Geo: &GeoQuery{
+			Relation: GeoRelationIntersects, Geometry: GeometryPolygon, Polygon: [][][2]float64{district, hole},
+		}}, deviceIDs[1])
+
+		_, err := db.GetDevices(DeviceFilter{Geo: &GeoQuery{
+			Relation: GeoRelationWithin, Geometry: GeometryPolygon, Polygon: [][][2]float64{district[:3]},
+		}}, Pagination{})
+		if !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("Expected an open polygon to be rejected, but got: %v", err)
+		}
+	}
+}
+
+func TestThatAttributeQueriesFilterDevicesAndDeviceModels(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		deviceIDs := []string{}
+		modelIDs := []string{}
+
+		for i := 0; i < 3; i++ {
+			key, deviceID, ok := seedNewDevice(t, db)
+			if !ok {
+				return
+			}
+
+			device, _ := db.GetDeviceFromID(deviceID)
+			model, _ := db.GetDeviceModelFromPrimaryKey(device.DeviceModelID)
+
+			db.(*myDB).impl.Model(&models.Device{}).Where("id = ?", key).Update(
+				"date_last_value_reported", time.Date(2021, 5, 1+i, 0, 0, 0, 0, time.UTC),
+			)
+
+			deviceIDs = append(deviceIDs, deviceID)
+			modelIDs = append(modelIDs, model.DeviceModelID)
+		}
+
+		filter := DeviceFilter{Query: &AttributeQuery{
+			Operator: QueryOperatorOr,
+			Operands: []AttributeQuery{
+				{Attribute: "refDeviceModel", Operator: "==", Values: []string{fiware.DeviceModelIDPrefix + modelIDs[0]}},
+				{Attribute: "dateLastValueReported", Operator: ">", Values: []string{"2021-05-02T12:00:00Z"}},
+			},
+		}}
+
+		devices, err := db.GetDevices(filter, Pagination{})
+		if err != nil || len(devices) != 2 || devices[0].DeviceID != deviceIDs[0] || devices[1].DeviceID != deviceIDs[2] {
+			t.Errorf("Expected devices %s and %s to match the query, but got %v (%v)", deviceIDs[0], deviceIDs[2], devices, err)
+		}
+
+		count, _ := db.GetDeviceCount(DeviceFilter{Query: &AttributeQuery{
+			Attribute: "dateLastValueReported", Operator: "==", Range: &[2]string{"2021-05-01T00:00:00Z", "2021-05-02T00:00:00Z"},
+		}})
+		if count != 2 {
+			t.Errorf("Expected two devices to have reported values within the range, but got %d", count)
+		}
+
+		deviceModels, err := db.GetDeviceModels(DeviceModelFilter{Query: &AttributeQuery{
+			Operator: QueryOperatorAnd,
+			Operands: []AttributeQuery{
+				{Attribute: "id", Operator: "==", Values: []string{modelIDs[1], fiware.DeviceModelIDPrefix + modelIDs[2]}},
+				{Attribute: "controlledProperty", Operator: "==", Values: []string{"temperature"}},
+			},
+		}}, Pagination{})
+		if err != nil || len(deviceModels) != 2 {
+			t.Errorf("Expected two device models to match the query, but got %d (%v)", len(deviceModels), err)
+		}
+
+		count, _ = db.GetDeviceModelCount(DeviceModelFilter{Query: &AttributeQuery{
+			Attribute: "controlledProperty", Operator: "==", Values: []string{"snowDepth"},
+		}})
+		if count != 0 {
+			t.Errorf("Expected no device models to control snowDepth, but got %d", count)
+		}
+
+		_, err = db.GetDevices(DeviceFilter{Query: &AttributeQuery{
+			Attribute: "spaceship", Operator: "==", Values: []string{"enterprise"},
+		}}, Pagination{})
+		if !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("Expected a query on an unknown attribute to be rejected, but got: %v", err)
+		}
+	}
+}
+
+func TestThatUpdateDeviceChangesLocationAndDeviceModel(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		_, deviceID, ok := seedNewDevice(t, db)
+		if !ok {
+			return
+		}
+
+		modelKey, modelID, ok := seedNewDeviceModel(t, db)
+		if !ok {
+			return
+		}
+
+		refDeviceModel := fiware.DeviceModelIDPrefix + modelID
+		device, err := db.UpdateDevice(deviceID, DeviceUpdate{
+			Location:       &[2]float64{17.3069, 62.3908},
+			RefDeviceModel: &refDeviceModel,
+		})
+
+		if err != nil {
+			t.Fatalf("Failed to update device: %s", err.Error())
+		}
+
+		if device.Longitude != 17.3069 || device.Latitude != 62.3908 || device.DeviceModelID != modelKey {
+			t.Errorf("Unexpected device after update: %+v", *device)
+		}
+
+		_, err = db.UpdateDevice(deviceID, DeviceUpdate{Location: &[2]float64{62.3908, 97.3069}})
+		if !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("Expected a latitude outside of [-90, 90] to be rejected, but got: %v", err)
+		}
+
+		unknownModel := "urn:ngsi-ld:DeviceModel:spaceship"
+		_, err = db.UpdateDevice(deviceID, DeviceUpdate{RefDeviceModel: &unknownModel})
+		if !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("Expected an unknown device model to be rejected, but got: %v", err)
+		}
+
+		_, err = db.UpdateDevice("nosuchdevice", DeviceUpdate{})
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound for an unknown device, but got: %v", err)
+		}
+	}
+}
+
+func TestThatUpdateDeviceStoresFiwareAttributes(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		_, deviceID, ok := seedNewDevice(t, db)
+		if !ok {
+			return
+		}
+
+		serialNumber := "LB-0001"
+		batteryLevel := 0.15
+		installed := time.Date(2021, 5, 1, 8, 0, 0, 0, time.UTC)
+
+		device, err := db.UpdateDevice(deviceID, DeviceUpdate{
+			SerialNumber:  &serialNumber,
+			BatteryLevel:  &batteryLevel,
+			Owner:         []string{"fritid", "teknik"},
+			DateInstalled: &installed,
+		})
+		if err != nil {
+			t.Fatalf("Failed to update device: %s", err.Error())
+		}
+
+		if device.SerialNumber != serialNumber || *device.BatteryLevel != batteryLevel ||
+			strings.Join(device.GetOwners(), ",") != "fritid,teknik" || !device.DateInstalled.Equal(installed) {
+			t.Errorf("Unexpected device after update: %+v", *device)
+		}
+
+		count, _ := db.GetDeviceCount(DeviceFilter{Query: &AttributeQuery{
+			Attribute: "batteryLevel", Operator: "<", Values: []string{"0.2"},
+		}})
+		if count != 1 {
+			t.Errorf("Expected one device with a low battery level, but got %d", count)
+		}
+
+		tooHigh := 1.5
+		_, err = db.UpdateDevice(deviceID, DeviceUpdate{BatteryLevel: &tooHigh})
+		if !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("Expected a battery level above 1 to be rejected, but got: %v", err)
+		}
+	}
+}
+
+func TestThatUpdateDeviceAcceptsUndeterminedLevels(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		_, deviceID, ok := seedNewDevice(t, db)
+		if !ok {
+			return
+		}
+
+		undetermined := models.UndeterminedLevel
+		device, err := db.UpdateDevice(deviceID, DeviceUpdate{BatteryLevel: &undetermined, RSSI: &undetermined})
+		if err != nil {
+			t.Fatalf("Expected -1 to be accepted as an undetermined level, but got: %s", err.Error())
+		}
+
+		if *device.BatteryLevel != -1 || *device.RSSI != -1 {
+			t.Errorf("Expected the undetermined levels to be stored, but got %v and %v", *device.BatteryLevel, *device.RSSI)
+		}
+
+		devices, _ := db.GetDevices(DeviceFilter{Query: &AttributeQuery{
+			Attribute: "batteryLevel", Operator: "<", Values: []string{"0.2"},
+		}}, Pagination{})
+		for _, d := range devices {
+			if d.DeviceID == deviceID {
+				t.Error("Expected an undetermined battery level not to be reported as low")
+			}
+		}
+
+		negative := -0.5
+		_, err = db.UpdateDevice(deviceID, DeviceUpdate{RSSI: &negative})
+		if !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("Expected a negative RSSI other than -1 to be rejected, but got: %v", err)
+		}
+	}
+}
+
+func TestThatUpdateDeviceWithReplaceClearsTheAttributesThatAreNotGiven(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		_, deviceID, ok := seedNewDevice(t, db)
+		if !ok {
+			return
+		}
+
+		serialNumber, name := "LB-0001", "Pier"
+		batteryLevel := 0.15
+		installed := time.Date(2021, 5, 1, 8, 0, 0, 0, time.UTC)
+
+		db.UpdateDevice(deviceID, DeviceUpdate{
+			SerialNumber:  &serialNumber,
+			BatteryLevel:  &batteryLevel,
+			Owner:         []string{"fritid"},
+			DateInstalled: &installed,
+		})
+
+		device, err := db.UpdateDevice(deviceID, DeviceUpdate{Name: &name, Replace: true})
+		if err != nil {
+			t.Fatalf("Failed to replace device: %s", err.Error())
+		}
+
+		if device.Name != name || device.SerialNumber != "" || device.BatteryLevel != nil ||
+			device.Owner != "" || device.DateInstalled != nil {
+			t.Errorf("Expected the attributes that were not given to be cleared: %+v", *device)
+		}
+
+		if device.DeviceModelID == 0 {
+			t.Error("Expected the device model of the device to be kept")
+		}
+	}
+}
+
+func TestThatUpdateDeviceModelRefusesToRemovePropertiesWithValues(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		_, deviceID, ok := seedNewDevice(t, db)
+		if !ok {
+			return
+		}
+
+		device, _ := db.GetDeviceFromID(deviceID)
+		deviceModel, _ := db.GetDeviceModelFromPrimaryKey(device.DeviceModelID)
+
+		_, err := db.UpdateDeviceValue(deviceID, "t=10", time.Time{})
+		if err != nil {
+			t.Fatalf("Failed to update device value: %s", err.Error())
+		}
+
+		_, err = db.UpdateDeviceModel(deviceModel.DeviceModelID, DeviceModelUpdate{
+			ControlledProperties: []string{"fillingLevel"},
+		})
+		if !errors.Is(err, ErrDeviceModelInUse) {
+			t.Errorf("Expected removing a property with values to fail with ErrDeviceModelInUse, but got: %v", err)
+		}
+
+		name := "Badtemperatur"
+		updated, err := db.UpdateDeviceModel(deviceModel.DeviceModelID, DeviceModelUpdate{
+			Name:                 &name,
+			ControlledProperties: []string{"temperature"},
+		})
+		if err != nil {
+			t.Fatalf("Failed to update device model: %s", err.Error())
+		}
+
+		if updated.Name != name || len(updated.ControlledProperties) != 1 || updated.ControlledProperties[0].Name != "temperature" {
+			t.Errorf("Unexpected device model after update: %+v", *updated)
+		}
+
+		_, err = db.UpdateDeviceModel(deviceModel.DeviceModelID, DeviceModelUpdate{
+			ControlledProperties: []string{"temperature", "spaceship"},
+		})
+		if !errors.Is(err, ErrUnsupportedProperty) {
+			t.Errorf("Expected an unknown controlled property to be rejected, but got: %v", err)
+		}
+	}
+}
+
+func TestThatRepairSwappedCoordinatesOnlySwapsDevicesOutsideOfTheRegion(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		sweden := Region{SouthWest: [2]float64{10.5, 55.0}, NorthEast: [2]float64{24.5, 69.5}}
+		// A correct device, a swapped device and a device that is neither (longitude, latitude)
+		positions := [][2]float64{{17.3069, 62.3908}, {62.3908, 17.3069}, {-73.9857, 40.7484}}
+		keys := []uint{}
+
+		for _, position := range positions {
+			key, _, ok := seedNewDevice(t, db)
+			if !ok {
+				return
+			}
+
+			db.(*myDB).impl.Model(&models.Device{}).Where("id = ?", key).Updates(
+				map[string]interface{}{"longitude": position[0], "latitude": position[1]},
+			)
+			keys = append(keys, key)
+		}
+
+		impl := db.(*myDB).impl
+		repairs, err := repairSwappedCoordinates(impl, sweden, true, logging.NewLogger())
+		if err != nil || len(repairs) != 1 || repairs[0].After != positions[0] {
+			t.Fatalf("Expected a dry run to find one swapped device, but got %v (%v)", repairs, err)
+		}
+
+		device := &models.Device{}
+		impl.First(device, keys[1])
+		if device.Longitude != positions[1][0] {
+			t.Errorf("Expected a dry run to leave the device unchanged, but got %+v", *device)
+		}
+
+		repairs, _ = repairSwappedCoordinates(impl, sweden, false, logging.NewLogger())
+		impl.First(device, keys[1])
+		if len(repairs) != 1 || device.Longitude != positions[0][0] || device.Latitude != positions[0][1] {
+			t.Errorf("Expected the swapped device to be repaired, but got %+v", *device)
+		}
+
+		repairs, _ = repairSwappedCoordinates(impl, sweden, false, logging.NewLogger())
+		if len(repairs) != 0 {
+			t.Errorf("Expected a second repair to find nothing, but got %v", repairs)
+		}
+	}
+}
+
+func TestThatTenantsCanNotSeeEachOthersDevices(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		sundsvall := db.WithTenant("sundsvall")
+		timra := db.WithTenant("timra")
+
+		for _, tenant := range []Datastore{sundsvall, timra} {
+			deviceModel := fiware.NewDeviceModel("livboj", []string{"sensor"})
+			deviceModel.ControlledProperty = types.NewTextListProperty([]string{"temperature"})
+			_, err := tenant.CreateDeviceModel(deviceModel)
+			if err != nil {
+				t.Fatalf("Failed to create device model: %s", err.Error())
+			}
+
+			device := fiware.NewDevice("livboj-01", "")
+			device.RefDeviceModel, _ = fiware.NewDeviceModelRelationship(fiware.DeviceModelIDPrefix + "livboj")
+			_, err = tenant.CreateDevice(device)
+			if err != nil {
+				t.Fatalf("Failed to create a device with the same id in another tenant: %s", err.Error())
+			}
+		}
+
+		_, err := sundsvall.UpdateDeviceValue("livboj-01", "t=12", time.Time{})
+		if err != nil {
+			t.Fatalf("Failed to update device value: %s", err.Error())
+		}
+
+		device, _ := timra.GetDeviceFromID("livboj-01")
+		if device == nil || device.Value != "" {
+			t.Errorf("Expected the value of one tenant to be invisible to the other, but got %+v", device)
+		}
+
+		count, _ := db.GetDeviceCount(DeviceFilter{})
+		if count != 0 {
+			t.Errorf("Expected the default tenant to have no devices, but it has %d", count)
+		}
+
+		_, err = db.GetDeviceModelFromID("livboj")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected the device models of other tenants to be invisible, but got: %v", err)
+		}
+
+		duplicate := fiware.NewDevice("livboj-01", "")
+		duplicate.RefDeviceModel, _ = fiware.NewDeviceModelRelationship(fiware.DeviceModelIDPrefix + "livboj")
+		_, err = timra.CreateDevice(duplicate)
+		if !errors.Is(err, ErrAlreadyExists) {
+			t.Errorf("Expected ErrAlreadyExists for a duplicate device within a tenant, but got: %v", err)
+		}
+
+		result := db.(*myDB).impl.Create(&models.Device{Tenant: "timra", DeviceID: "livboj-01"})
+		if result.Error == nil {
+			t.Error("Expected the database to enforce unique device ids within a tenant")
+		}
+	}
+}
+
+func TestThatOnlyTheDefaultTenantCanChangeControlledProperties(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		sundsvall := db.WithTenant("sundsvall")
+
+		_, err := sundsvall.CreateControlledProperty(&models.DeviceControlledProperty{Name: "pressure", Abbreviation: "p"})
+		if !errors.Is(err, ErrForbidden) {
+			t.Errorf("Expected a tenant to be forbidden to create a controlled property, but got: %v", err)
+		}
+
+		unitCode := "CEL"
+		_, err = sundsvall.UpdateControlledProperty("temperature", ControlledPropertyUpdate{UnitCode: &unitCode})
+		if !errors.Is(err, ErrForbidden) {
+			t.Errorf("Expected a tenant to be forbidden to update a controlled property, but got: %v", err)
+		}
+
+		_, err = db.UpdateControlledProperty("temperature", ControlledPropertyUpdate{UnitCode: &unitCode})
+		if err != nil {
+			t.Errorf("Expected the default tenant to be allowed to update a controlled property, but got: %s", err.Error())
+		}
+	}
+}
+
+func TestThatAuditEntriesAreFilteredByEntityTimeAndTenant(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		start := time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+		sundsvall := db.WithTenant("sundsvall")
+
+		for i, entityID := range []string{"urn:ngsi-ld:Device:a", "urn:ngsi-ld:Device:b", "urn:ngsi-ld:Device:a"} {
+			err := sundsvall.AppendAuditEntry(models.AuditEntry{
+				EntityID: entityID, Operation: models.AuditOperationUpdate, Timestamp: start.Add(time.Duration(i) * time.Hour),
+			})
+			if err != nil {
+				t.Fatalf("Failed to append audit entry: %s", err.Error())
+			}
+		}
+
+		entries, err := sundsvall.GetAuditEntries(AuditQuery{EntityID: "urn:ngsi-ld:Device:a"}, Pagination{})
+		if err != nil || len(entries) != 2 || entries[0].Tenant != "sundsvall" {
+			t.Errorf("Expected two audit entries for the entity, but got %v (%v)", entries, err)
+		}
+
+		entries, _ = sundsvall.GetAuditEntries(AuditQuery{From: start.Add(30 * time.Minute), To: start.Add(2 * time.Hour)}, Pagination{})
+		if len(entries) != 1 || entries[0].EntityID != "urn:ngsi-ld:Device:b" {
+			t.Errorf("Expected one audit entry within the time range, but got %v", entries)
+		}
+
+		entries, _ = db.GetAuditEntries(AuditQuery{}, Pagination{})
+		if len(entries) != 0 {
+			t.Errorf("Expected the audit entries of other tenants to be invisible, but got %v", entries)
+		}
+	}
+}
+
+func TestThatAuditEntriesOfAllTenantsAreDeletedWhenTheirRetentionExpires(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		start := time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+
+		for i, tenant := range []string{"", "sundsvall", "sundsvall"} {
+			err := db.WithTenant(tenant).AppendAuditEntry(models.AuditEntry{
+				EntityID: "urn:ngsi-ld:Device:a", Operation: models.AuditOperationUpdate, Timestamp: start.Add(time.Duration(i) * time.Hour),
+			})
+			if err != nil {
+				t.Fatalf("Failed to append audit entry: %s", err.Error())
+			}
+		}
+
+		deleted, err := db.DeleteAuditEntriesBefore(start.Add(90 * time.Minute))
+		if err != nil || deleted != 2 {
+			t.Fatalf("Expected two expired audit entries to be deleted, but got %d (%v)", deleted, err)
+		}
+
+		entries, _ := db.WithTenant("sundsvall").GetAuditEntries(AuditQuery{}, Pagination{})
+		if len(entries) != 1 || !entries[0].Timestamp.Equal(start.Add(2*time.Hour)) {
+			t.Errorf("Expected the newest audit entry to be kept, but got %v", entries)
+		}
+	}
+}
+
+func TestThatReadTransactionsSeeTheDatabaseAndReturnTheErrorOfTheirFunction(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		if _, deviceID, ok := seedNewDevice(t, db); ok {
+			failure := errors.New("stop")
+
+			err := db.ReadTransaction(func(tx Datastore) error {
+				if _, err := tx.GetDeviceFromID(deviceID); err != nil {
+					t.Errorf("Expected the device to be visible in the read transaction: %s", err.Error())
+				}
+				return failure
+			})
+
+			if !errors.Is(err, failure) {
+				t.Errorf("Expected the error of the function to be returned, but got %v", err)
+			}
+		}
+	}
+}
+
 func TestUpdateDeviceValue(t *testing.T) {
 	if db, ok := newDatabaseForTest(t); ok {
 		if _, deviceID, ok := seedNewDevice(t, db); ok {
 
-			_ = db.UpdateDeviceValue(deviceID, "t=10")
+			_, _ = db.UpdateDeviceValue(deviceID, "t=10", time.Time{})
 			time.Sleep(10 * time.Millisecond)
-			_ = db.UpdateDeviceValue(deviceID, "l=3")
+			_, _ = db.UpdateDeviceValue(deviceID, "l=3", time.Time{})
 			time.Sleep(10 * time.Millisecond)
-			_ = db.UpdateDeviceValue(deviceID, "t=11")
+			_, _ = db.UpdateDeviceValue(deviceID, "t=11", time.Time{})
 			time.Sleep(10 * time.Millisecond)
-			_ = db.UpdateDeviceValue(deviceID, "l=5")
+			_, _ = db.UpdateDeviceValue(deviceID, "l=5", time.Time{})
 			time.Sleep(10 * time.Millisecond)
-			err := db.UpdateDeviceValue(deviceID, "t=12")
+			_, err := db.UpdateDeviceValue(deviceID, "t=12", time.Time{})
 
 			if err != nil {
 				t.Errorf("Failed to update device value: %s", err.Error())
 			}
 
-			// TODO: Fix SQLite incompatibility in GetDeviceFromID
-			/*device, err = db.GetDeviceFromID(deviceID)
+			device, err := db.GetDeviceFromID(deviceID)
 			if err != nil {
 				t.Errorf("Failed to get device: %s", err.Error())
 				return
 			}
 			if device.Value != "l=5;t=12" {
 				t.Errorf("Received unexpected device value: %s", device.Value)
-			}*/
+			}
+		}
+	}
+}
+
+func TestThatRestoreDeviceValuesStoresValuesInsideDeadband(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		absolute := 5.0
+		db.UpdateControlledProperty("temperature", ControlledPropertyUpdate{Deadband: &DeadbandUpdate{Absolute: &absolute}})
+
+		if _, deviceID, ok := seedNewDevice(t, db); ok {
+			observedAt := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+			err := db.RestoreDeviceValues(deviceID, []RestoredValue{
+				{ControlledProperty: "temperature", Value: "10", ObservedAt: observedAt},
+				{ControlledProperty: "temperature", Value: "10.5", ObservedAt: observedAt.Add(time.Hour)},
+			})
+			if err != nil {
+				t.Fatalf("Failed to restore device values: %s", err.Error())
+			}
+
+			values, _ := db.GetDeviceValueHistory(deviceID, ValueHistoryQuery{})
+			device, _ := db.GetDeviceFromID(deviceID)
+			if len(values) != 2 || *values[1].NumberValue != 10.5 || device.DateLastValueReported == nil || !device.DateLastValueReported.Equal(observedAt.Add(time.Hour)) {
+				t.Errorf("Expected both values to be restored, but got %v", values)
+			}
+
+			err = db.RestoreDeviceValues(deviceID, []RestoredValue{
+				{ControlledProperty: "humidity", Value: "40", ObservedAt: observedAt},
+			})
+			if !errors.Is(err, ErrUnsupportedProperty) {
+				t.Errorf("Expected a value of an unsupported property to be rejected, but got: %v", err)
+			}
 		}
 	}
 }
@@ -218,7 +839,7 @@ func TestThatUpdateDeviceDoesNotSaveUnsupportedControlledProperty(t *testing.T)
 	if db, ok := newDatabaseForTest(t); ok {
 		if _, deviceID, ok := seedNewDevice(t, db); ok {
 
-			err := db.UpdateDeviceValue(deviceID, "snow=12")
+			_, err := db.UpdateDeviceValue(deviceID, "snow=12", time.Time{})
 
 			if err == nil {
 				t.Error("Expected UpdateDeviceValue to fail, but it didn't.")
@@ -227,6 +848,724 @@ func TestThatUpdateDeviceDoesNotSaveUnsupportedControlledProperty(t *testing.T)
 	}
 }
 
+func TestThatUpdateDeviceValueIsRejectedAsAWhole(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		if _, deviceID, ok := seedNewDevice(t, db); ok {
+			_, err := db.UpdateDeviceValue(deviceID, "t=10;x=3;snow=5;l=full", time.Time{})
+
+			errMsg := getErrorMessageOrString(err, "nil")
+			for _, problem := range []string{"property x", "property snow", "value \"full\" for fillingLevel"} {
+				if !strings.Contains(errMsg, problem) {
+					t.Errorf("Expected error to mention %s, but got: %s", problem, errMsg)
+				}
+			}
+
+			values, _ := db.GetDeviceValueHistory(deviceID, ValueHistoryQuery{})
+			if len(values) != 0 {
+				t.Errorf("Expected no values to be stored from a rejected update, but got %v", values)
+			}
+		}
+	}
+}
+
+func TestThatDatastoreErrorsCanBeToldApart(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		_, err := db.GetDeviceFromID("nosuchdevice")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected a not found error, but got: %v", err)
+		}
+
+		if _, deviceID, ok := seedNewDevice(t, db); ok {
+			device, _ := db.GetDeviceFromID(deviceID)
+			deviceModel, _ := db.GetDeviceModelFromPrimaryKey(device.DeviceModelID)
+
+			d := fiware.NewDevice(deviceID, "")
+			d.RefDeviceModel, _ = fiware.NewDeviceModelRelationship(fiware.DeviceModelIDPrefix + deviceModel.DeviceModelID)
+			_, err = db.CreateDevice(d)
+			if !errors.Is(err, ErrAlreadyExists) {
+				t.Errorf("Expected an already exists error, but got: %v", err)
+			}
+
+			_, err = db.UpdateDeviceValue(deviceID, "snow=12", time.Time{})
+			if !errors.Is(err, ErrUnsupportedProperty) {
+				t.Errorf("Expected an unsupported property error, but got: %v", err)
+			}
+
+			_, err = db.UpdateDeviceValue(deviceID, "t=warm", time.Time{})
+			if !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("Expected an invalid input error, but got: %v", err)
+			}
+		}
+	}
+}
+
+func TestThatUpdateDeviceValueOnlyReturnsTheValuesThatBecameLatest(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		absolute := 1.0
+		db.UpdateControlledProperty("temperature", ControlledPropertyUpdate{Deadband: &DeadbandUpdate{Absolute: &absolute}})
+
+		if _, deviceID, ok := seedNewDevice(t, db); ok {
+			observedAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+
+			latest, err := db.UpdateDeviceValue(deviceID, "t=10", observedAt)
+			if err != nil || len(latest) != 1 || latest[0].ControlledProperty != "temperature" || *latest[0].Value.NumberValue != 10 {
+				t.Fatalf("Expected the first value to become the latest value, but got %v (%v)", latest, err)
+			}
+
+			// Neither a value inside of the deadband nor one that arrives out of order is the latest value
+			older := observedAt.Add(-10 * time.Minute).Format(time.RFC3339)
+			latest, err = db.UpdateDeviceValue(deviceID, "t=4@"+older, observedAt.Add(time.Minute))
+			if err != nil || len(latest) != 0 {
+				t.Errorf("Expected no latest values for an out of order value, but got %v (%v)", latest, err)
+			}
+
+			latest, err = db.UpdateDeviceValue(deviceID, "t=10.5", observedAt.Add(time.Minute))
+			if err != nil || len(latest) != 0 {
+				t.Errorf("Expected no latest values for a value inside of the deadband, but got %v (%v)", latest, err)
+			}
+		}
+	}
+}
+
+func TestThatUpdateDeviceValueHonoursObservedAt(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		if key, deviceID, ok := seedNewDevice(t, db); ok {
+			observedAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+
+			_, err := db.UpdateDeviceValue(deviceID, "t=10", observedAt)
+			if err != nil {
+				t.Errorf("Failed to update device value: %s", err.Error())
+				return
+			}
+
+			// A value that was buffered by a gateway and arrives out of order
+			older := observedAt.Add(-10 * time.Minute).Format(time.RFC3339)
+			_, err = db.UpdateDeviceValue(deviceID, "t=8@"+older+";l=3", observedAt.Add(-20*time.Minute))
+			if err != nil {
+				t.Errorf("Failed to update device value: %s", err.Error())
+				return
+			}
+
+			device, _ := db.GetDeviceFromID(deviceID)
+			if device.Value != "l=3;t=10" {
+				t.Errorf("Expected the out of order value not to replace the latest value, but got %s", device.Value)
+			}
+
+			if device.DateLastValueReported == nil || !device.DateLastValueReported.Equal(observedAt) {
+				t.Errorf("Expected last reported date %s, but got %v", observedAt, device.DateLastValueReported)
+			}
+
+			var count int64
+			db.(*myDB).impl.Model(&models.DeviceValue{}).Where("device_id = ?", key).Count(&count)
+			if count != 3 {
+				t.Errorf("Expected all 3 values to be stored in the history, but got %d", count)
+			}
+		}
+	}
+}
+
+func TestThatUpdateDeviceValueRejectsValuesFromTheFuture(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		if _, deviceID, ok := seedNewDevice(t, db); ok {
+			_, err := db.UpdateDeviceValue(deviceID, "t=10", time.Now().Add(time.Hour))
+			if !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("Expected a value from the future to be rejected, but got: %v", err)
+			}
+		}
+	}
+}
+
+func TestThatNestedTransactionsOnlyRollBackTheirOwnChanges(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		err := db.Transaction(func(tx Datastore) error {
+			tx.Transaction(func(inner Datastore) error {
+				_, err := inner.CreateDeviceModel(newDeviceModel())
+				return err
+			})
+
+			tx.Transaction(func(inner Datastore) error {
+				inner.CreateDeviceModel(newDeviceModel())
+				return errors.New("roll back this device model")
+			})
+
+			return nil
+		})
+
+		if err != nil {
+			t.Errorf("Transaction failed: %s", err.Error())
+		}
+
+		count, _ := db.GetDeviceModelCount(DeviceModelFilter{})
+		if count != 1 {
+			t.Errorf("Expected one device model to be committed, but got %d", count)
+		}
+
+		db.Transaction(func(tx Datastore) error {
+			tx.CreateDeviceModel(newDeviceModel())
+			return errors.New("roll back everything")
+		})
+
+		count, _ = db.GetDeviceModelCount(DeviceModelFilter{})
+		if count != 1 {
+			t.Errorf("Expected the failed transaction to be rolled back, but got %d device models", count)
+		}
+	}
+}
+
+func TestThatDeleteDeviceRemovesDeviceAndValues(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		if key, deviceID, ok := seedNewDevice(t, db); ok {
+			_, _ = db.UpdateDeviceValue(deviceID, "t=10", time.Time{})
+
+			err := db.DeleteDevice(deviceID)
+			if err != nil {
+				t.Errorf("Failed to delete device: %s", err.Error())
+			}
+
+			_, err = db.GetDeviceFromID(deviceID)
+			if err == nil {
+				t.Error("Expected GetDeviceFromID to fail after device was deleted.")
+			}
+
+			var valueCount int64
+			db.(*myDB).impl.Model(&models.DeviceValue{}).Unscoped().Where("device_id = ?", key).Count(&valueCount)
+			if valueCount != 0 {
+				t.Errorf("Expected device values to be deleted, but %d remain.", valueCount)
+			}
+		}
+	}
+}
+
+func TestThatDeleteDeviceReturnsNotFoundForUnknownDevice(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		err := db.DeleteDevice("nosuchdevice")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Unexpected error: %s", getErrorMessageOrString(err, "nil"))
+		}
+	}
+}
+
+func TestThatDeleteDeviceModelIsRefusedWhenInUse(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		if _, modelID, ok := seedNewDeviceModel(t, db); ok {
+			device := newDevice()
+			device.RefDeviceModel, _ = fiware.NewDeviceModelRelationship(
+				fiware.DeviceModelIDPrefix + modelID,
+			)
+			db.CreateDevice(device)
+
+			err := db.DeleteDeviceModel(modelID)
+			if !errors.Is(err, ErrDeviceModelInUse) {
+				t.Errorf("Unexpected error: %s", getErrorMessageOrString(err, "nil"))
+			}
+
+			err = db.DeleteDevice(device.ID[len(fiware.DeviceIDPrefix):])
+			if err != nil {
+				t.Errorf("Failed to delete device: %s", err.Error())
+			}
+
+			err = db.DeleteDeviceModel(modelID)
+			if err != nil {
+				t.Errorf("Failed to delete device model: %s", err.Error())
+			}
+		}
+	}
+}
+
+func TestThatNewControlledPropertyCanBeUsedByDeviceModels(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		_, err := db.CreateControlledProperty(&models.DeviceControlledProperty{
+			Name: "humidity", Abbreviation: "h", UnitCode: "P1", ValueType: models.ValueTypeNumber,
+		})
+		if err != nil {
+			t.Errorf("Failed to create controlled property: %s", err.Error())
+			return
+		}
+
+		deviceModel := newDeviceModel()
+		deviceModel.ControlledProperty = types.NewTextListProperty([]string{"humidity", "temperature"})
+
+		_, err = db.CreateDeviceModel(deviceModel)
+		if err != nil {
+			t.Errorf("Failed to create device model with new controlled property: %s", err.Error())
+		}
+	}
+}
+
+func TestThatCreateControlledPropertyFailsOnDuplicateAbbreviation(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		_, err := db.CreateControlledProperty(&models.DeviceControlledProperty{
+			Name: "tilt", Abbreviation: "t", UnitCode: "DD", ValueType: models.ValueTypeNumber,
+		})
+		if err == nil {
+			t.Error("Expected CreateControlledProperty to fail when reusing the abbreviation of temperature.")
+		}
+	}
+}
+
+func TestUpdateControlledProperty(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		unitCode := "FAH"
+		_, err := db.UpdateControlledProperty("temperature", ControlledPropertyUpdate{UnitCode: &unitCode})
+		if err != nil {
+			t.Errorf("Failed to update controlled property: %s", err.Error())
+			return
+		}
+
+		property, _ := db.GetControlledPropertyFromName("temperature")
+		checkStringValue(t, "unit code", property.UnitCode, unitCode)
+		checkStringValue(t, "abbreviation", property.Abbreviation, "t")
+	}
+}
+
+func TestThatUpdateDeviceValueStoresTypedNumbers(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		if key, deviceID, ok := seedNewDevice(t, db); ok {
+			_, err := db.UpdateDeviceValue(deviceID, "t=10.5", time.Time{})
+			if err != nil {
+				t.Errorf("Failed to update device value: %s", err.Error())
+				return
+			}
+
+			value := &models.DeviceValue{}
+			db.(*myDB).impl.Where("device_id = ?", key).First(value)
+			if value.NumberValue == nil || *value.NumberValue != 10.5 {
+				t.Errorf("Expected number value 10.5 to be stored, but got %v", value.NumberValue)
+			}
+		}
+	}
+}
+
+func TestThatUpdateDeviceValueRejectsMalformedNumbers(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		if _, deviceID, ok := seedNewDevice(t, db); ok {
+			_, err := db.UpdateDeviceValue(deviceID, "t=warm", time.Time{})
+
+			errMsg := getErrorMessageOrString(err, "nil")
+			if !strings.Contains(errMsg, "value \"warm\" for temperature is not a valid number") {
+				t.Errorf("Unexpected error: %s", errMsg)
+			}
+		}
+	}
+}
+
+func TestThatCreateControlledPropertyRequiresAllowedValuesForEnums(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		_, err := db.CreateControlledProperty(&models.DeviceControlledProperty{
+			Name: "mode", Abbreviation: "m", ValueType: models.ValueTypeEnum,
+		})
+
+		if err == nil {
+			t.Error("Expected CreateControlledProperty to fail for an enum without allowed values.")
+		}
+	}
+}
+
+func TestThatUpdateDeviceValueSuppressesValuesInsideDeadband(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		absolute, maxSilence := 0.5, uint(3600)
+		db.UpdateControlledProperty("temperature", ControlledPropertyUpdate{
+			Deadband: &DeadbandUpdate{Absolute: &absolute, MaxSilenceSeconds: &maxSilence},
+		})
+
+		if key, deviceID, ok := seedNewDevice(t, db); ok {
+			for _, value := range []string{"t=10", "t=10.2", "t=10.5", "t=11"} {
+				if _, err := db.UpdateDeviceValue(deviceID, value, time.Time{}); err != nil {
+					t.Errorf("Failed to update device value: %s", err.Error())
+					return
+				}
+			}
+
+			values, _ := db.GetDeviceValueHistory(deviceID, ValueHistoryQuery{})
+			if len(values) != 2 || values[0].Value != "10" || values[1].Value != "11" {
+				t.Errorf("Expected only the values 10 and 11 to be stored, but got %v", values)
+			}
+
+			device := &models.Device{}
+			db.(*myDB).impl.First(device, key)
+			if device.DateLastValueReported == nil {
+				t.Error("Expected the suppressed values to update the last reported date.")
+			}
+
+			// A value that has been silent for longer than the max silence interval is always stored
+			db.(*myDB).impl.Model(&models.DeviceValue{}).Where("device_id = ?", key).Update(
+				"observed_at", time.Now().UTC().Add(-2*time.Hour),
+			)
+			db.UpdateDeviceValue(deviceID, "t=11", time.Time{})
+
+			values, _ = db.GetDeviceValueHistory(deviceID, ValueHistoryQuery{})
+			if len(values) != 3 {
+				t.Errorf("Expected the value to be stored after the max silence interval, but got %v", values)
+			}
+		}
+	}
+}
+
+func TestThatDeviceModelDeadbandOverridesControlledPropertyDeadbandPerPart(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		absolute, relative := 5.0, 0.01
+		db.UpdateControlledProperty("temperature", ControlledPropertyUpdate{
+			Deadband: &DeadbandUpdate{Absolute: &absolute, Relative: &relative},
+		})
+
+		if _, deviceID, ok := seedNewDevice(t, db); ok {
+			device, _ := db.GetDeviceFromID(deviceID)
+			deviceModel, _ := db.GetDeviceModelFromPrimaryKey(device.DeviceModelID)
+
+			err := db.SetDeviceModelDeadband(deviceModel.DeviceModelID, models.Deadband{DeadbandAbsolute: 1})
+			if err != nil {
+				t.Errorf("Failed to set device model deadband: %s", err.Error())
+				return
+			}
+
+			// 102 is outside of the absolute deadband of the device model, while 103.01 is still
+			// inside of the relative deadband of the controlled property
+			for _, value := range []string{"t=100", "t=100.5", "t=102", "t=103.01"} {
+				db.UpdateDeviceValue(deviceID, value, time.Time{})
+			}
+
+			values, _ := db.GetDeviceValueHistory(deviceID, ValueHistoryQuery{})
+			if len(values) != 2 || values[1].Value != "102" {
+				t.Errorf("Expected the deadbands to be merged, but got %v", values)
+			}
+		}
+	}
+}
+
+func TestThatUpdateDeviceModelOnlyChangesTheGivenPartsOfTheDeadband(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		if _, deviceModelID, ok := seedNewDeviceModel(t, db); ok {
+			db.SetDeviceModelDeadband(deviceModelID, models.Deadband{DeadbandRelative: 0.1, MaxSilenceSeconds: 600})
+
+			absolute := 2.0
+			deviceModel, err := db.UpdateDeviceModel(deviceModelID, DeviceModelUpdate{Deadband: &DeadbandUpdate{Absolute: &absolute}})
+			if err != nil {
+				t.Fatalf("Failed to update the device model: %s", err.Error())
+			}
+
+			expected := models.Deadband{DeadbandAbsolute: 2, DeadbandRelative: 0.1, MaxSilenceSeconds: 600}
+			deviceModel, _ = db.GetDeviceModelFromID(deviceModelID)
+			if deviceModel.Deadband != expected {
+				t.Errorf("Expected the deadband to be %+v, but got %+v", expected, deviceModel.Deadband)
+			}
+		}
+	}
+}
+
+func TestGetDeviceValueHistory(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		if _, deviceID, ok := seedNewDevice(t, db); ok {
+			for _, value := range []string{"t=10", "l=3", "t=11", "l=5", "t=12"} {
+				db.UpdateDeviceValue(deviceID, value, time.Time{})
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			values, err := db.GetDeviceValueHistory(deviceID, ValueHistoryQuery{})
+			if err != nil {
+				t.Errorf("Failed to get value history: %s", err.Error())
+				return
+			}
+
+			if len(values) != 5 {
+				t.Errorf("Expected 5 values in history, but got %d", len(values))
+			}
+
+			values, _ = db.GetDeviceValueHistory(deviceID, ValueHistoryQuery{
+				ControlledProperties: []string{"temperature"},
+				LastN:                2,
+			})
+
+			if len(values) != 2 || values[0].Value != "11" || values[1].Value != "12" {
+				t.Errorf("Unexpected last temperature values: %v", values)
+			}
+
+			values, _ = db.GetDeviceValueHistory(deviceID, ValueHistoryQuery{
+				To: time.Now().Add(-time.Hour),
+			})
+
+			if len(values) != 0 {
+				t.Errorf("Expected no values before the device was created, but got %d", len(values))
+			}
+		}
+	}
+}
+
+func TestThatGetDeviceValueHistoriesOnlyReturnsDevicesWithValues(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		_, quiet, _ := seedNewDevice(t, db)
+		_, first, _ := seedNewDevice(t, db)
+		_, second, ok := seedNewDevice(t, db)
+		if !ok {
+			return
+		}
+
+		start := time.Now().UTC().Add(-time.Hour)
+		for idx, value := range []string{"t=10", "l=3", "t=11", "t=12"} {
+			observedAt := start.Add(time.Duration(idx) * time.Minute)
+			db.UpdateDeviceValue(first, value, observedAt)
+			db.UpdateDeviceValue(second, value, observedAt)
+		}
+
+		histories, err := db.GetDeviceValueHistories(nil, ValueHistoryQuery{ControlledProperties: []string{"temperature"}, LastN: 2}, Pagination{})
+		if err != nil || len(histories) != 2 {
+			t.Fatalf("Expected the histories of two devices, but got %v (%v)", histories, err)
+		}
+
+		for _, history := range histories {
+			if history.DeviceID == quiet || len(history.Values) != 2 ||
+				history.Values[0].Value != "11" || history.Values[1].Value != "12" {
+				t.Errorf("Unexpected value history %+v", history)
+			}
+		}
+
+		last := histories[1].DeviceID
+		histories, _ = db.GetDeviceValueHistories(nil, ValueHistoryQuery{}, Pagination{Limit: 1, Offset: 1})
+		if len(histories) != 1 || histories[0].DeviceID != last || len(histories[0].Values) != 4 {
+			t.Errorf("Expected the second page to hold the full history of %s, but got %+v", last, histories)
+		}
+
+		histories, _ = db.GetDeviceValueHistories([]string{quiet, first}, ValueHistoryQuery{}, Pagination{})
+		if len(histories) != 1 || histories[0].DeviceID != first {
+			t.Errorf("Expected only the history of %s, but got %+v", first, histories)
+		}
+	}
+}
+
+func TestThatApplyRetentionPoliciesDownsamplesExpiredValues(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		if key, _, ok := seedNewDevice(t, db); ok {
+			impl := db.(*myDB).impl
+			property, _ := db.GetControlledPropertyFromName("temperature")
+
+			rawRetention := uint(30)
+			db.UpdateControlledProperty("temperature", ControlledPropertyUpdate{RawValueRetentionDays: &rawRetention})
+
+			now := time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)
+			expiredHour := now.Add(-31 * 24 * time.Hour).Truncate(time.Hour)
+
+			for idx, value := range []float64{10, 14, 12} {
+				impl.Create(&models.DeviceValue{
+					DeviceID:                   key,
+					DeviceControlledPropertyID: property.ID,
+					Value:                      fmt.Sprintf("%v", value),
+					NumberValue:                &value,
+					ObservedAt:                 expiredHour.Add(time.Duration(idx) * time.Minute),
+				})
+			}
+
+			recentValue := 20.0
+			impl.Create(&models.DeviceValue{
+				DeviceID:                   key,
+				DeviceControlledPropertyID: property.ID,
+				Value:                      "20",
+				NumberValue:                &recentValue,
+				ObservedAt:                 now.Add(-time.Hour),
+			})
+
+			reports, err := db.ApplyRetentionPolicies(now)
+			if err != nil {
+				t.Errorf("Failed to apply retention policies: %s", err.Error())
+				return
+			}
+
+			for _, report := range reports {
+				if report.ControlledProperty == "temperature" && (report.ValuesDeleted != 3 || report.AggregatesCreated != 1) {
+					t.Errorf("Unexpected retention report: %v", report)
+				}
+			}
+
+			aggregate := &models.DeviceValueAggregate{}
+			impl.Where("device_id = ?", key).First(aggregate)
+			if aggregate.Count != 3 || aggregate.Min != 10 || aggregate.Max != 14 || aggregate.Avg != 12 {
+				t.Errorf("Unexpected aggregate: %v", aggregate)
+			}
+
+			var remaining int64
+			impl.Model(&models.DeviceValue{}).Where("device_id = ?", key).Count(&remaining)
+			if remaining != 1 {
+				t.Errorf("Expected the recent value to remain, but found %d values.", remaining)
+			}
+		}
+	}
+}
+
+func TestThatApplyRetentionPoliciesKeepsTheLatestValueOfAQuietDevice(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		if key, deviceID, ok := seedNewDevice(t, db); ok {
+			rawRetention := uint(30)
+			absolute := 1.0
+			db.UpdateControlledProperty("temperature", ControlledPropertyUpdate{
+				RawValueRetentionDays: &rawRetention, Deadband: &DeadbandUpdate{Absolute: &absolute},
+			})
+
+			// The device last reported 40 days ago
+			lastReport := time.Now().UTC().Add(-40 * 24 * time.Hour)
+			db.UpdateDeviceValue(deviceID, "t=10", lastReport.Add(-time.Hour))
+			db.UpdateDeviceValue(deviceID, "t=12", lastReport)
+
+			_, err := db.ApplyRetentionPolicies(time.Now())
+			if err != nil {
+				t.Fatalf("Failed to apply retention policies: %s", err.Error())
+			}
+
+			device, _ := db.GetDeviceFromID(deviceID)
+			if device.Value != "t=12" {
+				t.Errorf("Expected the latest value of the quiet device to be kept, but its value is \"%s\"", device.Value)
+			}
+
+			aggregate := &models.DeviceValueAggregate{}
+			db.(*myDB).impl.Where("device_id = ?", key).First(aggregate)
+			if aggregate.Count != 1 || aggregate.Avg != 10 {
+				t.Errorf("Expected only the superseded value to be aggregated, but got %v", aggregate)
+			}
+
+			// The kept value is still the baseline of the deadband
+			db.UpdateDeviceValue(deviceID, "t=12.5", time.Time{})
+			values, _ := db.GetDeviceValueHistory(deviceID, ValueHistoryQuery{})
+			if len(values) != 1 {
+				t.Errorf("Expected a value inside the deadband of the kept value to be suppressed, but got %v", values)
+			}
+		}
+	}
+}
+
+func TestThatMigrationsAreRecordedAndOnlyAppliedOnce(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		impl := db.(*myDB).impl
+		log := logging.NewLogger()
+
+		err := migrate(impl, log)
+		if err != nil {
+			t.Errorf("Failed to re-run migrations: %s", err.Error())
+		}
+
+		var migrationCount int64
+		impl.Model(&models.SchemaMigration{}).Count(&migrationCount)
+		if migrationCount != int64(len(migrations)) {
+			t.Errorf("Expected %d applied migrations, but found %d.", len(migrations), migrationCount)
+		}
+
+		var propertyCount int64
+		impl.Model(&models.DeviceControlledProperty{}).Count(&propertyCount)
+		if propertyCount != 4 {
+			t.Errorf("Expected 4 seeded controlled properties, but found %d.", propertyCount)
+		}
+	}
+}
+
+func TestThatMigrationsDoNotMoveDevicesWithLongitudeLargerThanLatitude(t *testing.T) {
+	impl, err := NewSQLiteConnector()()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// A device in Nairobi that was stored before the first migrations that have a
+	// version of their own
+	impl.AutoMigrate(&models.SchemaMigration{})
+	for _, m := range migrations[:2] {
+		m.migrate(impl)
+		impl.Create(&models.SchemaMigration{Version: m.version, Description: m.description})
+	}
+	impl.Exec("INSERT INTO devices (device_id, longitude, latitude) VALUES ('nairobi', 36.82, -1.29)")
+
+	err = migrate(impl, logging.NewLogger())
+	if err != nil {
+		t.Fatalf("Failed to migrate: %s", err.Error())
+	}
+
+	device := &models.Device{}
+	impl.Where("device_id = ?", "nairobi").First(device)
+	if device.Longitude != 36.82 || device.Latitude != -1.29 {
+		t.Errorf("Expected the device to stay at [36.82, -1.29], but it was moved to [%v, %v]", device.Longitude, device.Latitude)
+	}
+}
+
+func TestThatMigrationsClearTheZeroLastReportedDateOfDevices(t *testing.T) {
+	impl, err := NewSQLiteConnector()()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// A device that never reported a value, stored before the date could be NULL
+	impl.AutoMigrate(&models.SchemaMigration{})
+	for _, m := range migrations[:11] {
+		m.migrate(impl)
+		impl.Create(&models.SchemaMigration{Version: m.version, Description: m.description})
+	}
+	impl.Exec("INSERT INTO devices (device_id, date_last_value_reported) VALUES ('silent', ?)", time.Time{})
+
+	err = migrate(impl, logging.NewLogger())
+	if err != nil {
+		t.Fatalf("Failed to migrate: %s", err.Error())
+	}
+
+	device := &models.Device{}
+	impl.Where("device_id = ?", "silent").First(device)
+	if device.DateLastValueReported != nil {
+		t.Errorf("Expected the last reported date to be cleared, but it was %v", *device.DateLastValueReported)
+	}
+}
+
+func TestThatDevicesThatNeverReportedDoNotMatchLastReportedQueries(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		if _, _, ok := seedNewDevice(t, db); ok {
+			count, err := db.GetDeviceCount(DeviceFilter{Query: &AttributeQuery{
+				Attribute: "dateLastValueReported", Operator: "<", Values: []string{"2021-05-01T00:00:00Z"},
+			}})
+			if err != nil || count != 0 {
+				t.Errorf("Expected a device that never reported not to match, but got %d (%v)", count, err)
+			}
+		}
+	}
+}
+
+func TestThatMigrateRefusesNewerSchemaVersion(t *testing.T) {
+	if db, ok := newDatabaseForTest(t); ok {
+		impl := db.(*myDB).impl
+		impl.Create(&models.SchemaMigration{Version: 9999, Description: "from the future"})
+
+		err := migrate(impl, logging.NewLogger())
+		if err == nil {
+			t.Error("Expected migrate to fail on a database with a newer schema version.")
+		}
+	}
+}
+
+func BenchmarkGetDevices(b *testing.B) {
+	db, err := NewDatabaseConnection(NewSQLiteConnector(), logging.NewLogger())
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+
+	deviceModel, err := db.CreateDeviceModel(newDeviceModel())
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+
+	for i := 0; i < 500; i++ {
+		device := newDevice()
+		device.RefDeviceModel, _ = fiware.NewDeviceModelRelationship(
+			fiware.DeviceModelIDPrefix + deviceModel.DeviceModelID,
+		)
+
+		d, err := db.CreateDevice(device)
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+
+		db.UpdateDeviceValue(d.DeviceID, fmt.Sprintf("l=%d;t=%d", i%100, i%30), time.Time{})
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		devices, err := db.GetDevices(DeviceFilter{}, Pagination{})
+		if err != nil || len(devices) != 500 {
+			b.Fatalf("Unexpected result from GetDevices: %d devices (%v)", len(devices), err)
+		}
+	}
+}
+
 func checkStringValue(t *testing.T, property, lhs, rhs string) {
 	if strings.Compare(lhs, rhs) != 0 {
 		t.Errorf("Check string failed for property %s: %s != %s", property, lhs, rhs)
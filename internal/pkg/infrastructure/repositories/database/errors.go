@@ -0,0 +1,48 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+//ErrNotFound is returned when the requested entity does not exist in the database
+var ErrNotFound = errors.New("not found")
+
+//ErrAlreadyExists is returned when attempting to create an entity that already exists
+var ErrAlreadyExists = errors.New("already exists")
+
+//ErrInvalidInput is returned when the input to a Datastore method is malformed or incomplete
+var ErrInvalidInput = errors.New("invalid input")
+
+//ErrUnsupportedProperty is returned when referring to a controlled property that is either
+//unknown or not supported by the device model in question
+var ErrUnsupportedProperty = errors.New("unsupported controlled property")
+
+//ErrDeviceModelInUse is returned when attempting to delete a device model that devices still refer
+//to, or to remove controlled properties that its devices have reported values for
+var ErrDeviceModelInUse = errors.New("device model is in use")
+
+//ErrForbidden is returned when a tenant attempts to change data that it does not own, such as
+//the catalog of controlled properties that is shared by all tenants
+var ErrForbidden = errors.New("forbidden")
+
+//Error is returned by the Datastore to describe what went wrong in a way that the caller can
+//tell apart using errors.Is with the sentinel errors above, without losing the detailed message
+type Error struct {
+	Kind   error
+	Detail string
+}
+
+func (e *Error) Error() string {
+	return e.Detail
+}
+
+//Unwrap returns the sentinel error that describes the kind of this error
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+//NewError creates a new Error of the given kind with a formatted detail message
+func NewError(kind error, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Detail: fmt.Sprintf(format, args...)}
+}
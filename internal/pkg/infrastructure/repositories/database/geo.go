@@ -0,0 +1,168 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+//Supported geospatial relations for device queries
+const (
+	GeoRelationNear       string = "near"
+	GeoRelationWithin     string = "within"
+	GeoRelationIntersects string = "intersects"
+)
+
+//Supported geometries for device queries
+const (
+	GeometryPoint   string = "Point"
+	GeometryPolygon string = "Polygon"
+)
+
+//metersPerDegree is the length of a degree of latitude (and of longitude at the equator)
+const metersPerDegree float64 = 111320
+
+//GeoQuery selects devices by their location relative to a geometry. Coordinates are given
+//in GeoJSON order, i.e. as longitude followed by latitude.
+type GeoQuery struct {
+	Relation    string
+	Geometry    string
+	Point       [2]float64     // Used when Geometry is a Point
+	Polygon     [][][2]float64 // Used when Geometry is a Polygon, as a list of linear rings
+	MaxDistance float64        // Meters, used with the near relation
+	MinDistance float64        // Meters, used with the near relation
+}
+
+//Validate returns an error if the query is not supported or the geometry is malformed
+func (q *GeoQuery) Validate() error {
+	switch q.Geometry {
+	case GeometryPoint:
+		if !isValidPosition(q.Point) {
+			return NewError(ErrInvalidInput, "point %v is not a valid [longitude, latitude] position", q.Point)
+		}
+	case GeometryPolygon:
+		if len(q.Polygon) == 0 {
+			return NewError(ErrInvalidInput, "a polygon requires at least one linear ring")
+		}
+
+		for _, ring := range q.Polygon {
+			if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+				return NewError(ErrInvalidInput, "a linear ring must be closed and have at least four positions")
+			}
+
+			for _, position := range ring {
+				if !isValidPosition(position) {
+					return NewError(ErrInvalidInput, "%v is not a valid [longitude, latitude] position", position)
+				}
+			}
+		}
+	default:
+		return NewError(ErrInvalidInput, "geometry %s is not supported", q.Geometry)
+	}
+
+	switch q.Relation {
+	case GeoRelationNear:
+		if q.Geometry != GeometryPoint {
+			return NewError(ErrInvalidInput, "the near relation is only supported for a Point")
+		}
+
+		if q.MaxDistance <= 0 && q.MinDistance <= 0 {
+			return NewError(ErrInvalidInput, "the near relation requires a maxDistance or a minDistance")
+		}
+	case GeoRelationWithin, GeoRelationIntersects:
+	default:
+		return NewError(ErrInvalidInput, "geo relation %s is not supported", q.Relation)
+	}
+
+	return nil
+}
+
+func isValidPosition(position [2]float64) bool {
+	return position[0] >= -180 && position[0] <= 180 && position[1] >= -90 && position[1] <= 90
+}
+
+//geoFilter is a gorm scope that applies the geo query to a query on the devices table. It only
+//uses plain arithmetic so that it works the same way in both PostgreSQL and SQLite.
+func geoFilter(q *GeoQuery) func(tx *gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		if q == nil {
+			return tx
+		}
+
+		if q.Relation == GeoRelationNear {
+			return nearPoint(tx, q)
+		}
+
+		if q.Geometry == GeometryPoint {
+			// Devices are points, so they can only be within or intersect a point they are equal to
+			return tx.Where("longitude = ? AND latitude = ?", q.Point[0], q.Point[1])
+		}
+
+		return insidePolygon(tx, q.Polygon)
+	}
+}
+
+//nearPoint compares distances using an equirectangular projection around the point, which is
+//accurate enough for the distances within a municipality and needs no trigonometry in SQL
+func nearPoint(tx *gorm.DB, q *GeoQuery) *gorm.DB {
+	lon, lat := q.Point[0], q.Point[1]
+	lonScale := math.Cos(lat * math.Pi / 180)
+
+	distanceSquared := "((longitude - ?) * ? * (longitude - ?) * ? + (latitude - ?) * (latitude - ?))"
+	distanceArgs := []interface{}{lon, lonScale, lon, lonScale, lat, lat}
+
+	if q.MaxDistance > 0 {
+		// A bounding box lets the database use the index on the coordinates before computing distances
+		maxDegrees := q.MaxDistance / metersPerDegree
+		tx = tx.Where("latitude BETWEEN ? AND ?", lat-maxDegrees, lat+maxDegrees)
+		if lonScale > 0.01 {
+			tx = tx.Where("longitude BETWEEN ? AND ?", lon-maxDegrees/lonScale, lon+maxDegrees/lonScale)
+		}
+
+		tx = tx.Where(distanceSquared+" <= ?", append(distanceArgs, maxDegrees*maxDegrees)...)
+	}
+
+	if q.MinDistance > 0 {
+		minDegrees := q.MinDistance / metersPerDegree
+		tx = tx.Where(distanceSquared+" >= ?", append(distanceArgs, minDegrees*minDegrees)...)
+	}
+
+	return tx
+}
+
+//insidePolygon counts how many edges of the polygon a ray from each device crosses, using
+//the even-odd rule so that holes in the polygon are handled as well
+func insidePolygon(tx *gorm.DB, polygon [][][2]float64) *gorm.DB {
+	minLon, minLat, maxLon, maxLat := 180.0, 90.0, -180.0, -90.0
+	crossings := []string{}
+	args := []interface{}{}
+
+	for _, ring := range polygon {
+		for idx := 0; idx < len(ring)-1; idx++ {
+			from, to := ring[idx], ring[idx+1]
+
+			minLon, maxLon = math.Min(minLon, from[0]), math.Max(maxLon, from[0])
+			minLat, maxLat = math.Min(minLat, from[1]), math.Max(maxLat, from[1])
+
+			if from[1] == to[1] {
+				// Horizontal edges are never crossed by a horizontal ray
+				continue
+			}
+
+			slope := (to[0] - from[0]) / (to[1] - from[1])
+			crossings = append(crossings,
+				"CASE WHEN latitude >= ? AND latitude < ? AND longitude < ? + (latitude - ?) * ? THEN 1 ELSE 0 END",
+			)
+			args = append(args, math.Min(from[1], to[1]), math.Max(from[1], to[1]), from[0], from[1], slope)
+		}
+	}
+
+	if len(crossings) == 0 {
+		return tx.Where("1 = 0")
+	}
+
+	tx = tx.Where("longitude BETWEEN ? AND ? AND latitude BETWEEN ? AND ?", minLon, maxLon, minLat, maxLat)
+	return tx.Where(fmt.Sprintf("(%s) %% 2 = 1", strings.Join(crossings, " + ")), args...)
+}
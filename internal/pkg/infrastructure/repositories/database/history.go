@@ -0,0 +1,158 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/models"
+
+	"gorm.io/gorm"
+)
+
+//DeviceValueHistory is the value history of a single device, as returned by GetDeviceValueHistories
+type DeviceValueHistory struct {
+	DeviceID string
+	Values   []models.DeviceValue
+}
+
+func (db *myDB) GetDeviceValueHistory(deviceID string, query ValueHistoryQuery) ([]models.DeviceValue, error) {
+	device := &models.Device{}
+	result := db.impl.Scopes(db.inTenant).Where("device_id = ?", deviceID).First(device)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("device %s: %w", deviceID, ErrNotFound)
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+
+	propertyKeys, err := db.getControlledPropertyKeys(query.ControlledProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.getValueHistory([]uint{device.ID}, propertyKeys, query)
+}
+
+//GetDeviceValueHistories returns a page of the value histories of the devices in deviceIDs, or of
+//all devices if deviceIDs is empty. Devices without any values that match the query are left out,
+//and the histories are ordered by device id.
+func (db *myDB) GetDeviceValueHistories(deviceIDs []string, query ValueHistoryQuery, page Pagination) ([]DeviceValueHistory, error) {
+	propertyKeys, err := db.getControlledPropertyKeys(query.ControlledProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	hasValues := db.impl.Model(&models.DeviceValue{}).Select("1").Where(
+		"device_values.device_id = devices.id",
+	).Scopes(valuesInRange(propertyKeys, query))
+
+	devices := []models.Device{}
+	tx := db.impl.Scopes(db.inTenant).Where("EXISTS (?)", hasValues)
+	if len(deviceIDs) > 0 {
+		tx = tx.Where("device_id IN ?", deviceIDs)
+	}
+
+	result := tx.Order("device_id").Scopes(paginate(page)).Find(&devices)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	deviceKeys := make([]uint, 0, len(devices))
+	for _, device := range devices {
+		deviceKeys = append(deviceKeys, device.ID)
+	}
+
+	values, err := db.getValueHistory(deviceKeys, propertyKeys, query)
+	if err != nil {
+		return nil, err
+	}
+
+	valuesPerDevice := map[uint][]models.DeviceValue{}
+	for _, value := range values {
+		valuesPerDevice[value.DeviceID] = append(valuesPerDevice[value.DeviceID], value)
+	}
+
+	histories := make([]DeviceValueHistory, 0, len(devices))
+	for _, device := range devices {
+		histories = append(histories, DeviceValueHistory{DeviceID: device.DeviceID, Values: valuesPerDevice[device.ID]})
+	}
+
+	return histories, nil
+}
+
+//getControlledPropertyKeys returns the primary keys of the named controlled properties, or none
+//if no names are given
+func (db *myDB) getControlledPropertyKeys(names []string) ([]uint, error) {
+	propertyKeys := []uint{}
+
+	if len(names) > 0 {
+		controlledProperties, err := db.getControlledProperties(names)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range controlledProperties {
+			propertyKeys = append(propertyKeys, p.ID)
+		}
+	}
+
+	return propertyKeys, nil
+}
+
+//valuesInRange is a gorm scope that limits device values to the controlled properties and the
+//time range of the query
+func valuesInRange(propertyKeys []uint, query ValueHistoryQuery) func(tx *gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		if len(propertyKeys) > 0 {
+			tx = tx.Where("device_values.device_controlled_property_id IN ?", propertyKeys)
+		}
+
+		if !query.From.IsZero() {
+			tx = tx.Where("device_values.observed_at >= ?", query.From.UTC())
+		}
+
+		if !query.To.IsZero() {
+			tx = tx.Where("device_values.observed_at < ?", query.To.UTC())
+		}
+
+		return tx
+	}
+}
+
+//getValueHistory returns the values of the devices that match the query in chronological order
+//per device and controlled property, using one query per maxDeviceKeysPerQuery devices. The last
+//N values per device and property are selected with a window function.
+func (db *myDB) getValueHistory(deviceKeys, propertyKeys []uint, query ValueHistoryQuery) ([]models.DeviceValue, error) {
+	history := []models.DeviceValue{}
+
+	for first := 0; first < len(deviceKeys); first += maxDeviceKeysPerQuery {
+		last := first + maxDeviceKeysPerQuery
+		if last > len(deviceKeys) {
+			last = len(deviceKeys)
+		}
+
+		values := db.impl.Model(&models.DeviceValue{}).Where(
+			"device_values.device_id IN ?", deviceKeys[first:last],
+		).Scopes(valuesInRange(propertyKeys, query))
+
+		if query.LastN > 0 {
+			ranked := values.Select(`device_values.*, ROW_NUMBER() OVER (
+				PARTITION BY device_values.device_id, device_values.device_controlled_property_id
+				ORDER BY device_values.observed_at DESC, device_values.id DESC
+			) AS recency`)
+
+			values = db.impl.Table("(?) AS device_values", ranked).Where("recency <= ?", query.LastN)
+		}
+
+		deviceValues := []models.DeviceValue{}
+		result := values.Order(
+			"device_values.device_id, device_values.device_controlled_property_id, device_values.observed_at, device_values.id",
+		).Find(&deviceValues)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+
+		history = append(history, deviceValues...)
+	}
+
+	return history, nil
+}
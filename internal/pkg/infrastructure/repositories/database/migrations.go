@@ -0,0 +1,433 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/logging"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/models"
+
+	"gorm.io/gorm"
+)
+
+type migration struct {
+	version     uint
+	description string
+	migrate     func(tx *gorm.DB) error
+}
+
+//migrations holds all schema migrations in the order they should be applied. Migrations that
+//have been released must never be changed or reordered. Add a new migration to the end instead.
+var migrations = []migration{
+	{1, "create the initial device registry schema", createInitialSchema},
+	{2, "seed the supported controlled properties", seedControlledProperties},
+	{3, "swap latitude and longitude of erroneously seeded devices (withdrawn)", withdrawnMigration},
+	{4, "add unit code and value type to controlled properties", addControlledPropertyUnitsAndTypes},
+	{5, "store device values typed according to their controlled property", addTypedDeviceValues},
+	{6, "add retention policies and device value aggregates", addRetentionPoliciesAndAggregates},
+	{7, "add deadbands to controlled properties and device models", addDeadbands},
+	{8, "index devices by location", addDeviceLocationIndex},
+	{9, "add FIWARE attributes such as name and serial number to devices", addDeviceAttributes},
+	{10, "make device and device model ids unique per tenant", addTenants},
+	{11, "add an append-only audit log", addAuditLog},
+	{12, "store the last reported date of devices that never reported as NULL", clearZeroLastReportedDates},
+}
+
+//MigrateDatabase connects to the database and applies all pending schema migrations
+func MigrateDatabase(connect ConnectorFunc, log logging.Logger) error {
+	impl, err := connect()
+	if err != nil {
+		return err
+	}
+
+	return migrate(impl, log)
+}
+
+func migrate(impl *gorm.DB, log logging.Logger) error {
+	err := impl.AutoMigrate(&models.SchemaMigration{})
+	if err != nil {
+		return fmt.Errorf("failed to create schema migrations table: %s", err.Error())
+	}
+
+	applied := []models.SchemaMigration{}
+	result := impl.Order("version").Find(&applied)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	appliedVersions := map[uint]bool{}
+	for _, m := range applied {
+		appliedVersions[m.Version] = true
+	}
+
+	latestVersion := migrations[len(migrations)-1].version
+	if len(applied) > 0 && applied[len(applied)-1].Version > latestVersion {
+		return fmt.Errorf(
+			"database schema version %d is newer than the latest version %d known to this service",
+			applied[len(applied)-1].Version, latestVersion,
+		)
+	}
+
+	for _, m := range migrations {
+		if appliedVersions[m.version] {
+			continue
+		}
+
+		log.Infof("Applying database migration %d: %s ...", m.version, m.description)
+
+		err = impl.Transaction(func(tx *gorm.DB) error {
+			err := m.migrate(tx)
+			if err != nil {
+				return err
+			}
+
+			return tx.Create(&models.SchemaMigration{
+				Version:     m.version,
+				Description: m.description,
+				AppliedAt:   time.Now().UTC(),
+			}).Error
+		})
+
+		if err != nil {
+			return fmt.Errorf("database migration %d failed: %s", m.version, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func createInitialSchema(tx *gorm.DB) error {
+	// The models are declared here as they looked when this migration was written, so
+	// that later changes to the models package do not alter what this migration does.
+	// Databases that were created before migrations were introduced are left intact.
+	type DeviceControlledProperty struct {
+		gorm.Model
+		Name         string `gorm:"unique"`
+		Abbreviation string
+	}
+
+	type DeviceModel struct {
+		gorm.Model
+		DeviceModelID        string `gorm:"unique"`
+		BrandName            string
+		ModelName            string
+		ManufacturerName     string
+		Name                 string
+		Category             string
+		ControlledProperties []DeviceControlledProperty `gorm:"many2many:devicemodel_ctrlprops;"`
+	}
+
+	type DeviceValue struct {
+		gorm.Model
+		DeviceID                   uint `gorm:"index:values_from_device"`
+		DeviceControlledPropertyID uint `gorm:"index:values_from_property"`
+		Value                      string
+		ObservedAt                 time.Time
+	}
+
+	type Device struct {
+		gorm.Model
+		DeviceID              string `gorm:"unique"`
+		Latitude              float64
+		Longitude             float64
+		Value                 string
+		DeviceModelID         uint
+		DeviceModel           DeviceModel
+		DateLastValueReported time.Time
+	}
+
+	return tx.AutoMigrate(&DeviceControlledProperty{}, &DeviceModel{}, &DeviceValue{}, &Device{})
+}
+
+func seedControlledProperties(tx *gorm.DB) error {
+	props := map[string]string{
+		"state":        "",
+		"fillingLevel": "l",
+		"snowDepth":    "snow",
+		"temperature":  "t",
+	}
+
+	timeNow := time.Now().UTC()
+
+	for property, abbreviation := range props {
+		var count int64
+		result := tx.Table("device_controlled_properties").Where("name = ?", property).Count(&count)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if count == 0 {
+			result = tx.Exec(
+				"INSERT INTO device_controlled_properties (created_at, updated_at, name, abbreviation) VALUES (?, ?, ?, ?)",
+				timeNow, timeNow, property, abbreviation,
+			)
+			if result.Error != nil {
+				return fmt.Errorf("failed to seed controlled property %s: %s", property, result.Error.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+//withdrawnMigration keeps the version of a migration that has been withdrawn, so that databases
+//that already applied it and those that did not end up with the same sequence of versions
+func withdrawnMigration(tx *gorm.DB) error {
+	// Version 3 swapped the coordinates of every device with a longitude larger than its latitude,
+	// which corrupts correct devices outside of Sweden. Swapped devices are repaired within a
+	// given region with the repair-coordinates command instead.
+	return nil
+}
+
+func addControlledPropertyUnitsAndTypes(tx *gorm.DB) error {
+	type DeviceControlledProperty struct {
+		UnitCode  string
+		ValueType string `gorm:"default:text"`
+	}
+
+	err := tx.AutoMigrate(&DeviceControlledProperty{})
+	if err != nil {
+		return err
+	}
+
+	// Units are expressed as UN/CEFACT common codes
+	seeds := []struct {
+		name      string
+		unitCode  string
+		valueType string
+	}{
+		{"state", "", "text"},
+		{"fillingLevel", "", "number"},
+		{"snowDepth", "CMT", "number"},
+		{"temperature", "CEL", "number"},
+	}
+
+	for _, seed := range seeds {
+		result := tx.Table("device_controlled_properties").Where("name = ?", seed.name).Updates(
+			map[string]interface{}{"unit_code": seed.unitCode, "value_type": seed.valueType},
+		)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+
+	return nil
+}
+
+func addTypedDeviceValues(tx *gorm.DB) error {
+	type DeviceControlledProperty struct {
+		AllowedValues string
+	}
+
+	type DeviceValue struct {
+		NumberValue *float64
+		BoolValue   *bool
+	}
+
+	err := tx.AutoMigrate(&DeviceControlledProperty{}, &DeviceValue{})
+	if err != nil {
+		return err
+	}
+
+	result := tx.Table("device_controlled_properties").Where("name = ?", "state").Updates(
+		map[string]interface{}{"value_type": "enum", "allowed_values": "on,off"},
+	)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	// Parse the existing values of all numeric properties and store them as numbers as well
+	numericProperties := tx.Table("device_controlled_properties").Select("id").Where("value_type = ?", "number")
+
+	type storedValue struct {
+		ID    uint
+		Value string
+	}
+
+	storedValues := []storedValue{}
+	result = tx.Table("device_values").Select("id, value").Where(
+		"device_controlled_property_id IN (?) AND number_value IS NULL", numericProperties,
+	).FindInBatches(&storedValues, 1000, func(_ *gorm.DB, _ int) error {
+		for _, v := range storedValues {
+			number, err := strconv.ParseFloat(v.Value, 64)
+			if err != nil {
+				// Values that were stored before validation was introduced may be malformed
+				continue
+			}
+
+			err = tx.Table("device_values").Where("id = ?", v.ID).Update("number_value", number).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return result.Error
+}
+
+func addRetentionPoliciesAndAggregates(tx *gorm.DB) error {
+	type DeviceControlledProperty struct {
+		RawValueRetentionDays  uint
+		AggregateRetentionDays uint
+	}
+
+	type DeviceValueAggregate struct {
+		gorm.Model
+		DeviceID                   uint      `gorm:"index:aggregates_from_device"`
+		DeviceControlledPropertyID uint      `gorm:"index:aggregates_from_property"`
+		PeriodStart                time.Time `gorm:"index:aggregates_by_period"`
+		PeriodLength               time.Duration
+		Count                      uint
+		Min                        float64
+		Max                        float64
+		Avg                        float64
+	}
+
+	return tx.AutoMigrate(&DeviceControlledProperty{}, &DeviceValueAggregate{})
+}
+
+func addDeadbands(tx *gorm.DB) error {
+	type Deadband struct {
+		DeadbandAbsolute  float64
+		DeadbandRelative  float64
+		MaxSilenceSeconds uint
+	}
+
+	type DeviceControlledProperty struct {
+		Deadband Deadband `gorm:"embedded"`
+	}
+
+	type DeviceModel struct {
+		Deadband Deadband `gorm:"embedded"`
+	}
+
+	return tx.AutoMigrate(&DeviceControlledProperty{}, &DeviceModel{})
+}
+
+func addDeviceLocationIndex(tx *gorm.DB) error {
+	// Lets geo queries narrow down the devices by a bounding box before comparing distances
+	return tx.Exec("CREATE INDEX IF NOT EXISTS devices_by_location ON devices (latitude, longitude)").Error
+}
+
+func addDeviceAttributes(tx *gorm.DB) error {
+	type Device struct {
+		Name            string
+		Description     string
+		SerialNumber    string
+		FirmwareVersion string
+		BatteryLevel    *float64
+		RSSI            *float64
+		DeviceState     string
+		Owner           string
+		DateInstalled   *time.Time
+		DateFirstUsed   *time.Time
+	}
+
+	return tx.AutoMigrate(&Device{})
+}
+
+func addTenants(tx *gorm.DB) error {
+	type Device struct {
+		Tenant   string
+		DeviceID string
+	}
+
+	type DeviceModel struct {
+		Tenant        string
+		DeviceModelID string
+	}
+
+	err := tx.AutoMigrate(&Device{}, &DeviceModel{})
+	if err != nil {
+		return err
+	}
+
+	// Everything that existed before tenants were introduced belongs to the default tenant
+	for _, table := range []string{"devices", "device_models"} {
+		result := tx.Exec(fmt.Sprintf("UPDATE %s SET tenant = '' WHERE tenant IS NULL", table))
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+
+	// The ids were globally unique in the initial schema, so that constraint is replaced by a
+	// unique index on the tenant and the id
+	err = dropUniqueConstraint(tx, &Device{}, "devices", "DeviceID")
+	if err != nil {
+		return err
+	}
+
+	err = dropUniqueConstraint(tx, &DeviceModel{}, "device_models", "DeviceModelID")
+	if err != nil {
+		return err
+	}
+
+	result := tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS devices_by_tenant ON devices (tenant, device_id)")
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS device_models_by_tenant ON device_models (tenant, device_model_id)").Error
+}
+
+//dropUniqueConstraint removes the unique constraint that gorm created for a field that was tagged
+//as unique in the initial schema. The model must declare the field without the unique tag.
+func dropUniqueConstraint(tx *gorm.DB, model interface{}, table, field string) error {
+	column := tx.NamingStrategy.ColumnName(table, field)
+
+	if tx.Dialector.Name() != "sqlite" {
+		return tx.Exec(fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s_%s_key", table, table, column)).Error
+	}
+
+	// SQLite can not drop constraints, so the table is rebuilt without it by AlterColumn. As the
+	// indices are dropped with the old table, we need to recreate them afterwards.
+	indices := []string{}
+	result := tx.Raw(
+		"SELECT sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL", table,
+	).Scan(&indices)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	err := tx.Migrator().AlterColumn(model, field)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indices {
+		result = tx.Exec(index)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+
+	return nil
+}
+
+func addAuditLog(tx *gorm.DB) error {
+	type AuditEntry struct {
+		ID         uint   `gorm:"primaryKey"`
+		Tenant     string `gorm:"index:audit_entries_by_entity"`
+		EntityID   string `gorm:"index:audit_entries_by_entity"`
+		EntityType string
+		Operation  string
+		Actor      string
+		SourceIP   string
+		Before     string
+		After      string
+		Timestamp  time.Time `gorm:"index:audit_entries_by_time"`
+	}
+
+	return tx.AutoMigrate(&AuditEntry{})
+}
+
+func clearZeroLastReportedDates(tx *gorm.DB) error {
+	// Devices that never reported a value were stored with the zero time, which matched every
+	// query for devices that have not reported since a given date
+	return tx.Exec(
+		"UPDATE devices SET date_last_value_reported = NULL WHERE date_last_value_reported < ?",
+		time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC),
+	).Error
+}
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/logging"
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/models"
+	"gorm.io/gorm"
+)
+
+//Region is a bounding box given by its south west and north east [longitude, latitude] corners
+type Region struct {
+	SouthWest [2]float64
+	NorthEast [2]float64
+}
+
+//Contains returns true if the [longitude, latitude] position lies within the region
+func (r Region) Contains(position [2]float64) bool {
+	return position[0] >= r.SouthWest[0] && position[0] <= r.NorthEast[0] &&
+		position[1] >= r.SouthWest[1] && position[1] <= r.NorthEast[1]
+}
+
+//CoordinateRepair describes a device whose latitude and longitude have been swapped
+type CoordinateRepair struct {
+	Tenant   string
+	DeviceID string
+	Before   [2]float64 // Longitude and latitude as stored
+	After    [2]float64 // Longitude and latitude after the repair
+}
+
+//RepairSwappedCoordinates connects to the database and swaps the latitude and longitude of
+//every device, in all tenants, that lies outside of the region but would lie inside of it with
+//its coordinates swapped. Nothing is changed in a dry run, but the repairs are still returned.
+func RepairSwappedCoordinates(connect ConnectorFunc, region Region, dryRun bool, log logging.Logger) ([]CoordinateRepair, error) {
+	impl, err := connect()
+	if err != nil {
+		return nil, err
+	}
+
+	return repairSwappedCoordinates(impl, region, dryRun, log)
+}
+
+func repairSwappedCoordinates(impl *gorm.DB, region Region, dryRun bool, log logging.Logger) ([]CoordinateRepair, error) {
+	if !isValidPosition(region.SouthWest) || !isValidPosition(region.NorthEast) ||
+		region.SouthWest[0] > region.NorthEast[0] || region.SouthWest[1] > region.NorthEast[1] {
+		return nil, NewError(ErrInvalidInput, "%v is not a valid region", region)
+	}
+
+	repairs := []CoordinateRepair{}
+
+	err := impl.Transaction(func(tx *gorm.DB) error {
+		devices := []models.Device{}
+		result := tx.Where(
+			"longitude BETWEEN ? AND ? AND latitude BETWEEN ? AND ?",
+			region.SouthWest[1], region.NorthEast[1], region.SouthWest[0], region.NorthEast[0],
+		).Order("id").Find(&devices)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		for _, device := range devices {
+			stored := [2]float64{device.Longitude, device.Latitude}
+			if region.Contains(stored) {
+				continue
+			}
+
+			repair := CoordinateRepair{
+				Tenant:   device.Tenant,
+				DeviceID: device.DeviceID,
+				Before:   stored,
+				After:    [2]float64{device.Latitude, device.Longitude},
+			}
+
+			if !dryRun {
+				result = tx.Model(&models.Device{}).Where("id = ?", device.ID).UpdateColumns(
+					map[string]interface{}{"longitude": repair.After[0], "latitude": repair.After[1]},
+				)
+				if result.Error != nil {
+					return fmt.Errorf("failed to repair the coordinates of device %s: %s", device.DeviceID, result.Error.Error())
+				}
+			}
+
+			log.Infof("Device %s (tenant %q) moved from %v to %v", device.DeviceID, device.Tenant, repair.Before, repair.After)
+			repairs = append(repairs, repair)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return repairs, nil
+}
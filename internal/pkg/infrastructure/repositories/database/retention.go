@@ -0,0 +1,190 @@
+package database
+
+import (
+	"time"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/models"
+
+	"gorm.io/gorm"
+)
+
+//aggregatePeriod is the length of the periods that numeric values are downsampled into
+const aggregatePeriod time.Duration = time.Hour
+
+//RetentionReport summarizes what ApplyRetentionPolicies did for a controlled property
+type RetentionReport struct {
+	ControlledProperty string
+	ValuesDeleted      int64
+	AggregatesCreated  int64
+	AggregatesDeleted  int64
+}
+
+func (db *myDB) ApplyRetentionPolicies(now time.Time) ([]RetentionReport, error) {
+	controlledProperties, err := db.GetControlledProperties()
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []RetentionReport{}
+
+	for idx := range controlledProperties {
+		property := &controlledProperties[idx]
+		report := RetentionReport{ControlledProperty: property.Name}
+
+		if property.RawValueRetentionDays > 0 {
+			// Only complete periods are aggregated
+			cutoff := now.UTC().Add(-days(property.RawValueRetentionDays)).Truncate(aggregatePeriod)
+
+			err = db.applyRawValueRetention(property, cutoff, &report)
+			if err != nil {
+				return reports, err
+			}
+		}
+
+		if property.AggregateRetentionDays > 0 {
+			cutoff := now.UTC().Add(-days(property.AggregateRetentionDays))
+
+			result := db.impl.Unscoped().Where(
+				"device_controlled_property_id = ? AND period_start < ?", property.ID, cutoff,
+			).Delete(&models.DeviceValueAggregate{})
+			if result.Error != nil {
+				return reports, result.Error
+			}
+
+			report.AggregatesDeleted = result.RowsAffected
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+func (db *myDB) applyRawValueRetention(property *models.DeviceControlledProperty, cutoff time.Time, report *RetentionReport) error {
+	deviceIDs := []uint{}
+	result := db.impl.Model(&models.DeviceValue{}).Where(
+		"device_controlled_property_id = ? AND observed_at < ?", property.ID, cutoff,
+	).Distinct("device_id").Pluck("device_id", &deviceIDs)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	// Downsample and delete the values one device at a time to keep transactions small
+	for _, deviceID := range deviceIDs {
+		err := db.impl.Transaction(func(tx *gorm.DB) error {
+			// The latest value of a device that has been quiet for longer than the retention is
+			// kept, as it is still the current value of the device and the baseline of its deadband
+			latest := []uint{}
+			result := tx.Model(&models.DeviceValue{}).Where(
+				"device_id = ? AND device_controlled_property_id = ?", deviceID, property.ID,
+			).Order("observed_at desc, id desc").Limit(1).Pluck("id", &latest)
+			if result.Error != nil {
+				return result.Error
+			}
+
+			expired := func(tx *gorm.DB) *gorm.DB {
+				tx = tx.Where("device_id = ? AND device_controlled_property_id = ? AND observed_at < ?", deviceID, property.ID, cutoff)
+				if len(latest) > 0 {
+					tx = tx.Where("id <> ?", latest[0])
+				}
+				return tx
+			}
+
+			if property.ValueType == models.ValueTypeNumber {
+				created, err := aggregateDeviceValues(tx, expired, deviceID, property.ID)
+				if err != nil {
+					return err
+				}
+				report.AggregatesCreated += created
+			}
+
+			result = tx.Unscoped().Scopes(expired).Delete(&models.DeviceValue{})
+			if result.Error != nil {
+				return result.Error
+			}
+
+			report.ValuesDeleted += result.RowsAffected
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//aggregateDeviceValues folds the expired numeric values into one aggregate per period. Values that
+//arrive late for an already aggregated period are merged into its aggregate.
+func aggregateDeviceValues(tx *gorm.DB, expired func(*gorm.DB) *gorm.DB, deviceID, propertyID uint) (int64, error) {
+	values := []models.DeviceValue{}
+	result := tx.Scopes(expired).Where("number_value IS NOT NULL").Order("observed_at").Find(&values)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	aggregates := []*models.DeviceValueAggregate{}
+	for _, value := range values {
+		periodStart := value.ObservedAt.UTC().Truncate(aggregatePeriod)
+		count := len(aggregates)
+
+		if count == 0 || !aggregates[count-1].PeriodStart.Equal(periodStart) {
+			aggregates = append(aggregates, &models.DeviceValueAggregate{
+				DeviceID:                   deviceID,
+				DeviceControlledPropertyID: propertyID,
+				PeriodStart:                periodStart,
+				PeriodLength:               aggregatePeriod,
+				Min:                        *value.NumberValue,
+				Max:                        *value.NumberValue,
+			})
+		}
+
+		addToAggregate(aggregates[len(aggregates)-1], 1, *value.NumberValue, *value.NumberValue, *value.NumberValue)
+	}
+
+	var created int64
+
+	for _, aggregate := range aggregates {
+		existing := &models.DeviceValueAggregate{}
+		result := tx.Where(
+			"device_id = ? AND device_controlled_property_id = ? AND period_start = ?",
+			deviceID, propertyID, aggregate.PeriodStart,
+		).Limit(1).Find(existing)
+		if result.Error != nil {
+			return created, result.Error
+		}
+
+		if result.RowsAffected == 1 {
+			addToAggregate(existing, aggregate.Count, aggregate.Min, aggregate.Max, aggregate.Avg)
+			aggregate = existing
+		} else {
+			created++
+		}
+
+		result = tx.Save(aggregate)
+		if result.Error != nil {
+			return created, result.Error
+		}
+	}
+
+	return created, nil
+}
+
+func addToAggregate(aggregate *models.DeviceValueAggregate, count uint, min, max, avg float64) {
+	if min < aggregate.Min {
+		aggregate.Min = min
+	}
+
+	if max > aggregate.Max {
+		aggregate.Max = max
+	}
+
+	total := aggregate.Count + count
+	aggregate.Avg = (aggregate.Avg*float64(aggregate.Count) + avg*float64(count)) / float64(total)
+	aggregate.Count = total
+}
+
+func days(count uint) time.Duration {
+	return time.Duration(count) * 24 * time.Hour
+}
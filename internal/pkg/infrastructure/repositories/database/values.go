@@ -0,0 +1,99 @@
+package database
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/iot-device-registry/internal/pkg/infrastructure/repositories/models"
+)
+
+//newDeviceValue parses a value according to the value type of its controlled property and
+//returns a DeviceValue with the typed value set, or an error describing why it was rejected
+func newDeviceValue(property *models.DeviceControlledProperty, value string) (*models.DeviceValue, error) {
+	deviceValue := &models.DeviceValue{
+		DeviceControlledPropertyID: property.ID,
+		Value:                      value,
+	}
+
+	switch property.ValueType {
+	case models.ValueTypeNumber:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, NewError(ErrInvalidInput, "value \"%s\" for %s is not a valid number", value, property.Name)
+		}
+		deviceValue.NumberValue = &number
+	case models.ValueTypeBoolean:
+		boolean, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, NewError(ErrInvalidInput, "value \"%s\" for %s is not a valid boolean", value, property.Name)
+		}
+		deviceValue.BoolValue = &boolean
+	case models.ValueTypeEnum:
+		allowedValues := property.GetAllowedValues()
+		if !contains(allowedValues, value) {
+			return nil, NewError(
+				ErrInvalidInput, "value \"%s\" for %s is not one of the allowed values [%s]",
+				value, property.Name, strings.Join(allowedValues, ","),
+			)
+		}
+	}
+
+	return deviceValue, nil
+}
+
+//isInsideDeadband returns true if the value is too close to the last stored value to be stored
+func isInsideDeadband(deadband models.Deadband, last, value *models.DeviceValue) bool {
+	if last == nil || !deadband.IsEnabled() {
+		return false
+	}
+
+	if deadband.MaxSilenceSeconds > 0 {
+		maxSilence := time.Duration(deadband.MaxSilenceSeconds) * time.Second
+		if value.ObservedAt.Sub(last.ObservedAt) >= maxSilence {
+			return false
+		}
+	}
+
+	if value.NumberValue != nil && last.NumberValue != nil {
+		delta := math.Abs(*value.NumberValue - *last.NumberValue)
+		return delta <= deadband.DeadbandAbsolute || delta <= deadband.DeadbandRelative*math.Abs(*last.NumberValue)
+	}
+
+	return value.Value == last.Value
+}
+
+func validateDeadband(deadband models.Deadband) error {
+	if deadband.DeadbandAbsolute < 0 || deadband.DeadbandRelative < 0 {
+		return NewError(ErrInvalidInput, "a deadband must not be negative")
+	}
+	return nil
+}
+
+func validateValueType(valueType string, allowedValues []string) error {
+	if !models.IsSupportedValueType(valueType) {
+		return NewError(ErrInvalidInput, "value type %s is not supported", valueType)
+	}
+
+	if valueType == models.ValueTypeEnum && len(allowedValues) == 0 {
+		return NewError(ErrInvalidInput, "value type %s requires a list of allowed values", valueType)
+	}
+
+	for _, v := range allowedValues {
+		if v == "" || strings.ContainsAny(v, ",;=") {
+			return NewError(ErrInvalidInput, "allowed value \"%s\" must not be empty or contain any of \",;=\"", v)
+		}
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+//Operations that are recorded in the audit log
+const (
+	AuditOperationCreate string = "create"
+	AuditOperationUpdate string = "update"
+	AuditOperationDelete string = "delete"
+)
+
+//AuditEntry records a change of an entity in the registry, who made it and from where. Audit
+//entries are only ever appended, and never updated or deleted until their retention expires.
+type AuditEntry struct {
+	ID         uint   `gorm:"primaryKey"`
+	Tenant     string `gorm:"index:audit_entries_by_entity"`
+	EntityID   string `gorm:"index:audit_entries_by_entity"`
+	EntityType string
+	Operation  string
+	Actor      string
+	SourceIP   string
+	// JSON snapshots of the entity, where Before is empty for created entities and After is
+	// empty for deleted entities
+	Before    string
+	After     string
+	Timestamp time.Time `gorm:"index:audit_entries_by_time"`
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -9,39 +10,160 @@ import (
 //Device is the database model to store devices in our database
 type Device struct {
 	gorm.Model
-	DeviceID              string `gorm:"unique"`
-	Latitude              float64
-	Longitude             float64
+	Tenant                string  `gorm:"uniqueIndex:devices_by_tenant"`
+	DeviceID              string  `gorm:"uniqueIndex:devices_by_tenant"`
+	Latitude              float64 `gorm:"index:devices_by_location"`
+	Longitude             float64 `gorm:"index:devices_by_location"`
 	Value                 string
 	DeviceModelID         uint
 	DeviceModel           DeviceModel
-	DateLastValueReported time.Time
+	DateLastValueReported *time.Time // nil until the device reports its first value
+
+	// Attributes from the FIWARE Device data model that are maintained by field technicians
+	Name            string
+	Description     string
+	SerialNumber    string
+	FirmwareVersion string
+	BatteryLevel    *float64 // Between 0 and 1, UndeterminedLevel, or nil if unknown
+	RSSI            *float64 // Between 0 and 1, UndeterminedLevel, or nil if unknown
+	DeviceState     string
+	Owner           string // Comma separated list of owners
+	DateInstalled   *time.Time
+	DateFirstUsed   *time.Time
+}
+
+//UndeterminedLevel is the battery level or RSSI of a device that can not be determined
+const UndeterminedLevel float64 = -1
+
+//GetOwners returns the list of owners of the device
+func (d *Device) GetOwners() []string {
+	if d.Owner == "" {
+		return []string{}
+	}
+	return strings.Split(d.Owner, ",")
+}
+
+//SetOwners stores the list of owners of the device
+func (d *Device) SetOwners(owners []string) {
+	d.Owner = strings.Join(owners, ",")
 }
 
 //DeviceModel is the database model to store Fiware Device Models in our database
 type DeviceModel struct {
 	gorm.Model
-	DeviceModelID        string `gorm:"unique"`
+	Tenant               string `gorm:"uniqueIndex:device_models_by_tenant"`
+	DeviceModelID        string `gorm:"uniqueIndex:device_models_by_tenant"`
 	BrandName            string
 	ModelName            string
 	ManufacturerName     string
 	Name                 string
 	Category             string
 	ControlledProperties []DeviceControlledProperty `gorm:"many2many:devicemodel_ctrlprops;"`
+
+	// A deadband that is set on a device model overrides the deadbands of its controlled properties
+	Deadband Deadband `gorm:"embedded"`
 }
 
-//DeviceValue stores the value from a point in time (observedAt)
+//DeviceValue stores the value from a point in time (observedAt). Numeric and boolean values
+//are also stored typed so that they can be aggregated without parsing the value string.
 type DeviceValue struct {
 	gorm.Model
 	DeviceID                   uint `gorm:"index:values_from_device"`
 	DeviceControlledPropertyID uint `gorm:"index:values_from_property"`
 	Value                      string
+	NumberValue                *float64
+	BoolValue                  *bool
 	ObservedAt                 time.Time
 }
 
+//DeviceValueAggregate stores the min, max and average of the numeric values that a device
+//reported for a controlled property during a period of time
+type DeviceValueAggregate struct {
+	gorm.Model
+	DeviceID                   uint      `gorm:"index:aggregates_from_device"`
+	DeviceControlledPropertyID uint      `gorm:"index:aggregates_from_property"`
+	PeriodStart                time.Time `gorm:"index:aggregates_by_period"`
+	PeriodLength               time.Duration
+	Count                      uint
+	Min                        float64
+	Max                        float64
+	Avg                        float64
+}
+
 //DeviceControlledProperty stores different properties that devices can control/sense/meter/whatever
 type DeviceControlledProperty struct {
 	gorm.Model
-	Name         string `gorm:"unique"`
-	Abbreviation string
+	Name          string `gorm:"unique"`
+	Abbreviation  string
+	UnitCode      string
+	ValueType     string
+	AllowedValues string
+
+	// Number of days to keep raw values, where zero means that they are kept forever. Numeric
+	// values are downsampled into hourly aggregates before they are deleted.
+	RawValueRetentionDays uint
+	// Number of days to keep hourly aggregates, where zero means that they are kept forever
+	AggregateRetentionDays uint
+
+	Deadband Deadband `gorm:"embedded"`
+}
+
+//Deadband decides when a new value is too close to the last stored value to be worth storing.
+//A value that is inside the deadband is still stored if the last stored value is older than
+//the max silence interval, so that gaps in the reported data can be detected.
+type Deadband struct {
+	DeadbandAbsolute  float64
+	DeadbandRelative  float64
+	MaxSilenceSeconds uint
+}
+
+//IsEnabled returns true if any part of the deadband is configured
+func (d Deadband) IsEnabled() bool {
+	return d.DeadbandAbsolute > 0 || d.DeadbandRelative > 0 || d.MaxSilenceSeconds > 0
+}
+
+//OverriddenBy returns the deadband with every part that is configured in the override replacing
+//the corresponding part of its own, so that a device model can override a single part of the
+//deadband of a controlled property
+func (d Deadband) OverriddenBy(override Deadband) Deadband {
+	if override.DeadbandAbsolute > 0 {
+		d.DeadbandAbsolute = override.DeadbandAbsolute
+	}
+
+	if override.DeadbandRelative > 0 {
+		d.DeadbandRelative = override.DeadbandRelative
+	}
+
+	if override.MaxSilenceSeconds > 0 {
+		d.MaxSilenceSeconds = override.MaxSilenceSeconds
+	}
+
+	return d
+}
+
+//GetAllowedValues returns the list of values that are allowed for an enum property
+func (p *DeviceControlledProperty) GetAllowedValues() []string {
+	if p.AllowedValues == "" {
+		return []string{}
+	}
+	return strings.Split(p.AllowedValues, ",")
+}
+
+//SetAllowedValues stores the list of values that are allowed for an enum property
+func (p *DeviceControlledProperty) SetAllowedValues(values []string) {
+	p.AllowedValues = strings.Join(values, ",")
+}
+
+//Supported value types for controlled properties
+const (
+	ValueTypeBoolean string = "boolean"
+	ValueTypeEnum    string = "enum"
+	ValueTypeNumber  string = "number"
+	ValueTypeText    string = "text"
+)
+
+//IsSupportedValueType returns true if the value type is one of the supported value types
+func IsSupportedValueType(valueType string) bool {
+	return valueType == ValueTypeBoolean || valueType == ValueTypeEnum ||
+		valueType == ValueTypeNumber || valueType == ValueTypeText
 }
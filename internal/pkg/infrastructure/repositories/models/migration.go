@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+//SchemaMigration records that a versioned schema migration has been applied to the database
+type SchemaMigration struct {
+	Version     uint `gorm:"primaryKey;autoIncrement:false"`
+	Description string
+	AppliedAt   time.Time
+}